@@ -1,12 +1,27 @@
 #!/bin/sh
 
 # This script will run the dhcp client. If `vlan_id=` in `/proc/cmdline` has a value, it will run the dhcp client only on the
-# VLAN interface.
+# VLAN interface. If hook-network listed interfaces in `/run/network/dhcp-interfaces`, it will run the dhcp client only on those.
+# As a service, it also runs the dhcp client on the interfaces leased by the built-in DHCP client of hook-network, listed in
+# `/run/network/dhcp-renew-interfaces`, so that their leases are renewed.
 # This script accepts an input parameter of true or false.
 # true: run the dhcp client with the one shot option
 # false: run the dhcp client as a service
 set -x
 
+# run_dhcp6_client runs the DHCPv6 client on the interfaces listed in /run/network/dhcp6-interfaces,
+# the interfaces of the static network configuration that get their IPv6 configuration with DHCPv6.
+run_dhcp6_client() {
+	one_shot="$1"
+	al=$(tr '\n' ',' < /run/network/dhcp6-interfaces | sed 's/,$//')
+
+	if [ "$one_shot" = "true" ]; then
+		/sbin/dhcpcd -f /dhcpcd.conf --ipv6only --waitip 6 --allowinterfaces "${al}" -1 || true
+	else
+		/sbin/dhcpcd --nobackground -f /dhcpcd.conf --ipv6only --allowinterfaces "${al}"
+	fi
+}
+
 run_dhcp_client() {
 	one_shot="$1"
 	al="e*"
@@ -21,34 +36,21 @@ run_dhcp_client() {
 		al="e*.*"
 	fi
 
+	# interfaces set up by hook-network, such as bonds, that get their address with DHCP
+	if [ -s /run/network/dhcp-interfaces ]; then
+		al=$(tr '\n' ',' < /run/network/dhcp-interfaces | sed 's/,$//')
+	fi
+
+	# interfaces leased by the built-in DHCP client of hook-network, whose leases the service renews
+	if [ "$one_shot" != "true" ] && [ -s /run/network/dhcp-renew-interfaces ]; then
+		al=$(cat /run/network/dhcp-interfaces /run/network/dhcp-renew-interfaces 2>/dev/null | tr '\n' ',' | sed 's/,$//')
+	fi
+
 	if [ "$one_shot" = "true" ]; then
 		# always return true for the one shot dhcp call so it doesn't block Hook from starting up.
 		# the --nobackground is not used here because when it is used, dhcpcd doesn't honor the --timeout option
 		# and waits indefinitely for a response. For one shot, we want to timeout after the 30 second default.
 		/sbin/dhcpcd -f /dhcpcd.conf --allowinterfaces "${al}" -1 || true
-
-		# use busybox's ntpd to set the time after getting an IP address; don't fail
-		echo "sleep 1 second before calling ntpd; date: '$(date)'" && sleep 1
-		if ! /usr/sbin/ntpd -n -q -dd -p pool.ntp.org; then
-			echo "ntpd call failed; setting time manually and retrying"
-			# set system time to the date of the dhcpd binary file
-			# this should recover from ntpd failures due to time being too far off
-			date -s "$(stat -c %y /sbin/dhcpcd | cut -d'.' -f1)" || true
-			tries=1	# retry up to 5 times
-			while [ $tries -le 5 ]; do
-				echo "waiting 1 second before retrying ntpd call; try #$tries ; date is now: '$(date)'"
-				sleep 1
-				if /usr/sbin/ntpd -n -q -dd -p pool.ntp.org; then
-					echo "ntpd retry call succeeded on try #$tries; date is now: '$(date)'"
-					break
-				else
-					echo "ntpd retry call failed on try #$tries"
-				fi
-				tries=$((tries + 1))
-			done
-		else
-			echo "ntpd call succeeded; date is now: '$(date)'"
-		fi
 	else
 		/sbin/dhcpcd --nobackground -f /dhcpcd.conf --allowinterfaces "${al}"
 	fi
@@ -56,8 +58,24 @@ run_dhcp_client() {
 }
 
 if [ -f /run/network/interfaces ] || [ -f /var/run/network/interfaces ]; then
-	echo "the /run/network/interfaces file or /var/run/network/interfaces file exists, so static IP's are in use. not running the dhcp client."
-	exit 0
+	echo "the /run/network/interfaces file or /var/run/network/interfaces file exists, so static IP's are in use."
+	if [ -s /run/network/dhcp6-interfaces ]; then
+		echo "running the DHCPv6 client on the interfaces in /run/network/dhcp6-interfaces"
+		if { [ -s /run/network/dhcp-interfaces ] || [ -s /run/network/dhcp-renew-interfaces ]; } && [ "$1" != "true" ]; then
+			# the DHCP client below runs in the foreground
+			run_dhcp6_client "$1" &
+		else
+			run_dhcp6_client "$1" || true
+		fi
+	fi
+	if [ "$1" != "true" ] && [ -s /run/network/dhcp-renew-interfaces ]; then
+		echo "renewing the leases of the interfaces in /run/network/dhcp-renew-interfaces"
+	elif [ ! -s /run/network/dhcp-interfaces ]; then
+		echo "not running the dhcp client."
+		exit 0
+	else
+		echo "running the dhcp client on the interfaces in /run/network/dhcp-interfaces"
+	fi
 fi
 
 # we always return true so that a failure here doesn't block the next container service from starting. Ideally, we always
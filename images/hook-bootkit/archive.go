@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// archiveMountPoint is where the hook-bootkit-archive onboot step mounts the file system of
+	// image_archive_path=, read only.
+	archiveMountPoint = "/image-archive"
+	// diskDir holds the by-label and by-uuid links of udev to the block devices.
+	diskDir = "/dev/disk"
+	// archiveDeviceTimeout is how long to wait for udev to create the link to the block device of
+	// image_archive_path=, as the USB devices can show up late.
+	archiveDeviceTimeout = 30 * time.Second
+	// archiveSpoolDir holds the image archive of image_archive_url= while it is verified and loaded.
+	archiveSpoolDir = "/var/run/image-archive-download"
+)
+
+// loadedImages are the references of the images loaded from the image archive. The archive is only
+// loaded once, not at every bootstrap attempt.
+var loadedImages []string
+
+// loadImageArchive loads the image archive of image_archive_url= or image_archive_path= with rt,
+// after verifying its SHA-256 checksum, and returns the references of the loaded images. It returns
+// no images when no archive is configured.
+func loadImageArchive(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig) ([]string, error) {
+	if loadedImages != nil || (cfg.imageArchiveURL == "" && cfg.imageArchivePath == "") {
+		return loadedImages, nil
+	}
+	if cfg.imageArchiveURL != "" && cfg.imageArchivePath != "" {
+		return nil, newBootstrapError(kindConfig, errors.New("image_archive_url= and image_archive_path= are mutually exclusive"))
+	}
+
+	var archive *os.File
+	var name, checksum string
+	var err error
+	if cfg.imageArchiveURL != "" {
+		name = cfg.imageArchiveURL
+		var body io.ReadCloser
+		if body, checksum, err = openArchiveURL(ctx, cfg.imageArchiveURL, cfg.imageArchiveSHA256); err != nil {
+			return nil, err
+		}
+		// The download is spooled, so that it is verified before the runtime reads it.
+		file, err := spoolArchive(body)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(file)
+		archive, err = os.Open(file)
+	} else {
+		name = cfg.imageArchivePath
+		archive, checksum, err = openArchivePath(cfg.imageArchivePath, cfg.imageArchiveSHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	log.Info("loading the image archive", "archive", name, "sha256", checksum)
+	start := time.Now()
+	refs, err := loadVerified(ctx, rt, archive, checksum)
+	if err != nil {
+		return nil, fmt.Errorf("loading the image archive %s failed: %w", name, err)
+	}
+	log.Info("loaded the image archive", "archive", name, "images", refs, "duration", time.Since(start).String())
+	loadedImages = refs
+	return refs, nil
+}
+
+// loadVerified loads the archive f with rt once its SHA-256 checksum is want, so that the runtime
+// never loads, nor tags, the images of a corrupted or tampered archive.
+func loadVerified(ctx context.Context, rt containerRuntime, f *os.File, want string) ([]string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("checksum mismatch: got sha256 %s, want %s", got, want))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return rt.Load(ctx, f)
+}
+
+// spoolArchive writes the downloaded archive to a file of archiveSpoolDir and returns its path.
+func spoolArchive(body io.ReadCloser) (string, error) {
+	defer body.Close()
+	if err := os.MkdirAll(archiveSpoolDir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(archiveSpoolDir, "image-archive-*.tar")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("downloading the image archive failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// openArchiveURL downloads the image archive. Without an expected checksum, it is read from the
+// url with a .sha256 suffix, in the sha256sum format.
+func openArchiveURL(ctx context.Context, url, checksum string) (io.ReadCloser, string, error) {
+	if checksum == "" {
+		body, err := httpGet(ctx, url+".sha256")
+		if err != nil {
+			return nil, "", newBootstrapError(kindConfig, fmt.Errorf("image_archive_sha256= is not set and reading the checksum failed: %w", err))
+		}
+		b, err := io.ReadAll(io.LimitReader(body, 4096))
+		body.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("reading the checksum of %s failed: %w", url, err)
+		}
+		checksum = string(b)
+	}
+	checksum, err := parseChecksum(checksum)
+	if err != nil {
+		return nil, "", newBootstrapError(kindConfig, fmt.Errorf("invalid checksum of %s: %w", url, err))
+	}
+	body, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, checksum, nil
+}
+
+// httpGet returns the body of a GET of url, through the proxy of the environment.
+func httpGet(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, newBootstrapError(kindConfig, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err := fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, newBootstrapError(kindNotFound, err)
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// openArchivePath opens the image archive of image_archive_path= on the file system that the
+// hook-bootkit-archive onboot step mounted, so that BootKit needs no access to the block devices.
+// Without an expected checksum, it is read from the archive path with a .sha256 suffix.
+func openArchivePath(spec, checksum string) (*os.File, string, error) {
+	_, name, err := splitArchivePath(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	file := filepath.Join(archiveMountPoint, name)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", newBootstrapError(kindNotFound, fmt.Errorf("the image archive of image_archive_path= is not on the file system mounted by the hook-bootkit-archive onboot step: %w", err))
+	}
+	if checksum == "" {
+		b, err := os.ReadFile(file + ".sha256")
+		if err != nil {
+			f.Close()
+			return nil, "", newBootstrapError(kindConfig, fmt.Errorf("image_archive_sha256= is not set and reading the checksum failed: %w", err))
+		}
+		checksum = string(b)
+	}
+	if checksum, err = parseChecksum(checksum); err != nil {
+		f.Close()
+		return nil, "", newBootstrapError(kindConfig, fmt.Errorf("invalid checksum of %s: %w", name, err))
+	}
+	return f, checksum, nil
+}
+
+// mountArchive mounts the file system of image_archive_path= read only at archiveMountPoint. It
+// runs as "bootkit mount-archive" in the hook-bootkit-archive onboot step, which has the block
+// devices that the hook-bootkit service does not.
+func mountArchive(ctx context.Context, log logr.Logger, spec string) error {
+	device, _, err := splitArchivePath(spec)
+	if err != nil {
+		return err
+	}
+	dev, err := devicePath(device)
+	if err != nil {
+		return newBootstrapError(kindConfig, fmt.Errorf("invalid image_archive_path=%q: %w", spec, err))
+	}
+	if err := waitForDevice(ctx, dev, archiveDeviceTimeout); err != nil {
+		return newBootstrapError(kindNotFound, fmt.Errorf("the file system %s of image_archive_path= was not found: %w", device, err))
+	}
+	fsType, err := mountReadOnly(dev, archiveMountPoint)
+	if err != nil {
+		return err
+	}
+	log.Info("mounted the file system of the image archive", "device", device, "type", fsType, "mountPoint", archiveMountPoint)
+	return nil
+}
+
+// splitArchivePath splits image_archive_path= in the DEVICE:/path form, where DEVICE is
+// LABEL=label, UUID=uuid or a /dev path, into the device and the path of the archive.
+func splitArchivePath(spec string) (string, string, error) {
+	device, name, ok := strings.Cut(spec, ":")
+	if !ok || !path.IsAbs(name) {
+		return "", "", newBootstrapError(kindConfig, fmt.Errorf("invalid image_archive_path=%q, must be LABEL=label:/path, UUID=uuid:/path or /dev/device:/path", spec))
+	}
+	return device, name, nil
+}
+
+// parseChecksum returns the SHA-256 checksum of s, which is either only the checksum or a line of
+// sha256sum.
+func parseChecksum(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum")
+	}
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 checksum", fields[0])
+	}
+	return sum, nil
+}
+
+// devicePath returns the path of the block device of LABEL=label, UUID=uuid or a /dev path.
+func devicePath(device string) (string, error) {
+	if label, ok := strings.CutPrefix(device, "LABEL="); ok && label != "" {
+		return filepath.Join(diskDir, "by-label", udevEncode(label)), nil
+	}
+	if uuid, ok := strings.CutPrefix(device, "UUID="); ok && uuid != "" {
+		return filepath.Join(diskDir, "by-uuid", udevEncode(strings.ToLower(uuid))), nil
+	}
+	if strings.HasPrefix(device, "/dev/") {
+		return device, nil
+	}
+	return "", fmt.Errorf("unsupported device %q", device)
+}
+
+// udevEncode encodes a label or UUID the way udev does in the names of the links, with the
+// characters other than letters, digits and #+-.:=@_ as \xNN.
+func udevEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80 || strings.IndexByte("#+-.:=@_", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, `\x%02x`, c)
+	}
+	return b.String()
+}
+
+// waitForDevice waits until dev exists.
+func waitForDevice(ctx context.Context, dev string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if _, err := os.Stat(dev); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s does not exist after %v", dev, timeout)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// mountReadOnly mounts dev read only at target, trying the file systems of the kernel like mount
+// does without a type. It returns the type of the file system.
+func mountReadOnly(dev, target string) (string, error) {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return "", err
+	}
+	var errs []error
+	for _, fsType := range blockFileSystems(f) {
+		err := unix.Mount(dev, target, fsType, unix.MS_RDONLY, "")
+		if err == nil {
+			return fsType, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", fsType, err))
+	}
+	return "", fmt.Errorf("mounting %s failed: %w", dev, errors.Join(errs...))
+}
+
+// blockFileSystems returns the file systems of /proc/filesystems that need a block device.
+func blockFileSystems(r io.Reader) []string {
+	var types []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 1 {
+			types = append(types, fields[0])
+		}
+	}
+	return types
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sum := strings.Repeat("ab", sha256.Size)
+	tests := map[string]struct {
+		checksum string
+		want     string
+		wantErr  bool
+	}{
+		"checksum":       {checksum: sum, want: sum},
+		"upper case":     {checksum: strings.ToUpper(sum), want: sum},
+		"digest":         {checksum: "sha256:" + sum, want: sum},
+		"sha256sum line": {checksum: sum + "  images.tar\n", want: sum},
+		"empty":          {checksum: "\n", wantErr: true},
+		"too short":      {checksum: "abab", wantErr: true},
+		"not hex":        {checksum: strings.Repeat("zz", sha256.Size), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseChecksum(tt.checksum)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevicePath(t *testing.T) {
+	tests := map[string]struct {
+		device  string
+		want    string
+		wantErr bool
+	}{
+		"label":            {device: "LABEL=HOOKIMAGES", want: "/dev/disk/by-label/HOOKIMAGES"},
+		"label with space": {device: "LABEL=HOOK IMAGES", want: `/dev/disk/by-label/HOOK\x20IMAGES`},
+		"uuid":             {device: "UUID=2F3A-1C0B", want: "/dev/disk/by-uuid/2f3a-1c0b"},
+		"device":           {device: "/dev/sdb1", want: "/dev/sdb1"},
+		"empty label":      {device: "LABEL=", wantErr: true},
+		"unsupported":      {device: "PARTUUID=0a1b2c3d-01", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := devicePath(tt.device)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockFileSystems(t *testing.T) {
+	filesystems := "nodev\tsysfs\nnodev\ttmpfs\n\text4\n\tvfat\nnodev\toverlay\n\tiso9660\n"
+	want := []string{"ext4", "vfat", "iso9660"}
+	if diff := cmp.Diff(want, blockFileSystems(strings.NewReader(filesystems))); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLoadImageArchive(t *testing.T) {
+	archive := "a docker save archive"
+	h := sha256.Sum256([]byte(archive))
+	sum := hex.EncodeToString(h[:])
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images.tar":
+			_, _ = io.WriteString(w, archive)
+		case "/images.tar.sha256":
+			_, _ = io.WriteString(w, sum+"  images.tar\n")
+		case "/corrupted.tar":
+			_, _ = io.WriteString(w, archive[1:])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	mounted := t.TempDir()
+	if err := os.WriteFile(filepath.Join(mounted, "images.tar"), []byte(archive), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := archiveMountPoint
+	archiveMountPoint = mounted
+	t.Cleanup(func() { archiveMountPoint = old })
+	oldSpool := archiveSpoolDir
+	archiveSpoolDir = t.TempDir()
+	t.Cleanup(func() { archiveSpoolDir = oldSpool })
+
+	tests := map[string]struct {
+		cfg      tinkWorkerConfig
+		want     []string
+		wantKind errorKind
+	}{
+		"no archive":                         {},
+		"checksum file":                      {cfg: tinkWorkerConfig{imageArchiveURL: srv.URL + "/images.tar"}, want: []string{"quay.io/tinkerbell/tink-worker:latest"}},
+		"checksum":                           {cfg: tinkWorkerConfig{imageArchiveURL: srv.URL + "/corrupted.tar", imageArchiveSHA256: "sha256:" + sum}, wantKind: kindConfig},
+		"no checksum":                        {cfg: tinkWorkerConfig{imageArchiveURL: srv.URL + "/corrupted.tar"}, wantKind: kindConfig},
+		"missing archive":                    {cfg: tinkWorkerConfig{imageArchiveURL: srv.URL + "/missing.tar", imageArchiveSHA256: sum}, wantKind: kindNotFound},
+		"archive path":                       {cfg: tinkWorkerConfig{imageArchivePath: "LABEL=HOOKIMAGES:/images.tar", imageArchiveSHA256: sum}, want: []string{"quay.io/tinkerbell/tink-worker:latest"}},
+		"archive path checksum file missing": {cfg: tinkWorkerConfig{imageArchivePath: "LABEL=HOOKIMAGES:/images.tar"}, wantKind: kindConfig},
+		"archive not mounted":                {cfg: tinkWorkerConfig{imageArchivePath: "LABEL=HOOKIMAGES:/missing.tar", imageArchiveSHA256: sum}, wantKind: kindNotFound},
+		"invalid archive path":               {cfg: tinkWorkerConfig{imageArchivePath: "LABEL=HOOKIMAGES"}, wantKind: kindConfig},
+		"both":                               {cfg: tinkWorkerConfig{imageArchiveURL: srv.URL + "/images.tar", imageArchivePath: "LABEL=HOOKIMAGES:/images.tar"}, wantKind: kindConfig},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			loadedImages = nil
+			t.Cleanup(func() { loadedImages = nil })
+			var loaded bool
+			rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != podmanAPIPrefix+"/images/load" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				loaded = true
+				if _, err := io.ReadAll(r.Body); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = io.WriteString(w, `{"cause":"unexpected EOF","message":"unexpected EOF","response":400}`)
+					return
+				}
+				_, _ = io.WriteString(w, `{"Names":["quay.io/tinkerbell/tink-worker:latest"]}`)
+			})
+			got, err := loadImageArchive(context.Background(), logr.Discard(), rt, tt.cfg)
+			if spooled, _ := os.ReadDir(archiveSpoolDir); len(spooled) > 0 {
+				t.Errorf("the downloaded archive was not removed: %v", spooled)
+			}
+			if tt.wantKind != "" {
+				if kindOf(err) != tt.wantKind {
+					t.Fatalf("got err %v of kind %q, want kind %q", err, kindOf(err), tt.wantKind)
+				}
+				if loaded {
+					t.Error("the runtime loaded an archive that was not verified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// dhcpLeaseFile is where the built-in DHCP client of hook-network records its leases.
+var dhcpLeaseFile = "/run/network/dhcp-lease.json"
+
+// dhcpSettings are the settings that DHCP options can set. The others, such as docker_registry,
+// tink_worker_image, tink_worker_spec or worker_id, would let whoever answers DHCP requests run
+// privileged containers, receive the registry credentials or take over the workflows of another
+// machine.
+var dhcpSettings = []string{"grpc_authority", "tinkerbell_tls", "hook_events_url", "otel_endpoint"}
+
+// dhcpLease is the part of a hook-network lease that can carry BootKit settings.
+type dhcpLease struct {
+	Options         map[string]string            `json:"options"`
+	VendorOptions   map[string]string            `json:"vendorOptions"`
+	VIVendorOptions map[string]map[string]string `json:"viVendorOptions"`
+}
+
+// dhcpCmdLine returns the kernel command line style key=value settings in the DHCP leases, from the
+// sub-options of the vendor-specific information options (43 and 125) and from the site-specific
+// options (224 to 254). A value can hold several space separated settings, for example
+// "grpc_authority=tink.example.com:42113 tinkerbell_tls=false".
+// Only the dhcpSettings are returned, the keys of the other settings are returned as ignored.
+// It returns nothing when there is no lease file, which is the case unless hook_dhcp_client=go is set.
+func dhcpCmdLine(path string) (settings, ignored []string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil
+	}
+	var leases []dhcpLease
+	if err := json.Unmarshal(b, &leases); err != nil {
+		return nil, nil
+	}
+	var values []string
+	for _, l := range leases {
+		for _, code := range slices.Sorted(maps.Keys(l.VendorOptions)) {
+			values = append(values, l.VendorOptions[code])
+		}
+		for _, enterprise := range slices.Sorted(maps.Keys(l.VIVendorOptions)) {
+			for _, code := range slices.Sorted(maps.Keys(l.VIVendorOptions[enterprise])) {
+				values = append(values, l.VIVendorOptions[enterprise][code])
+			}
+		}
+		for code := 224; code <= 254; code++ {
+			if v, err := hex.DecodeString(l.Options[strconv.Itoa(code)]); err == nil {
+				values = append(values, string(v))
+			}
+		}
+	}
+
+	for _, v := range values {
+		for _, f := range strings.Fields(v) {
+			key, _, ok := strings.Cut(f, "=")
+			switch {
+			case !ok || key == "":
+			case slices.Contains(dhcpSettings, key):
+				settings = append(settings, f)
+			default:
+				ignored = append(ignored, key)
+			}
+		}
+	}
+	return settings, ignored
+}
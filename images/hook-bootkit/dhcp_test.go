@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDHCPCmdLine(t *testing.T) {
+	site := func(s string) string { return hex.EncodeToString([]byte(s)) }
+	tests := map[string]struct {
+		content     string
+		want        []string
+		wantIgnored []string
+	}{
+		"no lease file": {},
+		"invalid":       {content: `{"options":`},
+		"vendor and site-specific options": {
+			content: `[{
+				"options": {"1": "ffffff00", "224": "` + site("docker_registry=registry.example tink_worker_image=registry.example/tink-worker:v1") + `", "230": "` + site("not a setting") + `"},
+				"vendorOptions": {"2": "worker_id=de:ad:be:ef:fe:ed", "1": "grpc_authority=tink.example:42113"},
+				"viVendorOptions": {"59449": {"1": "tinkerbell_tls=false"}}
+			}]`,
+			want: []string{
+				"grpc_authority=tink.example:42113",
+				"tinkerbell_tls=false",
+			},
+			wantIgnored: []string{"worker_id", "docker_registry", "tink_worker_image"},
+		},
+		"lease without options": {content: `[{"options": {"1": "ffffff00"}}]`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dhcp-lease.json")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, ignored := dhcpCmdLine(path)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.wantIgnored, ignored); diff != "" {
+				t.Errorf("ignored: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDHCPCmdLinePrecedence(t *testing.T) {
+	cmdLine := []string{"grpc_authority=tink.example:42113", "otel_endpoint=otel.example:4317"}
+	cfg := parseCmdLine(append(cmdLine, "grpc_authority=override.example:42113"))
+	if cfg.grpcAuthority != "override.example:42113" {
+		t.Errorf("got grpc_authority %q, want the kernel command line value", cfg.grpcAuthority)
+	}
+	if cfg.otelEndpoint != "otel.example:4317" {
+		t.Errorf("got otel_endpoint %q, want the DHCP value", cfg.otelEndpoint)
+	}
+}
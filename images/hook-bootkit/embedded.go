@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+)
+
+// embeddedManifestFile is the manifest of the images that hook-embedded baked into the image
+// store of hook-docker, written by images/hook-embedded/pull-images.sh or embed-images.
+var embeddedManifestFile = "/embedded/embedded-images.json"
+
+// embeddedArchiveFile is the image archive written by embed-images, which is imported into the
+// image store at boot instead of being baked into it. Its checksum is in the file with a .sha256
+// suffix.
+var embeddedArchiveFile = "/embedded/embedded-images.tar"
+
+// embeddedImage is an image of the embedded image manifest.
+type embeddedImage struct {
+	Reference string `json:"reference"`
+	// Digest is the image ID, the digest of the image config. Unlike the repository digests, it
+	// is kept by docker save and docker load.
+	Digest string `json:"digest"`
+}
+
+// readEmbeddedManifest reads the embedded image manifest. A missing manifest, as in HookOS builds
+// without embedded images, is not an error.
+func readEmbeddedManifest(name string) ([]embeddedImage, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var images []embeddedImage
+	if err := json.Unmarshal(b, &images); err != nil {
+		return nil, fmt.Errorf("invalid embedded image manifest %s: %w", name, err)
+	}
+	for _, img := range images {
+		if _, err := normalizeImageName(img.Reference); err != nil {
+			return nil, fmt.Errorf("invalid embedded image manifest %s: %w", name, err)
+		}
+		if _, err := digest.Parse(img.Digest); err != nil {
+			return nil, fmt.Errorf("invalid embedded image manifest %s: image %s: %w", name, img.Reference, err)
+		}
+	}
+	return images, nil
+}
+
+// verifyEmbeddedImages checks the embedded images against the local image store of rt and logs
+// the ones that are missing or do not match their digest. It returns the digests of the images that
+// match, by normalized reference.
+func verifyEmbeddedImages(ctx context.Context, log logr.Logger, rt containerRuntime, images []embeddedImage) map[string]string {
+	verified := map[string]string{}
+	for _, img := range images {
+		id, err := rt.ImageID(ctx, img.Reference)
+		switch {
+		case err != nil:
+			log.Error(err, "checking the embedded image failed", "reference", img.Reference)
+		case id == "":
+			log.Info("embedded image is missing from the local image store", "reference", img.Reference, "digest", img.Digest)
+		case id != img.Digest:
+			log.Info("embedded image does not match the manifest", "reference", img.Reference, "digest", img.Digest, "localDigest", id)
+		default:
+			name, _ := normalizeImageName(img.Reference)
+			verified[name] = img.Digest
+		}
+	}
+	log.Info("verified the embedded images", "images", len(images), "matching", len(verified))
+	return verified
+}
+
+// importEmbeddedArchive imports the embedded image archive with rt when some of the embedded images
+// were not verified, as in the first bootstrap attempt, and returns the verified images again. A
+// missing archive, as in HookOS builds with pull-images.sh, is not an error.
+func importEmbeddedArchive(ctx context.Context, log logr.Logger, rt containerRuntime, images []embeddedImage, verified map[string]string) (map[string]string, error) {
+	missing := false
+	for _, img := range images {
+		if name, _ := normalizeImageName(img.Reference); verified[name] == "" {
+			missing = true
+		}
+	}
+	if !missing {
+		return verified, nil
+	}
+	f, err := os.Open(embeddedArchiveFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return verified, nil
+		}
+		return verified, err
+	}
+	defer f.Close()
+	b, err := os.ReadFile(embeddedArchiveFile + ".sha256")
+	if err != nil {
+		return verified, fmt.Errorf("reading the checksum of the embedded image archive failed: %w", err)
+	}
+	checksum, err := parseChecksum(string(b))
+	if err != nil {
+		return verified, fmt.Errorf("invalid checksum of the embedded image archive: %w", err)
+	}
+
+	log.Info("importing the embedded image archive", "archive", embeddedArchiveFile, "sha256", checksum)
+	start := time.Now()
+	refs, err := loadVerified(ctx, rt, f, checksum)
+	if err != nil {
+		return verified, fmt.Errorf("importing the embedded image archive failed: %w", err)
+	}
+	log.Info("imported the embedded image archive", "images", refs, "duration", time.Since(start).String())
+	return verifyEmbeddedImages(ctx, log, rt, images), nil
+}
+
+// normalizeImageName returns the fully qualified form of an image reference, with the latest tag
+// when it has neither a tag nor a digest, so that tink-worker and
+// docker.io/library/tink-worker:latest are the same image.
+func normalizeImageName(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
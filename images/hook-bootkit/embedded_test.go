@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	workerDigest = "sha256:0a7e2c0b3b7c2f6d2bd6ed5a5c1b7d64a25d3b1c24f3f11e1c1d5a8b7f1f3e21"
+	cexecDigest  = "sha256:5d6cf1d5a0e1d1e7c0c9b4b3a1f2e4d5c6b7a8f9e0d1c2b3a4f5e6d7c8b9a0f1"
+)
+
+func TestReadEmbeddedManifest(t *testing.T) {
+	tests := map[string]struct {
+		manifest string
+		want     []embeddedImage
+		wantErr  bool
+	}{
+		"no manifest": {},
+		"manifest": {
+			manifest: `[{"reference":"quay.io/tinkerbell/tink-worker:v0.10.0","digest":"` + workerDigest + `"}]`,
+			want:     []embeddedImage{{Reference: "quay.io/tinkerbell/tink-worker:v0.10.0", Digest: workerDigest}},
+		},
+		"invalid reference": {manifest: `[{"reference":"Quay.io/UPPER","digest":"` + workerDigest + `"}]`, wantErr: true},
+		"invalid digest":    {manifest: `[{"reference":"tink-worker","digest":"0a7e2c0b"}]`, wantErr: true},
+		"invalid JSON":      {manifest: `[{"reference":`, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "embedded-images.json")
+			if tt.manifest != "" {
+				if err := os.WriteFile(file, []byte(tt.manifest), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := readEmbeddedManifest(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestVerifyEmbeddedImages(t *testing.T) {
+	// The local image store of the fake libpod API, with the IDs without the sha256: prefix as libpod reports them.
+	store := map[string]string{
+		"quay.io/tinkerbell/tink-worker:v0.10.0": strings.TrimPrefix(workerDigest, "sha256:"),
+		"127.0.0.1/embedded/actions/cexec":       strings.TrimPrefix(workerDigest, "sha256:"),
+	}
+	rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, podmanAPIPrefix+"/images/"), "/json")
+		id, ok := store[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"cause":"failed to find image","message":"failed to find image ` + ref + `: image not known","response":404}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Id":"` + id + `"}`))
+	})
+
+	images := []embeddedImage{
+		{Reference: "quay.io/tinkerbell/tink-worker:v0.10.0", Digest: workerDigest},
+		{Reference: "127.0.0.1/embedded/actions/cexec", Digest: cexecDigest},
+		{Reference: "quay.io/tinkerbell/actions/image2disk:latest", Digest: cexecDigest},
+	}
+	got := verifyEmbeddedImages(context.Background(), logr.Discard(), rt, images)
+	want := map[string]string{"quay.io/tinkerbell/tink-worker:v0.10.0": workerDigest}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestNormalizeImageName(t *testing.T) {
+	tests := map[string]struct {
+		ref  string
+		want string
+	}{
+		"docker hub":  {ref: "tink-worker", want: "docker.io/library/tink-worker:latest"},
+		"tag":         {ref: "quay.io/tinkerbell/tink-worker:v0.10.0", want: "quay.io/tinkerbell/tink-worker:v0.10.0"},
+		"no tag":      {ref: "127.0.0.1/embedded/tink-worker", want: "127.0.0.1/embedded/tink-worker:latest"},
+		"with digest": {ref: "quay.io/tinkerbell/tink-worker@" + workerDigest, want: "quay.io/tinkerbell/tink-worker@" + workerDigest},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := normalizeImageName(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportEmbeddedArchive(t *testing.T) {
+	archive := "an embed-images archive"
+	h := sha256.Sum256([]byte(archive))
+	sum := hex.EncodeToString(h[:])
+	images := []embeddedImage{{Reference: "quay.io/tinkerbell/tink-worker:v0.10.0", Digest: workerDigest}}
+
+	tests := map[string]struct {
+		archive  string
+		checksum string
+		verified map[string]string
+		want     map[string]string
+		wantLoad bool
+		wantErr  bool
+	}{
+		"no archive": {verified: map[string]string{}, want: map[string]string{}},
+		"imported":   {archive: archive, checksum: sum + "  embedded-images.tar\n", verified: map[string]string{}, want: map[string]string{"quay.io/tinkerbell/tink-worker:v0.10.0": workerDigest}, wantLoad: true},
+		"already imported": {
+			archive: archive, checksum: sum,
+			verified: map[string]string{"quay.io/tinkerbell/tink-worker:v0.10.0": workerDigest},
+			want:     map[string]string{"quay.io/tinkerbell/tink-worker:v0.10.0": workerDigest},
+		},
+		"checksum mismatch": {archive: archive[1:], checksum: sum, verified: map[string]string{}, want: map[string]string{}, wantErr: true},
+		"no checksum":       {archive: archive, verified: map[string]string{}, want: map[string]string{}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "embedded-images.tar")
+			old := embeddedArchiveFile
+			embeddedArchiveFile = file
+			t.Cleanup(func() { embeddedArchiveFile = old })
+			if tt.archive != "" {
+				if err := os.WriteFile(file, []byte(tt.archive), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.checksum != "" {
+				if err := os.WriteFile(file+".sha256", []byte(tt.checksum), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var loaded bool
+			rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == podmanAPIPrefix+"/images/load" {
+					loaded = true
+					if _, err := io.ReadAll(r.Body); err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						_, _ = w.Write([]byte(`{"cause":"unexpected EOF","message":"unexpected EOF","response":400}`))
+						return
+					}
+					_, _ = w.Write([]byte(`{"Names":["quay.io/tinkerbell/tink-worker:v0.10.0"]}`))
+					return
+				}
+				if !loaded {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"cause":"failed to find image","message":"image not known","response":404}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"Id":"` + strings.TrimPrefix(workerDigest, "sha256:") + `"}`))
+			})
+			got, err := importEmbeddedArchive(context.Background(), logr.Discard(), rt, images, tt.verified)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if loaded != tt.wantLoad {
+				t.Errorf("got load %v, want %v", loaded, tt.wantLoad)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/client"
+)
+
+// errorKind is the category of a bootstrap failure.
+type errorKind string
+
+const (
+	kindUnknown           errorKind = "unknown"
+	kindConfig            errorKind = "configuration"
+	kindAuth              errorKind = "auth"
+	kindNotFound          errorKind = "not_found"
+	kindNetwork           errorKind = "network"
+	kindDaemonUnavailable errorKind = "daemon_unavailable"
+	kindContainerCrash    errorKind = "container_crash"
+)
+
+// permanent reports whether errors of this kind need an operator to change something before a retry can succeed.
+func (k errorKind) permanent() bool {
+	switch k {
+	case kindConfig, kindAuth, kindNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// bootstrapError is a classified bootstrap failure.
+type bootstrapError struct {
+	kind errorKind
+	err  error
+}
+
+func (b *bootstrapError) Error() string {
+	return b.err.Error()
+}
+
+func (b *bootstrapError) Unwrap() error {
+	return b.err
+}
+
+// newBootstrapError returns err classified as kind.
+func newBootstrapError(kind errorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &bootstrapError{kind: kind, err: err}
+}
+
+// classify wraps err in a bootstrapError, detecting its kind from the Docker API error or the error message.
+// Errors that are already classified are returned as is.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var be *bootstrapError
+	if errors.As(err, &be) {
+		return err
+	}
+	return newBootstrapError(detectKind(err), err)
+}
+
+// kindOf returns the kind of err, classifying it if needed.
+func kindOf(err error) errorKind {
+	var be *bootstrapError
+	if errors.As(err, &be) {
+		return be.kind
+	}
+	return detectKind(err)
+}
+
+func detectKind(err error) errorKind {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return kindUnknown
+	}
+	if client.IsErrConnectionFailed(err) {
+		return kindDaemonUnavailable
+	}
+	switch {
+	case cerrdefs.IsUnauthorized(err), cerrdefs.IsPermissionDenied(err):
+		return kindAuth
+	// Only a missing image needs an operator: a missing container, network or bind source can be
+	// there at the next attempt.
+	case cerrdefs.IsNotFound(err) && isImageNotFound(err):
+		return kindNotFound
+	case cerrdefs.IsInvalidArgument(err), isReferenceError(err):
+		return kindConfig
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return kindNetwork
+	}
+
+	// The Docker daemon reports registry failures, and errors embedded in the
+	// image pull stream are plain strings, so fall back to the message.
+	msg := strings.ToLower(err.Error())
+	switch {
+	case containsAny(msg, "unauthorized", "authentication required", "access denied", "denied: "):
+		return kindAuth
+	case isImageNotFound(err):
+		return kindNotFound
+	case containsAny(msg, "invalid reference format"):
+		return kindConfig
+	case containsAny(msg, "dial tcp", "no such host", "i/o timeout", "connection refused", "connection reset",
+		"network is unreachable", "tls handshake timeout", "server misbehaving", "proxyconnect"):
+		return kindNetwork
+	case cerrdefs.IsUnavailable(err):
+		return kindNetwork
+	}
+	return kindUnknown
+}
+
+// isImageNotFound reports whether err is about a missing image, from the messages of Docker, Podman
+// and containerd. Not a bare "not found", which is also how missing files, devices and networks
+// are reported.
+func isImageNotFound(err error) bool {
+	return containsAny(strings.ToLower(err.Error()), "manifest unknown", "no such image", "image not known", "failed to resolve reference")
+}
+
+func isReferenceError(err error) bool {
+	for _, rerr := range []error{
+		reference.ErrReferenceInvalidFormat, reference.ErrNameEmpty, reference.ErrNameContainsUppercase,
+		reference.ErrTagInvalidFormat, reference.ErrDigestInvalidFormat, reference.ErrNameTooLong,
+	} {
+		if errors.Is(err, rerr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermanent reports whether retrying err right away is pointless, because it
+// will only succeed after someone changes the configuration.
+func isPermanent(err error) bool {
+	var pe *backoff.PermanentError
+	if errors.As(err, &pe) {
+		return true
+	}
+	return kindOf(err).permanent()
+}
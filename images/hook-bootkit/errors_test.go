@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/go-logr/logr"
+)
+
+// fakeDocker returns a Docker client for a fake Docker API that answers every request with status and body.
+func fakeDocker(t *testing.T, status int, body string) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost(srv.URL), client.WithVersion("1.47"), client.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestClassifyDockerResponses(t *testing.T) {
+	pull := func(cli *client.Client) error {
+		_, err := pullImage(context.Background(), logr.Discard(), cli, "quay.io/tinkerbell/tink-worker:latest", image.PullOptions{})
+		return err
+	}
+	tests := map[string]struct {
+		status    int
+		body      string
+		call      func(*client.Client) error
+		want      errorKind
+		permanent bool
+	}{
+		"pull unauthorized": {
+			status: http.StatusUnauthorized, body: `{"message":"Head \"https://quay.io/v2/tinkerbell/tink-worker/manifests/latest\": unauthorized"}`,
+			call: pull, want: kindAuth, permanent: true,
+		},
+		"pull manifest unknown": {
+			status: http.StatusNotFound, body: `{"message":"manifest for quay.io/tinkerbell/tink-worker:nope not found: manifest unknown"}`,
+			call: pull, want: kindNotFound, permanent: true,
+		},
+		"pull registry unreachable": {
+			status: http.StatusInternalServerError, body: `{"message":"Get \"https://quay.io/v2/\": dial tcp: lookup quay.io on 10.0.0.1:53: no such host"}`,
+			call: pull, want: kindNetwork,
+		},
+		"pull auth error inside the stream": {
+			status: http.StatusOK, body: `{"errorDetail":{"message":"unauthorized: authentication required"},"error":"unauthorized: authentication required"}`,
+			call: pull, want: kindAuth, permanent: true,
+		},
+		"pull registry unavailable": {
+			status: http.StatusServiceUnavailable, body: `{"message":"received unexpected HTTP status: 503 Service Unavailable"}`,
+			call: pull, want: kindNetwork,
+		},
+		"create with an invalid config": {
+			status: http.StatusBadRequest, body: `{"message":"invalid mount config for type \"bind\": bind source path does not exist: /worker"}`,
+			call: func(cli *client.Client) error {
+				_, err := cli.ContainerCreate(context.Background(), &container.Config{}, nil, nil, nil, "tink-worker")
+				return err
+			},
+			want: kindConfig, permanent: true,
+		},
+		"container exited": {
+			status: http.StatusOK, body: `{"Id":"abc","State":{"Running":false,"ExitCode":1,"Error":""}}`,
+			call: func(cli *client.Client) error {
+				return checkContainerRunning(context.Background(), &dockerRuntime{cli: cli}, "abc", time.Second)
+			},
+			want: kindContainerCrash,
+		},
+		"start with a missing file": {
+			status: http.StatusInternalServerError, body: `{"message":"failed to create task for container: exec: \"/usr/bin/tink-worker\": stat /usr/bin/tink-worker: no such file or directory: not found"}`,
+			call: func(cli *client.Client) error {
+				return cli.ContainerStart(context.Background(), "abc", container.StartOptions{})
+			},
+			want: kindUnknown,
+		},
+		"inspect a missing image": {
+			status: http.StatusNotFound, body: `{"message":"No such image: quay.io/tinkerbell/tink-worker:nope"}`,
+			call: func(cli *client.Client) error {
+				_, err := cli.ImageInspect(context.Background(), "quay.io/tinkerbell/tink-worker:nope")
+				return err
+			},
+			want: kindNotFound, permanent: true,
+		},
+		"inspect a missing container": {
+			status: http.StatusNotFound, body: `{"message":"No such container: abc"}`,
+			call: func(cli *client.Client) error {
+				_, err := cli.ContainerInspect(context.Background(), "abc")
+				return err
+			},
+			want: kindUnknown,
+		},
+		"create with a missing network": {
+			status: http.StatusNotFound, body: `{"message":"network hook-net not found"}`,
+			call: func(cli *client.Client) error {
+				_, err := cli.ContainerCreate(context.Background(), &container.Config{}, nil, nil, nil, "tink-worker")
+				return err
+			},
+			want: kindUnknown,
+		},
+		"daemon error": {
+			status: http.StatusInternalServerError, body: `{"message":"something unexpected happened"}`,
+			call: func(cli *client.Client) error {
+				return checkContainerRunning(context.Background(), &dockerRuntime{cli: cli}, "abc", time.Second)
+			},
+			want: kindUnknown,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := classify(tt.call(fakeDocker(t, tt.status, tt.body)))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := kindOf(err); got != tt.want {
+				t.Errorf("got kind %q, want %q (error: %v)", got, tt.want, err)
+			}
+			if got := isPermanent(err); got != tt.permanent {
+				t.Errorf("got permanent %v, want %v", got, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestClassifyDaemonUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	cli, err := client.NewClientWithOpts(client.WithHost(srv.URL), client.WithVersion("1.47"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	_, err = cli.Ping(context.Background())
+	if got := kindOf(err); got != kindDaemonUnavailable {
+		t.Fatalf("got kind %q, want %q (error: %v)", got, kindDaemonUnavailable, err)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want bool
+	}{
+		"unauthorized":             {err: errdefs.Unauthorized(errors.New("401")), want: true},
+		"wrapped forbidden":        {err: fmt.Errorf("pulling: %w", errdefs.Forbidden(errors.New("403"))), want: true},
+		"invalid reference":        {err: fmt.Errorf("bad image: %w", reference.ErrReferenceInvalidFormat), want: true},
+		"backoff permanent":        {err: backoff.Permanent(errors.New("stop")), want: true},
+		"configuration":            {err: newBootstrapError(kindConfig, errors.New("no image")), want: true},
+		"auth error in the stream": {err: errors.New("image pull reported an error: unauthorized: authentication required"), want: true},
+		"unavailable":              {err: errdefs.Unavailable(errors.New("503")), want: false},
+		"missing bind source":      {err: errdefs.NotFound(errors.New("bind source path does not exist: /var/run/worker")), want: false},
+		"missing podman image":     {err: &podmanError{Message: "quay.io/tinkerbell/tink-worker:nope: image not known", Response: http.StatusNotFound}, want: true},
+		"connection refused":       {err: errors.New("dial tcp 10.0.0.1:443: connect: connection refused"), want: false},
+		"container crash":          {err: newBootstrapError(kindContainerCrash, errors.New("exited")), want: false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := isPermanent(tt.err); got != tt.want {
+				t.Fatalf("isPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyKeepsExistingKind(t *testing.T) {
+	err := fmt.Errorf("checking: %w", newBootstrapError(kindContainerCrash, errors.New("tink-worker container is not running")))
+	if got := kindOf(classify(err)); got != kindContainerCrash {
+		t.Fatalf("got kind %q, want %q", got, kindContainerCrash)
+	}
+	if !strings.Contains(classify(err).Error(), "checking") {
+		t.Fatalf("classify changed the error message: %v", classify(err))
+	}
+}
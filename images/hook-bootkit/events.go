@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-logr/logr"
+)
+
+// Lifecycle event types reported by BootKit.
+const (
+	eventPullStarted   = "pull_started"
+	eventPullFinished  = "pull_finished"
+	eventPullFailed    = "pull_failed"
+	eventWorkerStarted = "worker_started"
+	eventWorkerCrashed = "worker_crashed"
+	// eventSidecarCrashed is reported when a sidecar stopped running and is restarted.
+	eventSidecarCrashed = "sidecar_crashed"
+)
+
+// eventSpoolDir is where events are buffered until they are delivered.
+// /var/run is shared with hook-docker, which spools its events in a sibling directory.
+const eventSpoolDir = "/var/run/hook-events/hook-bootkit"
+
+// errEventRejected is returned by post when the webhook rejects an event with a client error other
+// than 408 Request Timeout or 429 Too Many Requests, so that sending it again can't succeed.
+var errEventRejected = errors.New("event rejected by the webhook")
+
+// event is a structured lifecycle event that is POSTed to the hook_events_url.
+type event struct {
+	Type      string            `json:"type"`
+	Source    string            `json:"source"`
+	WorkerID  string            `json:"worker_id,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// eventReporter buffers events to disk and delivers them, in order, to an HTTP webhook.
+// A nil *eventReporter is valid and drops all events, so callers don't need to check
+// whether reporting is enabled.
+type eventReporter struct {
+	url      string
+	source   string
+	workerID string
+	dir      string
+	client   *http.Client
+	log      logr.Logger
+
+	// seqMu guards seq, flushMu makes sure only one flush runs at a time.
+	seqMu   sync.Mutex
+	seq     uint64
+	flushMu sync.Mutex
+	wake    chan struct{}
+}
+
+// newEventReporter returns an eventReporter that spools events in dir and POSTs them to url.
+// It returns nil when url is empty.
+func newEventReporter(log logr.Logger, url, source, workerID, dir string) *eventReporter {
+	if url == "" {
+		return nil
+	}
+	return &eventReporter{
+		url:      url,
+		source:   source,
+		workerID: workerID,
+		dir:      dir,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		log:      log,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// emit writes the event to the spool directory and wakes up the sender.
+func (e *eventReporter) emit(typ string, details map[string]string) {
+	if e == nil {
+		return
+	}
+	ev := event{Type: typ, Source: e.source, WorkerID: e.workerID, Timestamp: time.Now().UTC(), Details: details}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		e.log.Error(err, "unable to marshal event", "type", typ)
+		return
+	}
+
+	e.seqMu.Lock()
+	e.seq++
+	// The name sorts in emit order, which is the order events are delivered in.
+	name := fmt.Sprintf("%020d-%06d.json", ev.Timestamp.UnixNano(), e.seq)
+	e.seqMu.Unlock()
+
+	if err := os.MkdirAll(e.dir, 0o700); err != nil {
+		e.log.Error(err, "unable to create event spool directory", "dir", e.dir)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(e.dir, name), b, 0o600); err != nil {
+		e.log.Error(err, "unable to spool event", "type", typ)
+		return
+	}
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers spooled events until ctx is canceled. Failed deliveries are retried with an exponential backoff.
+func (e *eventReporter) run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = 0
+	bo.MaxInterval = time.Minute
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wake:
+		case <-time.After(wait):
+		}
+		if err := e.flush(ctx); err != nil {
+			wait = bo.NextBackOff()
+			e.log.V(1).Info("delivering events failed, will retry", "error", err.Error(), "retryIn", wait.String())
+			continue
+		}
+		bo.Reset()
+		wait = time.Minute
+	}
+}
+
+// flush POSTs all spooled events in order, removing each one once it has been delivered or
+// rejected by the webhook.
+func (e *eventReporter) flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		loc := filepath.Join(e.dir, name)
+		b, err := os.ReadFile(loc)
+		if err != nil {
+			return err
+		}
+		if err := e.post(ctx, b); err != nil {
+			if !errors.Is(err, errEventRejected) {
+				return err
+			}
+			// Retrying a rejected event can't succeed, and would hold back the events after it.
+			e.log.Error(err, "dropping the event rejected by the webhook", "event", string(b))
+		}
+		if err := os.Remove(loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends a single event to the webhook.
+func (e *eventReporter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status code %d from %s", errEventRejected, resp.StatusCode, e.url)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code from %s: %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
@@ -1,29 +1,25 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/registry"
-	"github.com/docker/docker/client"
+	"github.com/distribution/reference"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zerologr"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type tinkWorkerConfig struct {
@@ -41,6 +37,16 @@ type tinkWorkerConfig struct {
 	// tinkWorkerImage is the Tink worker image location.
 	tinkWorkerImage string
 
+	// tinkWorkerPullPolicy is when the tink-worker image is pulled: always, if-not-present or never.
+	tinkWorkerPullPolicy string
+
+	// imageArchiveURL and imageArchivePath are a docker save or OCI archive of images to load at
+	// boot, from an http(s) URL or from a file system in the DEVICE:/path form; imageArchiveSHA256
+	// is its checksum.
+	imageArchiveURL    string
+	imageArchivePath   string
+	imageArchiveSHA256 string
+
 	// tinkServerTLS is whether or not to use TLS for tink-server communication.
 	tinkServerTLS string
 
@@ -50,50 +56,197 @@ type tinkWorkerConfig struct {
 	httpProxy  string
 	httpsProxy string
 	noProxy    string
+
+	// metricsAddr is the address to serve the Prometheus metrics and the bootstrap status on; empty disables both endpoints.
+	metricsAddr string
+
+	// otelEndpoint is the OTLP/HTTP endpoint to export traces to; empty disables tracing.
+	otelEndpoint string
+
+	// eventsURL is the HTTP webhook lifecycle events are POSTed to; empty disables event reporting.
+	eventsURL string
+
+	// retry holds the hook_retry_* settings for the bootstrap and image pull retries.
+	retry retryConfig
+
+	// containerRuntime is the runtime tink-worker is run with: docker (the default), containerd or podman.
+	containerRuntime string
+
+	// containerdAddress is the containerd socket used when containerRuntime is containerd.
+	containerdAddress string
+
+	// podmanAddress is the Podman API socket used when containerRuntime is podman.
+	podmanAddress string
+
+	// tinkWorkerSpec is a spec fragment, base64 encoded JSON or an http(s) URL, merged over the default tink-worker container spec.
+	tinkWorkerSpec string
+
+	// sidecars is the list of additional containers to run, base64 encoded JSON or an http(s) URL.
+	sidecars string
+
+	// prefetchImages are the images to pull in the background, a comma separated list or an http(s)
+	// URL serving a JSON array; prefetchParallelism is how many are pulled at the same time.
+	prefetchImages      string
+	prefetchParallelism string
 }
 
+// tinkWorkerContainerName is the name of the tink-worker container.
+const tinkWorkerContainerName = "tink-worker"
+
 func main() {
 	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
 	defer done()
 	log := defaultLogger("debug")
 	log.Info("starting BootKit: the tink-worker bootstrapper")
 
-	for {
+	readStart := time.Now()
+	content, err := readCmdLine(ctx, log, "/proc/cmdline", cmdLineRetryInterval)
+	if err != nil {
+		log.Info("context cancellation received, exiting")
+		return
+	}
+	// Run as "bootkit mount-archive" in the hook-bootkit-archive onboot step, it only mounts the file
+	// system of image_archive_path=, so that the hook-bootkit service needs no block devices.
+	if len(os.Args) > 1 && os.Args[1] == "mount-archive" {
+		cfg := parseCmdLine(strings.Split(content, " "))
+		if cfg.imageArchivePath == "" {
+			return
+		}
+		if err := mountArchive(ctx, log, cfg.imageArchivePath); err != nil {
+			log.Error(err, "mounting the file system of image_archive_path= failed")
+			os.Exit(1)
+		}
+		return
+	}
+	// Settings from DHCP options come first, so that the kernel command line takes precedence.
+	fromDHCP, ignoredDHCP := dhcpCmdLine(dhcpLeaseFile)
+	cfg := parseCmdLine(append(fromDHCP, strings.Split(content, " ")...))
+	readEnd := time.Now()
+
+	if len(fromDHCP) > 0 {
+		var keys []string
+		for _, s := range fromDHCP {
+			key, _, _ := strings.Cut(s, "=")
+			keys = append(keys, key)
+		}
+		log.Info("read settings from DHCP options, the kernel command line takes precedence", "keys", keys)
+	}
+	if len(ignoredDHCP) > 0 {
+		log.Info("ignoring the settings from DHCP options that only the kernel command line can set", "keys", ignoredDHCP, "allowed", dhcpSettings)
+	}
+
+	// The proxy env vars are set before any HTTP request, as the proxy of the environment is only
+	// read once.
+	os.Setenv("HTTP_PROXY", cfg.httpProxy)
+	os.Setenv("HTTPS_PROXY", cfg.httpsProxy)
+	os.Setenv("NO_PROXY", cfg.noProxy)
+
+	if cfg.metricsAddr != "" {
+		go serveHTTP(ctx, log, cfg.metricsAddr)
+	}
+
+	events := newEventReporter(log, cfg.eventsURL, "hook-bootkit", cfg.workerID, eventSpoolDir)
+	go events.run(ctx)
+	defer func() {
+		fctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := events.flush(fctx); err != nil {
+			log.Error(err, "delivering remaining events failed")
+		}
+	}()
+
+	shutdownTracing, err := setupTracing(ctx, cfg.otelEndpoint, cfg.workerID)
+	if err != nil {
+		log.Error(err, "setting up tracing failed, continuing without tracing", "endpoint", cfg.otelEndpoint)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+	defer func() {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(sctx); err != nil {
+			log.Error(err, "flushing traces failed")
+		}
+	}()
+
+	transient, permanent, err := cfg.retry.policies()
+	if err != nil {
+		log.Error(err, "invalid retry settings, using the defaults for those")
+	}
+	transientBackOff, permanentBackOff := transient.backOff(ctx), permanent.backOff(ctx)
+
+	// The prefetch runs concurrently with the bootstrap of tink-worker, and BootKit waits for it
+	// before exiting, so that the events of the pulls are still delivered.
+	defer waitForPrefetch(log, startPrefetch(ctx, log, cfg, transient))
+
+	bctx, bootstrapSpan := startSpan(ctx, "bootstrap", attribute.String("tinkerbell.worker_id", cfg.workerID))
+	_, readSpan := otel.Tracer(tracerName).Start(bctx, "read cmdline", trace.WithTimestamp(readStart))
+	readSpan.End(trace.WithTimestamp(readEnd))
+
+	var sidecars []containerSpec
+	for attempt := 1; ; attempt++ {
 		if errors.Is(ctx.Err(), context.Canceled) {
 			log.Info("context cancellation received, exiting")
+			endSpan(bootstrapSpan, ctx.Err())
 			return
 		}
-		if err := run(ctx, log); err != nil {
-			log.Error(err, "bootstrapping tink-worker failed")
-			log.Info("will retry in 5 seconds")
-			time.Sleep(5 * time.Second)
+		rctx, runSpan := startSpan(bctx, "run", attribute.Int("bootkit.attempt", attempt))
+		containerID, started, err := run(rctx, log, cfg, events, transient)
+		endSpan(runSpan, err)
+		if err != nil {
+			bootstrapFailures.Inc()
+			status.setFailure(attempt, err)
+			permanent := isPermanent(err)
+			log.Error(err, "bootstrapping tink-worker failed", "errorKind", kindOf(err), "permanent", permanent)
+			bo := transientBackOff
+			if permanent {
+				bo = permanentBackOff
+			}
+			wait := bo.NextBackOff()
+			if wait == backoff.Stop {
+				if ctx.Err() != nil {
+					continue
+				}
+				log.Info("giving up bootstrapping tink-worker, an operator needs to fix the error", "errorKind", kindOf(err), "attempts", attempt)
+				endSpan(bootstrapSpan, err)
+				status.setNeedsOperator()
+				announceNeedsOperator(err)
+				// Stay around so that the status stays available until the machine is rebooted.
+				<-ctx.Done()
+				return
+			}
+			log.Info("will retry", "retryIn", wait.String())
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
 			continue
 		}
+		status.setRunning(attempt, containerID)
+		sidecars = started
 		break
 	}
+	endSpan(bootstrapSpan, nil)
+	bootstrapSeconds.Set(time.Since(startTime).Seconds())
 	log.Info("BootKit: the tink-worker bootstrapper finished")
-}
 
-// TODO(jacobweinstock): clean up func run().
-// 1. read /proc/cmdline
-// 2. parse and populate tinkConfig from contents of /proc/cmdline
-// 3. do validation/sanitization on tinkConfig
-// 4. setup docker client
-// 4. configure any registry auth
-// 5. pull tink-worker image
-// 6. remove any existing tink-worker container
-// 7. setup tink-worker container config
-// 8. create tink-worker container
-// 9. start tink-worker container
-// 10. check that the tink-worker container is running
-
-func run(ctx context.Context, log logr.Logger) error {
-	content, err := os.ReadFile("/proc/cmdline")
-	if err != nil {
-		return err
+	// Keep running so the metrics stay available for scraping, tink-worker
+	// crashes are reported and sidecars are supervised after the bootstrap is done.
+	if cfg.metricsAddr != "" || cfg.eventsURL != "" || len(sidecars) > 0 {
+		watchTinkWorker(ctx, log, cfg, events, sidecars, 10*time.Second)
 	}
-	cmdLines := strings.Split(string(content), " ")
-	cfg := parseCmdLine(cmdLines)
+}
+
+// run bootstraps the tink-worker container and the sidecars. It returns the ID of the
+// tink-worker container and the specs of the sidecars. main reads and parses the kernel command
+// line into cfg, then run:
+//  1. validates the tink-worker image and its pull policy
+//  2. sets up the client of the container runtime
+//  3. loads the tink_worker_spec= fragment, the image archive and the embedded images
+//  4. runs the preflight checks and pulls the tink-worker image, when needed
+//  5. starts the sidecars that come before tink-worker
+//  6. launches the tink-worker container with launchContainer
+//  7. starts the sidecars that come after tink-worker
+func run(ctx context.Context, log logr.Logger, cfg tinkWorkerConfig, events *eventReporter, pullPolicy retryPolicy) (string, []containerSpec, error) {
 	// Generate the path to the tink-worker
 	var imageName string
 	if cfg.registry != "" {
@@ -103,86 +256,143 @@ func run(ctx context.Context, log logr.Logger) error {
 		imageName = cfg.tinkWorkerImage
 	}
 	if imageName == "" {
-		return fmt.Errorf("cannot pull image for tink-worker, 'docker_registry' and/or 'tink_worker_image' NOT specified in /proc/cmdline")
+		return "", nil, newBootstrapError(kindConfig, fmt.Errorf("cannot pull image for tink-worker, 'docker_registry' and/or 'tink_worker_image' NOT specified in /proc/cmdline"))
+	}
+	if _, err := reference.ParseNormalizedNamed(imageName); err != nil {
+		return "", nil, newBootstrapError(kindConfig, fmt.Errorf("invalid tink-worker image %q: %w", imageName, err))
+	}
+	imagePolicy, err := parseImagePullPolicy(cfg.tinkWorkerPullPolicy)
+	if err != nil {
+		return "", nil, newBootstrapError(kindConfig, err)
 	}
 
 	// Give time for Docker to start
 	// Alternatively we watch for the socket being created
-	log.Info("setting up the Docker client")
-
-	os.Setenv("HTTP_PROXY", cfg.httpProxy)
-	os.Setenv("HTTPS_PROXY", cfg.httpsProxy)
-	os.Setenv("NO_PROXY", cfg.noProxy)
-	// Create Docker client with API (socket)
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	log.Info("setting up the container runtime client", "runtime", cfg.containerRuntime)
+	cctx, span := startSpan(ctx, "setup container runtime client", attribute.String("container.runtime", cfg.containerRuntime))
+	rt, err := newContainerRuntime(log, cfg)
 	if err != nil {
-		return err
+		err = classify(err)
+		endSpan(span, err)
+		return "", nil, err
 	}
+	defer rt.Close()
 
-	log.Info("Pulling image", "imageName", imageName)
-	authConfig := registry.AuthConfig{
-		Username: cfg.username,
-		Password: strings.TrimSuffix(cfg.password, "\n"),
+	if err := rt.Ping(cctx); err != nil {
+		err = newBootstrapError(kindDaemonUnavailable, fmt.Errorf("%s is not reachable: %w", rt.Name(), err))
+		endSpan(span, err)
+		return "", nil, err
 	}
+	endSpan(span, nil)
+	markDockerReady()
 
-	encodedJSON, err := json.Marshal(authConfig)
+	// The spec fragment is loaded after the proxy env vars are set, as it can be fetched from a URL.
+	fctx, span := startSpan(ctx, "load tink-worker spec")
+	fragment, err := loadSpecFragment(fctx, cfg.tinkWorkerSpec)
 	if err != nil {
-		return err
+		err = classify(err)
+		endSpan(span, err)
+		return "", nil, err
+	}
+	sidecars, err := loadSidecars(fctx, cfg.sidecars)
+	if err != nil {
+		err = classify(err)
+		endSpan(span, err)
+		return "", nil, err
+	}
+	endSpan(span, nil)
+	var before, after []sidecar
+	for _, s := range sidecars {
+		if s.AfterTinkWorker {
+			after = append(after, s)
+		} else {
+			before = append(before, s)
+		}
 	}
 
-	authStr := base64.URLEncoding.EncodeToString(encodedJSON)
-
-	pullOpts := image.PullOptions{}
-	if useAuth(imageName, cfg.registry) {
-		pullOpts.RegistryAuth = authStr
+	actx, span := startSpan(ctx, "load image archive")
+	loaded, err := loadImageArchive(actx, log, rt, cfg)
+	if err != nil {
+		err = classify(err)
+		endSpan(span, err)
+		return "", nil, err
 	}
-	var out io.ReadCloser
-	imagePullOperation := func() error {
-		// with embedded images, the tink worker could potentially already exist
-		// in the local Docker image cache. And the image name could be something
-		// unreachable via the network (for example: 127.0.0.1/embedded/tink-worker).
-		// Because of this we check if the image already exists and don't return an
-		// error if the image does not exist and the pull fails.
-		var imageExists bool
-		if _, _, err := cli.ImageInspectWithRaw(ctx, imageName); err == nil {
-			imageExists = true
+	span.SetAttributes(attribute.Int("image.archive.images", len(loaded)))
+	endSpan(span, nil)
+	name, _ := normalizeImageName(imageName)
+	var fromArchive bool
+	for _, ref := range loaded {
+		if n, err := normalizeImageName(ref); err == nil && n == name {
+			fromArchive = true
 		}
-		out, err = cli.ImagePull(ctx, imageName, pullOpts)
-		if err != nil && !imageExists {
-			log.Error(err, "image pull failure", "imageName", imageName)
-			return err
+	}
+
+	ectx, span := startSpan(ctx, "verify embedded images")
+	embedded, err := readEmbeddedManifest(embeddedManifestFile)
+	if err != nil {
+		log.Error(err, "reading the embedded image manifest failed, pulling all images")
+	}
+	verified := verifyEmbeddedImages(ectx, log, rt, embedded)
+	if verified, err = importEmbeddedArchive(ectx, log, rt, embedded, verified); err != nil {
+		log.Error(err, "importing the embedded image archive failed, pulling the missing images")
+	}
+	embeddedDigest := verified[name]
+	span.SetAttributes(attribute.Int("embedded.images", len(embedded)), attribute.Int("embedded.images.matching", len(verified)))
+	endSpan(span, nil)
+
+	var localID string
+	if imagePolicy == pullIfNotPresent || imagePolicy == pullNever {
+		if localID, err = rt.ImageID(ctx, imageName); err != nil {
+			return "", nil, classify(fmt.Errorf("checking the local tink-worker image failed: %w", err))
 		}
-		return nil
 	}
-	if err := backoff.Retry(imagePullOperation, backoff.NewExponentialBackOff()); err != nil {
-		return err
+	pull, err := imagePolicy.needsPull(imageName, localID, embeddedDigest != "" || fromArchive)
+	if err != nil {
+		return "", nil, err
 	}
 
-	if out != nil {
-		buf := bufio.NewScanner(out)
-		for buf.Scan() {
-			structured := make(map[string]interface{})
-			if err := json.Unmarshal(buf.Bytes(), &structured); err != nil {
-				log.Info("image pull logs", "output", buf.Text())
-			} else {
-				log.Info("image pull logs", "logs", structured)
-			}
+	// The preflight does not stop the bootstrap: its report explains the failures of the pull and
+	// of tink-worker, which could still succeed, e.g. through a registry mirror of the runtime.
+	// The registry is not checked when the image is not pulled.
+	_, span = startSpan(ctx, "preflight")
+	preflightImage := imageName
+	if !pull {
+		preflightImage = ""
+	}
+	report := newPreflight().run(ctx, cfg, preflightImage)
+	status.setPreflight(report)
+	span.SetAttributes(attribute.Bool("preflight.ok", report.ok()))
+	endSpan(span, nil)
+	if report.ok() {
+		log.Info("network preflight checks passed", "checks", len(report.Checks))
+	} else {
+		log.Info("network preflight checks failed", "report", report.String())
+		announcePreflight(report)
+	}
 
+	switch {
+	case pull:
+		if err := pullTinkWorker(ctx, log, rt, cfg, imageName, imagePolicy == pullDefault, events, pullPolicy); err != nil {
+			return "", nil, err
 		}
-		if err := out.Close(); err != nil {
-			log.Error(err, "closing image pull logs failed")
-		}
+	case localID != "":
+		log.Info("using the local image instead of pulling it", "imageName", imageName, "id", localID, "pullPolicy", imagePolicy)
+	case fromArchive:
+		log.Info("using the image of the image archive instead of pulling it", "imageName", imageName)
+	default:
+		log.Info("using the embedded image instead of pulling it", "imageName", imageName, "digest", embeddedDigest)
 	}
 
-	log.Info("Removing any existing tink-worker container")
-	if err := removeTinkWorkerContainer(ctx, cli); err != nil {
-		return fmt.Errorf("failed to remove existing tink-worker container: %w", err)
+	started, err := startSidecars(ctx, log, rt, cfg, before, pullPolicy)
+	if err != nil {
+		return "", nil, err
 	}
 
-	log.Info("Creating tink-worker container")
-	tinkContainer := &container.Config{
-		Image: imageName,
-		Env: []string{
+	lctx, span := startSpan(ctx, "launch tink-worker container", attribute.String("image.name", imageName))
+	spec := containerSpec{
+		name:  tinkWorkerContainerName,
+		image: imageName,
+		env: []string{
 			fmt.Sprintf("DOCKER_REGISTRY=%s", cfg.registry),
 			fmt.Sprintf("REGISTRY_USERNAME=%s", cfg.username),
 			fmt.Sprintf("REGISTRY_PASSWORD=%s", cfg.password),
@@ -195,83 +405,67 @@ func run(ctx context.Context, log logr.Logger) error {
 			fmt.Sprintf("HTTPS_PROXY=%s", cfg.httpsProxy),
 			fmt.Sprintf("NO_PROXY=%s", cfg.noProxy),
 		},
-		AttachStdout: true,
-		AttachStderr: true,
-	}
-
-	tinkHostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: "/worker",
-				Target: "/worker",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: "/var/run/docker.sock",
-				Target: "/var/run/docker.sock",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: "/dev",
-				Target: "/dev",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: "/host_root/run",
-				Target: "/run",
-			},
-		},
-		NetworkMode: "host",
-		Privileged:  true,
+		mounts:      rt.DefaultMounts(),
+		hostNetwork: true,
+		privileged:  true,
 	}
-	resp, err := cli.ContainerCreate(ctx, tinkContainer, tinkHostConfig, nil, nil, "tink-worker")
+	// Pass the trace context on so that the workflow traces of tink-worker join the boot trace.
+	spec.env = append(spec.env, traceEnv(lctx)...)
+	spec = fragment.merge(spec)
+	id, err := launchContainer(lctx, log, rt, spec)
+	endSpan(span, err)
 	if err != nil {
-		return fmt.Errorf("creating tink-worker container failed: %w", err)
-	}
-
-	log.Info("Starting tink-worker container")
-	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return fmt.Errorf("starting tink-worker container failed: %w", err)
-	}
-
-	time.Sleep(time.Second * 3)
-	// if tink-worker is not running return error so we try again
-	if err := checkContainerRunning(ctx, cli, resp.ID); err != nil {
-		return fmt.Errorf("checking if tink-worker container is running failed: %w", err)
+		return "", nil, err
 	}
+	events.emit(eventWorkerStarted, map[string]string{"image": imageName, "container_id": id})
 
-	return nil
+	return id, append(started, startSidecarsAfter(ctx, log, rt, cfg, after, pullPolicy)...), nil
 }
 
-// checkContainerRunning checks if the tink-worker container is running.
-func checkContainerRunning(ctx context.Context, cli *client.Client, containerID string) error {
-	inspect, err := cli.ContainerInspect(ctx, containerID)
+// pullTinkWorker pulls the tink-worker image, with the registry credentials when it is in cfg.registry.
+// With useLocal, a failed pull falls back to the image in the local image store.
+func pullTinkWorker(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, imageName string, useLocal bool, events *eventReporter, pullPolicy retryPolicy) error {
+	log.Info("Pulling image", "imageName", imageName)
+	_, span := startSpan(ctx, "configure registry auth", attribute.String("registry", cfg.registry))
+	auth := cfg.registryAuth(imageName)
+	span.SetAttributes(attribute.Bool("registry.auth", auth != nil))
+	endSpan(span, nil)
+
+	pctx, span := startSpan(ctx, "pull image", attribute.String("image.name", imageName))
+	events.emit(eventPullStarted, map[string]string{"image": imageName})
+	pullStart := time.Now()
+	pulledBytes, retries, err := pullWithRetry(pctx, log, rt, imageName, auth, useLocal, pullPolicy)
+	imagePullBytes.Add(float64(pulledBytes))
+	span.SetAttributes(attribute.Int("image.pull.retries", retries), attribute.Int64("image.pull.bytes", pulledBytes))
 	if err != nil {
-		return err
-	}
-	if !inspect.State.Running {
-		return fmt.Errorf("tink-worker container is not running")
+		endSpan(span, err)
+		events.emit(eventPullFailed, map[string]string{"image": imageName, "error": err.Error(), "retries": strconv.Itoa(retries)})
+		return classify(err)
 	}
+	imagePullDuration.Observe(time.Since(pullStart).Seconds())
+	endSpan(span, nil)
+	events.emit(eventPullFinished, map[string]string{"image": imageName, "duration": time.Since(pullStart).String(), "retries": strconv.Itoa(retries)})
 	return nil
 }
 
-// removeTinkWorkerContainer removes the tink-worker container if it exists.
-func removeTinkWorkerContainer(ctx context.Context, cli *client.Client) error {
-	cs, err := cli.ContainerList(ctx, container.ListOptions{All: true})
-	if err != nil {
-		return fmt.Errorf("listing containers, in order to find an existing tink-worker container, failed: %w", err)
-	}
-	for _, c := range cs {
-		for _, n := range c.Names {
-			if n == "/tink-worker" {
-				if err := cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
-					return fmt.Errorf("removing existing tink-worker container failed: %w", err)
-				}
-			}
+// cmdLineRetryInterval is how long to wait before reading the kernel command line again.
+const cmdLineRetryInterval = 10 * time.Second
+
+// readCmdLine reads the kernel command line from file. Nothing can be bootstrapped without it, so a
+// failed read is retried every interval until it succeeds or ctx is done.
+func readCmdLine(ctx context.Context, log logr.Logger, file string, interval time.Duration) (string, error) {
+	for {
+		content, err := os.ReadFile(file)
+		if err == nil {
+			return string(content), nil
+		}
+		log.Error(err, "reading the kernel command line failed", "file", file, "retryIn", interval.String())
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
 		}
 	}
-	return nil
 }
 
 // parseCmdLine will parse the command line.
@@ -297,6 +491,14 @@ func parseCmdLine(cmdLines []string) (cfg tinkWorkerConfig) {
 			cfg.workerID = cmdLine[1]
 		case "tink_worker_image":
 			cfg.tinkWorkerImage = cmdLine[1]
+		case "tink_worker_pull_policy":
+			cfg.tinkWorkerPullPolicy = cmdLine[1]
+		case "image_archive_url":
+			cfg.imageArchiveURL = cmdLine[1]
+		case "image_archive_path":
+			cfg.imageArchivePath = cmdLine[1]
+		case "image_archive_sha256":
+			cfg.imageArchiveSHA256 = cmdLine[1]
 		case "tinkerbell_tls":
 			cfg.tinkServerTLS = cmdLine[1]
 		case "tinkerbell_insecure_tls":
@@ -307,6 +509,38 @@ func parseCmdLine(cmdLines []string) (cfg tinkWorkerConfig) {
 			cfg.httpsProxy = cmdLine[1]
 		case "NO_PROXY":
 			cfg.noProxy = cmdLine[1]
+		case "hook_metrics_addr":
+			cfg.metricsAddr = cmdLine[1]
+		case "otel_endpoint":
+			cfg.otelEndpoint = cmdLine[1]
+		case "hook_events_url":
+			cfg.eventsURL = cmdLine[1]
+		case "hook_retry_initial_interval":
+			cfg.retry.initialInterval = cmdLine[1]
+		case "hook_retry_max_interval":
+			cfg.retry.maxInterval = cmdLine[1]
+		case "hook_retry_max_elapsed":
+			cfg.retry.maxElapsed = cmdLine[1]
+		case "hook_retry_max_attempts":
+			cfg.retry.maxAttempts = cmdLine[1]
+		case "hook_retry_permanent_interval":
+			cfg.retry.permanentInterval = cmdLine[1]
+		case "hook_retry_permanent_max_attempts":
+			cfg.retry.permanentMaxAttempts = cmdLine[1]
+		case "container_runtime":
+			cfg.containerRuntime = cmdLine[1]
+		case "containerd_address":
+			cfg.containerdAddress = cmdLine[1]
+		case "podman_address":
+			cfg.podmanAddress = cmdLine[1]
+		case "tink_worker_spec":
+			cfg.tinkWorkerSpec = cmdLine[1]
+		case "hook_sidecars":
+			cfg.sidecars = cmdLine[1]
+		case "prefetch_images":
+			cfg.prefetchImages = cmdLine[1]
+		case "prefetch_parallelism":
+			cfg.prefetchParallelism = cmdLine[1]
 		}
 	}
 	return cfg
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestReadCmdLine(t *testing.T) {
+	tests := map[string]struct {
+		// createAfter is when the file is created; negative never creates it.
+		createAfter time.Duration
+		want        string
+		wantErr     bool
+	}{
+		"exists":         {createAfter: 0, want: "tink_worker_image=tink-worker"},
+		"appears later":  {createAfter: 50 * time.Millisecond, want: "tink_worker_image=tink-worker"},
+		"never readable": {createAfter: -1, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "cmdline")
+			create := func() {
+				if err := os.WriteFile(file, []byte(tt.want), 0o644); err != nil {
+					t.Error(err)
+				}
+			}
+			switch {
+			case tt.createAfter == 0:
+				create()
+			case tt.createAfter > 0:
+				time.AfterFunc(tt.createAfter, create)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := readCmdLine(ctx, logr.Discard(), file, 10*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
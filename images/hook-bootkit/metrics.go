@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startTime is used as the reference point for the bootstrap phase timings.
+var startTime = time.Now()
+
+var (
+	dockerReadySeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bootkit_docker_ready_seconds",
+		Help: "Seconds from BootKit start until the Docker API was first reachable.",
+	})
+	imagePullDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bootkit_image_pull_duration_seconds",
+		Help:    "Duration of the tink-worker image pull, including retries.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200},
+	})
+	imagePullBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootkit_image_pull_bytes_total",
+		Help: "Bytes of image layers downloaded while pulling the tink-worker image.",
+	})
+	imagePullRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootkit_image_pull_retries_total",
+		Help: "Number of times the tink-worker or a sidecar image pull was retried.",
+	})
+	containerCreateFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootkit_container_create_failures_total",
+		Help: "Number of failed attempts to create the tink-worker or a sidecar container.",
+	})
+	containerStartFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootkit_container_start_failures_total",
+		Help: "Number of failed attempts to start the tink-worker or a sidecar container.",
+	})
+	bootstrapFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootkit_bootstrap_failures_total",
+		Help: "Number of failed tink-worker bootstrap attempts.",
+	})
+	bootstrapSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bootkit_bootstrap_seconds",
+		Help: "Seconds from BootKit start until the tink-worker container was running.",
+	})
+	tinkWorkerRestarts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bootkit_tink_worker_restarts",
+		Help: "Restart count of the tink-worker container as reported by Docker.",
+	})
+	prefetchedImages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bootkit_prefetched_images_total",
+		Help: "Images of prefetch_images= that were prefetched, by result.",
+	}, []string{"result"})
+	sidecarRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bootkit_sidecar_restarts_total",
+		Help: "Number of times a sidecar container was restarted after it stopped running.",
+	}, []string{"sidecar"})
+)
+
+// dockerReadyOnce makes sure only the first successful Docker API call is recorded.
+var dockerReadyOnce sync.Once
+
+// markDockerReady records the time it took for the Docker API to become reachable.
+func markDockerReady() {
+	dockerReadyOnce.Do(func() {
+		dockerReadySeconds.Set(time.Since(startTime).Seconds())
+	})
+}
+
+// serveHTTP exposes the Prometheus metrics and the bootstrap status on addr until ctx is canceled.
+func serveHTTP(ctx context.Context, log logr.Logger, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/status", status)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+	}()
+
+	log.Info("serving metrics and status", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err, "metrics and status server failed", "addr", addr)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// defaultPrefetchParallelism is how many images are prefetched at the same time without prefetch_parallelism=.
+	defaultPrefetchParallelism = 3
+	// prefetchPingInterval is how often the container runtime is pinged until it is ready for the prefetch.
+	prefetchPingInterval = 2 * time.Second
+)
+
+// prefetchState is the state of a prefetched image.
+type prefetchState string
+
+const (
+	prefetchPending prefetchState = "pending"
+	prefetchPulling prefetchState = "pulling"
+	prefetchDone    prefetchState = "done"
+	prefetchFailed  prefetchState = "failed"
+)
+
+// prefetchImage is the progress of a prefetched image, as reported on /status.
+type prefetchImage struct {
+	Image string        `json:"image"`
+	State prefetchState `json:"state"`
+	Bytes int64         `json:"bytes,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// loadPrefetchImages returns the images of prefetch_images=, which is either a comma separated
+// list of images or an http(s) URL serving a JSON array of images, such as a metadata service.
+// Duplicates are removed.
+func loadPrefetchImages(ctx context.Context, value string) ([]string, error) {
+	var images []string
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		if err := loadJSONValue(ctx, "prefetch_images", value, &images); err != nil {
+			return nil, err
+		}
+	} else {
+		images = strings.Split(value, ",")
+	}
+	var unique []string
+	seen := map[string]bool{}
+	for _, img := range images {
+		img = strings.TrimSpace(img)
+		if img == "" {
+			continue
+		}
+		name, err := normalizeImageName(img)
+		if err != nil {
+			return nil, newBootstrapError(kindConfig, fmt.Errorf("invalid prefetch_images: %w", err))
+		}
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, img)
+		}
+	}
+	return unique, nil
+}
+
+// parsePrefetchParallelism parses prefetch_parallelism=, defaulting to defaultPrefetchParallelism.
+func parsePrefetchParallelism(value string) (int, error) {
+	if value == "" {
+		return defaultPrefetchParallelism, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid prefetch_parallelism=%q, must be a positive number", value)
+	}
+	return n, nil
+}
+
+// startPrefetch runs prefetchImages in the background, and returns a channel that is closed when it
+// is done.
+func startPrefetch(ctx context.Context, log logr.Logger, cfg tinkWorkerConfig, policy retryPolicy) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		prefetchImages(ctx, log, cfg, policy)
+	}()
+	return done
+}
+
+// waitForPrefetch waits until the prefetch is done, so that BootKit does not exit in the middle of
+// the pulls when it has nothing else to do after the bootstrap. The pulls stop when the context of
+// the prefetch is cancelled.
+func waitForPrefetch(log logr.Logger, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	default:
+	}
+	log.Info("waiting for the prefetch of the images to finish before exiting")
+	<-done
+}
+
+// prefetchImages pulls the images of prefetch_images= in the background, so that the workflow
+// actions do not pull them one at a time on the critical path. It uses its own client of the
+// container runtime, and waits for the runtime to be ready. Failures are logged and reported on
+// /status, but do not affect the bootstrap of tink-worker.
+func prefetchImages(ctx context.Context, log logr.Logger, cfg tinkWorkerConfig, policy retryPolicy) {
+	if cfg.prefetchImages == "" {
+		return
+	}
+	log = log.WithValues("prefetch", true)
+	images, err := loadPrefetchImages(ctx, cfg.prefetchImages)
+	if err != nil {
+		log.Error(err, "loading the images to prefetch failed")
+		return
+	}
+	if len(images) == 0 {
+		return
+	}
+	parallelism, err := parsePrefetchParallelism(cfg.prefetchParallelism)
+	if err != nil {
+		log.Error(err, "using the default prefetch parallelism", "parallelism", defaultPrefetchParallelism)
+		parallelism = defaultPrefetchParallelism
+	}
+
+	rt, err := newContainerRuntime(log, cfg)
+	if err != nil {
+		log.Error(err, "creating the container runtime client failed, not prefetching images")
+		return
+	}
+	defer rt.Close()
+	for rt.Ping(ctx) != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(prefetchPingInterval):
+		}
+	}
+
+	prefetch(ctx, log, rt, images, cfg.registryAuth, parallelism, policy)
+}
+
+// prefetch pulls the images with rt, parallelism at a time, with the credentials of auth. The
+// progress is logged and reported on /status as the pulls start and finish.
+func prefetch(ctx context.Context, log logr.Logger, rt containerRuntime, images []string, auth func(string) *registryAuth, parallelism int, policy retryPolicy) []prefetchImage {
+	progress := make([]prefetchImage, len(images))
+	for i, img := range images {
+		progress[i] = prefetchImage{Image: img, State: prefetchPending}
+	}
+	var mu sync.Mutex
+	var finished int
+	// update records the progress of an image and returns how many images are finished.
+	update := func(i int, p prefetchImage) int {
+		mu.Lock()
+		defer mu.Unlock()
+		progress[i] = p
+		if p.State == prefetchDone || p.State == prefetchFailed {
+			finished++
+		}
+		status.setPrefetch(progress)
+		return finished
+	}
+	status.setPrefetch(progress)
+
+	log.Info("prefetching images", "images", len(images), "parallelism", parallelism)
+	start := time.Now()
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				update(i, prefetchImage{Image: img, State: prefetchFailed, Error: ctx.Err().Error()})
+				return
+			}
+			defer func() { <-sem }()
+
+			update(i, prefetchImage{Image: img, State: prefetchPulling})
+			pulled, _, err := pullWithRetry(ctx, log, rt, img, auth(img), true, policy)
+			imagePullBytes.Add(float64(pulled))
+			if err != nil {
+				prefetchedImages.WithLabelValues(string(prefetchFailed)).Inc()
+				update(i, prefetchImage{Image: img, State: prefetchFailed, Bytes: pulled, Error: err.Error()})
+				log.Error(err, "prefetching image failed", "imageName", img)
+				return
+			}
+			prefetchedImages.WithLabelValues(string(prefetchDone)).Inc()
+			n := update(i, prefetchImage{Image: img, State: prefetchDone, Bytes: pulled})
+			log.Info("prefetched image", "imageName", img, "finished", n, "images", len(images))
+		}()
+	}
+	wg.Wait()
+	log.Info("prefetching images finished", "images", len(images), "duration", time.Since(start).String())
+	return progress
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadPrefetchImages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `["quay.io/tinkerbell/actions/image2disk:latest", "quay.io/tinkerbell/actions/cexec:latest"]`)
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := map[string]struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		"list": {
+			value: "quay.io/tinkerbell/actions/image2disk:latest, quay.io/tinkerbell/actions/cexec:latest,",
+			want:  []string{"quay.io/tinkerbell/actions/image2disk:latest", "quay.io/tinkerbell/actions/cexec:latest"},
+		},
+		"duplicates": {
+			value: "alpine,docker.io/library/alpine:latest,alpine:3.20",
+			want:  []string{"alpine", "alpine:3.20"},
+		},
+		"URL": {
+			value: srv.URL,
+			want:  []string{"quay.io/tinkerbell/actions/image2disk:latest", "quay.io/tinkerbell/actions/cexec:latest"},
+		},
+		"invalid image": {value: "alpine,Not/Valid", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadPrefetchImages(context.Background(), tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParsePrefetchParallelism(t *testing.T) {
+	tests := map[string]struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		"default":  {want: defaultPrefetchParallelism},
+		"value":    {value: "8", want: 8},
+		"zero":     {value: "0", wantErr: true},
+		"negative": {value: "-1", wantErr: true},
+		"invalid":  {value: "many", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parsePrefetchParallelism(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	var pulling, maxPulling int
+	authenticated := map[string]bool{}
+	rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != podmanAPIPrefix+"/images/pull" {
+			// The image is not in the local image store.
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"cause":"image not known","message":"image not known","response":404}`)
+			return
+		}
+		ref := r.URL.Query().Get("reference")
+		mu.Lock()
+		pulling++
+		maxPulling = max(maxPulling, pulling)
+		authenticated[ref] = r.Header.Get("X-Registry-Auth") != ""
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		pulling--
+		mu.Unlock()
+		if ref == "registry.example/missing:latest" {
+			_, _ = io.WriteString(w, `{"error":"manifest unknown"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"stream":"Copying blob\n"}{"images":["abc"],"id":"abc"}`)
+	})
+
+	images := []string{"registry.example/a:latest", "registry.example/missing:latest", "quay.io/b:latest", "quay.io/c:latest", "quay.io/d:latest"}
+	auth := func(img string) *registryAuth {
+		if useAuth(img, "registry.example") {
+			return &registryAuth{username: "user", password: "secret"}
+		}
+		return nil
+	}
+	t.Cleanup(func() { status.setPrefetch(nil) })
+	got := prefetch(context.Background(), logr.Discard(), rt, images, auth, 2, retryPolicy{maxAttempts: 1})
+	if diff := cmp.Diff(got, status.Prefetch); diff != "" {
+		t.Errorf("status: %s", diff)
+	}
+
+	want := []prefetchImage{
+		{Image: "registry.example/a:latest", State: prefetchDone},
+		{Image: "registry.example/missing:latest", State: prefetchFailed},
+		{Image: "quay.io/b:latest", State: prefetchDone},
+		{Image: "quay.io/c:latest", State: prefetchDone},
+		{Image: "quay.io/d:latest", State: prefetchDone},
+	}
+	for i := range got {
+		if got[i].State == prefetchFailed && got[i].Error == "" {
+			t.Errorf("image %s failed without an error", got[i].Image)
+		}
+		got[i].Error = ""
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+	if maxPulling > 2 {
+		t.Errorf("got %d concurrent pulls, want at most 2", maxPulling)
+	}
+	wantAuth := map[string]bool{"registry.example/a:latest": true, "registry.example/missing:latest": true, "quay.io/b:latest": false, "quay.io/c:latest": false, "quay.io/d:latest": false}
+	if diff := cmp.Diff(wantAuth, authenticated); diff != "" {
+		t.Errorf("authentication: %s", diff)
+	}
+}
+
+func TestWaitForPrefetch(t *testing.T) {
+	tests := map[string]struct {
+		// finishAfter is when the prefetch finishes.
+		finishAfter time.Duration
+	}{
+		"done":        {},
+		"in progress": {finishAfter: 50 * time.Millisecond},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			done := make(chan struct{})
+			finished := time.Now().Add(tt.finishAfter)
+			time.AfterFunc(tt.finishAfter, func() { close(done) })
+			waitForPrefetch(logr.Discard(), done)
+			if time.Now().Before(finished) {
+				t.Error("returned before the prefetch finished")
+			}
+		})
+	}
+}
+
+func TestStartPrefetch(t *testing.T) {
+	// Without a reachable runtime, the prefetch waits for it until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := tinkWorkerConfig{prefetchImages: "alpine", containerRuntime: "podman", podmanAddress: filepath.Join(t.TempDir(), "podman.sock")}
+	done := startPrefetch(ctx, logr.Discard(), cfg, retryPolicy{})
+	select {
+	case <-done:
+		t.Fatal("the prefetch finished without a runtime")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the prefetch did not stop when the context was cancelled")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// preflightTimeout bounds every network check of the preflight.
+const preflightTimeout = 5 * time.Second
+
+// checkResult is the outcome of a preflight check.
+type checkResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// preflightReport is the outcome of the preflight checks, in the order they ran.
+type preflightReport struct {
+	Checks []checkResult `json:"checks"`
+}
+
+// ok reports whether all the checks passed.
+func (r preflightReport) ok() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the report as one line per check, for the logs and the console.
+func (r preflightReport) String() string {
+	var b strings.Builder
+	b.WriteString("preflight checks:\n")
+	for _, c := range r.Checks {
+		result := " ok "
+		if !c.OK {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&b, "  [%s] %-40s %s\n", result, c.Name, c.Detail)
+	}
+	return b.String()
+}
+
+// announcePreflight writes a failed preflight report to the console, where it is seen without
+// access to the logs.
+func announcePreflight(r preflightReport) {
+	f, err := os.OpenFile("/dev/console", os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "\nHookOS: the network preflight checks failed, pulling tink-worker is likely to fail\n%s\n", r)
+}
+
+// preflight checks the network connectivity needed to pull tink-worker and for tink-worker to
+// reach tink-server: the default route, the name resolution, TCP and TLS to the registry and to
+// grpc_authority, and the proxy. The failures show where the network is broken, which the error of
+// the pull itself rarely does.
+type preflight struct {
+	// routeFiles are the IPv4 and IPv6 routing tables, in the /proc/net/route and
+	// /proc/net/ipv6_route formats.
+	routeFiles [2]string
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	dialer     *net.Dialer
+	// rootCAs verifies the certificates of the registry and tink-server; nil uses the system roots.
+	rootCAs *x509.CertPool
+}
+
+// preflightTarget is a host:port the preflight connects to.
+type preflightTarget struct {
+	name, addr string
+	tls        bool
+	insecure   bool
+}
+
+func newPreflight() *preflight {
+	return &preflight{
+		routeFiles: [2]string{"/proc/net/route", "/proc/net/ipv6_route"},
+		lookupHost: net.DefaultResolver.LookupHost,
+		dialer:     &net.Dialer{Timeout: preflightTimeout},
+	}
+}
+
+// run runs the checks for the image and the configuration; the registry is not checked when
+// imageName is empty. It does not stop at the first failure, so the report shows everything that
+// is wrong.
+func (p *preflight) run(ctx context.Context, cfg tinkWorkerConfig, imageName string) preflightReport {
+	var r preflightReport
+	add := func(name string, detail string, err error) {
+		if err != nil {
+			r.Checks = append(r.Checks, checkResult{Name: name, Detail: err.Error()})
+			return
+		}
+		r.Checks = append(r.Checks, checkResult{Name: name, OK: true, Detail: detail})
+	}
+
+	detail, err := p.defaultRoute()
+	add("default route", detail, err)
+
+	proxies := httpproxy.Config{HTTPProxy: cfg.httpProxy, HTTPSProxy: cfg.httpsProxy, NoProxy: cfg.noProxy}
+	proxyFunc := proxies.ProxyFunc()
+	checked := map[string]bool{}
+
+	var targets []preflightTarget
+	if imageName != "" {
+		if addr, err := registryAddr(imageName); err == nil {
+			targets = append(targets, preflightTarget{name: "registry", addr: addr, tls: true})
+		} else {
+			add("registry", "", err)
+		}
+	}
+	if cfg.grpcAuthority != "" {
+		useTLS, _ := strconv.ParseBool(cfg.tinkServerTLS)
+		insecure, _ := strconv.ParseBool(cfg.tinkServerInsecureTLS)
+		targets = append(targets, preflightTarget{name: "grpc_authority", addr: cfg.grpcAuthority, tls: useTLS, insecure: insecure})
+	}
+
+	for _, t := range targets {
+		host, _, err := net.SplitHostPort(t.addr)
+		if err != nil {
+			add(t.name, "", fmt.Errorf("%s: %w", t.addr, err))
+			continue
+		}
+		proxy, err := proxyFunc(&url.URL{Scheme: "https", Host: t.addr})
+		if err != nil {
+			add(t.name+" proxy", "", err)
+			continue
+		}
+		if proxy != nil {
+			// The names are resolved by the proxy, so only the proxy has to be reachable.
+			if !checked[proxy.Host] {
+				checked[proxy.Host] = true
+				detail, err := p.tcp(ctx, proxyAddr(proxy))
+				add("proxy "+proxy.Host, detail, err)
+			}
+		} else if net.ParseIP(host) == nil {
+			detail, err := p.resolve(ctx, host)
+			add("resolve "+host, detail, err)
+		}
+		name := "TCP " + t.addr
+		if t.tls {
+			name = "TCP and TLS " + t.addr
+		}
+		detail, err := p.connect(ctx, t.addr, proxy, t.tls, t.insecure)
+		add(name, t.name+": "+detail, err)
+	}
+	return r
+}
+
+// defaultRoute returns the default routes of the routing tables.
+func (p *preflight) defaultRoute() (string, error) {
+	var routes []string
+	if b, err := os.ReadFile(p.routeFiles[0]); err == nil {
+		routes = append(routes, defaultRoutes4(b)...)
+	}
+	if b, err := os.ReadFile(p.routeFiles[1]); err == nil {
+		routes = append(routes, defaultRoutes6(b)...)
+	}
+	if len(routes) == 0 {
+		return "", errors.New("no default route, the network is not configured: check the DHCP client or the static network configuration")
+	}
+	return strings.Join(routes, ", "), nil
+}
+
+// defaultRoutes4 returns the default routes in an IPv4 routing table in the /proc/net/route format.
+func defaultRoutes4(table []byte) []string {
+	var routes []string
+	s := bufio.NewScanner(bytes.NewReader(table))
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		f := strings.Fields(s.Text())
+		if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(f[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+		// The gateway is in host byte order, which is little endian on the supported architectures.
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		routes = append(routes, fmt.Sprintf("via %s dev %s", ip, f[0]))
+	}
+	return routes
+}
+
+// defaultRoutes6 returns the default routes in an IPv6 routing table in the /proc/net/ipv6_route format.
+func defaultRoutes6(table []byte) []string {
+	var routes []string
+	s := bufio.NewScanner(bytes.NewReader(table))
+	for s.Scan() {
+		// Destination PrefixLen Source PrefixLen NextHop Metric RefCnt Use Flags Iface
+		f := strings.Fields(s.Text())
+		if len(f) < 10 || f[1] != "00" || strings.Trim(f[0], "0") != "" || f[9] == "lo" {
+			continue
+		}
+		nh, err := hex.DecodeString(f[4])
+		if err != nil || len(nh) != 16 || net.IP(nh).IsUnspecified() {
+			continue
+		}
+		routes = append(routes, fmt.Sprintf("via %s dev %s", net.IP(nh), f[9]))
+	}
+	return routes
+}
+
+// resolve resolves a name.
+func (p *preflight) resolve(ctx context.Context, host string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	addrs, err := p.lookupHost(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s failed, check the DNS servers: %w", host, err)
+	}
+	return strings.Join(addrs, ", "), nil
+}
+
+// tcp opens a TCP connection.
+func (p *preflight) tcp(ctx context.Context, addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	conn, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("connecting to %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+	return "connected to " + conn.RemoteAddr().String(), nil
+}
+
+// connect opens a TCP connection to addr, through the proxy when it is not nil, and does a TLS
+// handshake over it when useTLS is set.
+func (p *preflight) connect(ctx context.Context, addr string, proxy *url.URL, useTLS, insecure bool) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = p.dialProxy(ctx, proxy, addr)
+	} else {
+		conn, err = p.dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("connecting to %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+	detail := "connected to " + conn.RemoteAddr().String()
+	if proxy != nil {
+		detail += " through the proxy"
+	}
+	if !useTLS {
+		return detail, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	cfg := &tls.Config{ServerName: host, RootCAs: p.rootCAs, InsecureSkipVerify: insecure} //nolint:gosec // Only with tinkerbell_insecure_tls, like tink-worker.
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("TLS handshake with %s failed, check the certificates and the clock (%s): %w", addr, time.Now().UTC().Format(time.RFC3339), err)
+	}
+	return detail + ", TLS " + tls.VersionName(tc.ConnectionState().Version), nil
+}
+
+// dialProxy opens a tunnel to addr through an HTTP proxy, with the CONNECT method.
+func (p *preflight) dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, "tcp", proxyAddr(proxy))
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	if d, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(d)
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u := proxy.User; u != nil {
+		pw, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pw)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	// The body is not closed on success: it is the tunnel, and closing it would read from it.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused the connection: %s", proxy.Host, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyAddr returns the host:port of a proxy URL, with the default port of its scheme.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	if proxy.Scheme == "https" {
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// registryAddr returns the host:port of the registry of an image.
+func registryAddr(imageName string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %q: %w", imageName, err)
+	}
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		// Docker Hub images are pulled from registry-1.docker.io.
+		domain = "registry-1.docker.io"
+	}
+	if _, _, err := net.SplitHostPort(domain); err == nil {
+		return domain, nil
+	}
+	return net.JoinHostPort(domain, "443"), nil
+}
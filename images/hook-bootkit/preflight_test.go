@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDefaultRoutes(t *testing.T) {
+	tests := map[string]struct {
+		route  string
+		route6 string
+		want   []string
+	}{
+		"ipv4": {
+			route: "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+				"eth0\t00000000\t0100000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"eth0\t0000000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			want: []string{"via 10.0.0.1 dev eth0"},
+		},
+		"ipv6": {
+			route6: "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0\n" +
+				"20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0\n" +
+				"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200 lo\n",
+			want: []string{"via fe80::1 dev eth0"},
+		},
+		"no default route": {
+			route: "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+				"eth0\t0000000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := newPreflight()
+			p.routeFiles = [2]string{filepath.Join(dir, "route"), filepath.Join(dir, "ipv6_route")}
+			for i, content := range []string{tt.route, tt.route6} {
+				if err := os.WriteFile(p.routeFiles[i], []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := p.defaultRoute()
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("got err %v, want routes %v", err, tt.want)
+			}
+			if tt.want != nil {
+				if diff := cmp.Diff(strings.Join(tt.want, ", "), got); diff != "" {
+					t.Error(diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryAddr(t *testing.T) {
+	tests := map[string]struct {
+		image string
+		want  string
+	}{
+		"docker hub":         {image: "tinkerbell/tink-worker", want: "registry-1.docker.io:443"},
+		"registry":           {image: "quay.io/tinkerbell/tink-worker:latest", want: "quay.io:443"},
+		"registry with port": {image: "10.0.0.1:5000/tink-worker:latest", want: "10.0.0.1:5000"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := registryAddr(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// connectProxy is an HTTP proxy that tunnels the CONNECT requests to target, whatever their host.
+func connectProxy(t *testing.T, target string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPreflight(t *testing.T) {
+	registry := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(registry.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(registry.Certificate())
+	registryHost := strings.TrimPrefix(registry.URL, "https://")
+
+	tinkServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tinkServer.Close() })
+	go func() {
+		for {
+			conn, err := tinkServer.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// The proxies are not used for loopback addresses, so the registry is reached through the proxy
+	// as example.com, which its certificate is valid for.
+	proxy := connectProxy(t, registryHost)
+
+	tests := map[string]struct {
+		cfg   tinkWorkerConfig
+		image string
+		// want is the result of each check, by name.
+		want map[string]bool
+	}{
+		"reachable": {
+			cfg:   tinkWorkerConfig{grpcAuthority: tinkServer.Addr().String()},
+			image: registryHost + "/tink-worker:latest",
+			want:  map[string]bool{"default route": true, "TCP and TLS " + registryHost: true, "TCP " + tinkServer.Addr().String(): true},
+		},
+		"through the proxy": {
+			cfg:   tinkWorkerConfig{grpcAuthority: tinkServer.Addr().String(), httpsProxy: proxy.URL},
+			image: "example.com/tink-worker:latest",
+			want: map[string]bool{
+				"default route": true, "proxy " + strings.TrimPrefix(proxy.URL, "http://"): true,
+				"TCP and TLS example.com:443": true, "TCP " + tinkServer.Addr().String(): true,
+			},
+		},
+		"unreachable proxy": {
+			cfg:   tinkWorkerConfig{httpsProxy: "http://127.0.0.1:1"},
+			image: "example.com/tink-worker:latest",
+			want:  map[string]bool{"default route": true, "proxy 127.0.0.1:1": false, "TCP and TLS example.com:443": false},
+		},
+		"unresolvable registry and TLS to tink-server": {
+			cfg:   tinkWorkerConfig{grpcAuthority: tinkServer.Addr().String(), tinkServerTLS: "true"},
+			image: "registry.invalid/tink-worker:latest",
+			want: map[string]bool{
+				"default route": true, "resolve registry.invalid": false, "TCP and TLS registry.invalid:443": false,
+				"TCP and TLS " + tinkServer.Addr().String(): false,
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := newPreflight()
+			p.routeFiles = [2]string{filepath.Join(dir, "route"), filepath.Join(dir, "ipv6_route")}
+			if err := os.WriteFile(p.routeFiles[0], []byte("eth0\t00000000\t0100000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			p.lookupHost = func(context.Context, string) ([]string, error) { return nil, errors.New("no such host") }
+			p.rootCAs = roots
+
+			report := p.run(context.Background(), tt.cfg, tt.image)
+			got := map[string]bool{}
+			for _, c := range report.Checks {
+				got[c.Name] = c.OK
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("%s\n%s", diff, report)
+			}
+			wantOK := true
+			for _, ok := range tt.want {
+				wantOK = wantOK && ok
+			}
+			if report.ok() != wantOK {
+				t.Errorf("got ok %v, want %v", report.ok(), wantOK)
+			}
+		})
+	}
+}
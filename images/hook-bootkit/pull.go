@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/go-logr/logr"
+)
+
+// layerProgress is the download state of a single image layer.
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// pullStats summarizes an image pull stream.
+type pullStats struct {
+	layers     int
+	layersDone int
+	// bytes is the number of bytes downloaded, bytesTotal the size of all layers being downloaded.
+	bytes      int64
+	bytesTotal int64
+	duration   time.Duration
+}
+
+// percent returns how much of the known layer bytes have been downloaded.
+func (p pullStats) percent() float64 {
+	if p.bytesTotal == 0 {
+		return 0
+	}
+	return float64(p.bytes) / float64(p.bytesTotal) * 100
+}
+
+// bytesPerSecond returns the average download rate.
+func (p pullStats) bytesPerSecond() float64 {
+	if p.duration <= 0 {
+		return 0
+	}
+	return float64(p.bytes) / p.duration.Seconds()
+}
+
+// pullProgress aggregates the jsonmessage stream of an image pull into per-layer progress.
+type pullProgress struct {
+	start  time.Time
+	layers map[string]*layerProgress
+	// order keeps the layer IDs in the order they were first seen.
+	order []string
+}
+
+func newPullProgress() *pullProgress {
+	return &pullProgress{start: time.Now(), layers: map[string]*layerProgress{}}
+}
+
+// update applies a single message from the pull stream. It returns an error if the
+// message reports a failure, for example a missing manifest or denied authentication.
+func (p *pullProgress) update(msg jsonmessage.JSONMessage) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if msg.ErrorMessage != "" {
+		return errors.New(msg.ErrorMessage)
+	}
+	// Messages without an ID are about the image as a whole, for example "Digest: sha256:...".
+	if msg.ID == "" {
+		return nil
+	}
+
+	l, ok := p.layers[msg.ID]
+	if !ok {
+		// The image tag (for example "latest") is reported with an ID too, but never as a layer status.
+		if msg.Status != "Pulling fs layer" && msg.Status != "Waiting" && msg.Status != "Already exists" && msg.Progress == nil {
+			return nil
+		}
+		l = &layerProgress{}
+		p.layers[msg.ID] = l
+		p.order = append(p.order, msg.ID)
+	}
+
+	switch msg.Status {
+	case "Downloading":
+		if msg.Progress != nil {
+			l.current = msg.Progress.Current
+			if msg.Progress.Total > 0 {
+				l.total = msg.Progress.Total
+			}
+		}
+	case "Verifying Checksum", "Download complete":
+		l.current = l.total
+	case "Pull complete", "Already exists":
+		l.current = l.total
+		l.done = true
+	}
+	return nil
+}
+
+// stats returns the current state of the pull.
+func (p *pullProgress) stats() pullStats {
+	s := pullStats{layers: len(p.layers), duration: time.Since(p.start)}
+	for _, id := range p.order {
+		l := p.layers[id]
+		s.bytes += l.current
+		s.bytesTotal += l.total
+		if l.done {
+			s.layersDone++
+		}
+	}
+	return s
+}
+
+// imagePullPolicy is when the tink-worker image is pulled, with the semantics of the Kubernetes
+// image pull policies.
+type imagePullPolicy string
+
+const (
+	// pullDefault uses a matching embedded image or the image of the image archive, and otherwise
+	// pulls the image and falls back to the local image when the pull fails.
+	pullDefault imagePullPolicy = ""
+	// pullAlways always pulls the image, and fails when the pull fails.
+	pullAlways imagePullPolicy = "always"
+	// pullIfNotPresent only pulls the image when it is not in the local image store.
+	pullIfNotPresent imagePullPolicy = "if-not-present"
+	// pullNever never pulls the image, and fails when it is not in the local image store.
+	pullNever imagePullPolicy = "never"
+)
+
+// parseImagePullPolicy parses tink_worker_pull_policy=.
+func parseImagePullPolicy(s string) (imagePullPolicy, error) {
+	switch p := imagePullPolicy(s); p {
+	case pullDefault, pullAlways, pullIfNotPresent, pullNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported tink_worker_pull_policy=%q, must be one of always, if-not-present or never", s)
+	}
+}
+
+// needsPull reports whether imageName has to be pulled, given its ID in the local image store,
+// empty when it is not there, and whether it matches the embedded image manifest or was loaded from
+// the image archive. The never policy fails when the image is not in the local image store, without
+// waiting on the network.
+func (p imagePullPolicy) needsPull(imageName, localID string, preloaded bool) (bool, error) {
+	switch p {
+	case pullAlways:
+		return true, nil
+	case pullIfNotPresent:
+		return localID == "", nil
+	case pullNever:
+		if localID == "" {
+			return false, newBootstrapError(kindNotFound, fmt.Errorf("image %s is not in the local image store and tink_worker_pull_policy=never", imageName))
+		}
+		return false, nil
+	default:
+		return !preloaded, nil
+	}
+}
+
+// pullImage pulls imageName and waits for the pull to finish.
+// The pull request can succeed while the stream reports a failure, for example a missing
+// manifest or denied authentication, so the stream is parsed for errors too.
+func pullImage(ctx context.Context, log logr.Logger, cli *client.Client, imageName string, opts image.PullOptions) (pullStats, error) {
+	out, err := cli.ImagePull(ctx, imageName, opts)
+	if err != nil {
+		return pullStats{}, err
+	}
+	defer out.Close()
+
+	return consumePullStream(log, out, imageName, 5*time.Second)
+}
+
+// pullWithRetry pulls imageName with rt, retrying failed pulls according to policy. Permanent errors
+// stop the retries early. With useLocal, a failed pull is not an error when the image is in the
+// local image store. It returns the downloaded bytes and the number of retries.
+func pullWithRetry(ctx context.Context, log logr.Logger, rt containerRuntime, imageName string, auth *registryAuth, useLocal bool, policy retryPolicy) (int64, int, error) {
+	var pulledBytes int64
+	imagePullOperation := func() error {
+		// with embedded images that are not in the embedded image manifest, the tink
+		// worker could potentially already exist in the local image store. And the image
+		// name could be something unreachable via the network (for example:
+		// 127.0.0.1/embedded/tink-worker). Because of this we check if the image already
+		// exists and don't return an error if the image does not exist and the pull fails.
+		var id string
+		if useLocal {
+			id, _ = rt.ImageID(ctx, imageName)
+		}
+		stats, err := rt.Pull(ctx, imageName, auth)
+		pulledBytes += stats.bytes
+		if err != nil {
+			if id != "" {
+				log.Info("image pull failed, using the existing local image", "imageName", imageName, "error", err.Error())
+				return nil
+			}
+			err = classify(err)
+			log.Error(err, "image pull failure", "imageName", imageName, "errorKind", kindOf(err))
+			if isPermanent(err) {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		return nil
+	}
+	var retries int
+	notify := func(error, time.Duration) {
+		retries++
+		imagePullRetries.Inc()
+	}
+	err := backoff.RetryNotify(imagePullOperation, policy.backOff(ctx), notify)
+	return pulledBytes, retries, err
+}
+
+// consumePullStream reads the image pull stream until it ends, logging a progress summary every interval.
+// It returns an error when the stream reports a failure, even though the pull request itself succeeded.
+func consumePullStream(log logr.Logger, out io.Reader, imageName string, interval time.Duration) (pullStats, error) {
+	p := newPullProgress()
+	dec := json.NewDecoder(out)
+	last := time.Now()
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return p.stats(), fmt.Errorf("reading image pull stream failed: %w", err)
+		}
+		if err := p.update(msg); err != nil {
+			return p.stats(), fmt.Errorf("image pull reported an error: %w", err)
+		}
+		if msg.ID == "" && msg.Status != "" {
+			log.Info("image pull", "imageName", imageName, "status", msg.Status)
+		}
+		if time.Since(last) >= interval {
+			last = time.Now()
+			logPullStats(log, "image pull progress", imageName, p.stats())
+		}
+	}
+	s := p.stats()
+	logPullStats(log, "image pull finished", imageName, s)
+	return s, nil
+}
+
+func logPullStats(log logr.Logger, msg, imageName string, s pullStats) {
+	log.Info(msg,
+		"imageName", imageName,
+		"percent", fmt.Sprintf("%.1f", s.percent()),
+		"bytes", s.bytes,
+		"bytesTotal", s.bytesTotal,
+		"bytesPerSecond", int64(s.bytesPerSecond()),
+		"layersDone", s.layersDone,
+		"layers", s.layers,
+	)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/go-logr/logr"
+)
+
+func TestConsumePullStream(t *testing.T) {
+	tests := map[string]struct {
+		stream    string
+		want      pullStats
+		wantErr   string
+		wantPcent float64
+	}{
+		"successful pull": {
+			stream: `{"status":"Pulling from tinkerbell/tink-worker","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"b2"}
+{"status":"Already exists","progressDetail":{},"id":"c3"}
+{"status":"Downloading","progressDetail":{"current":50,"total":100},"id":"a1"}
+{"status":"Downloading","progressDetail":{"current":100,"total":300},"id":"b2"}
+{"status":"Download complete","progressDetail":{},"id":"a1"}
+{"status":"Pull complete","progressDetail":{},"id":"a1"}
+{"status":"Digest: sha256:0123"}
+{"status":"Status: Downloaded newer image for quay.io/tinkerbell/tink-worker:latest"}
+`,
+			want:      pullStats{layers: 3, layersDone: 2, bytes: 200, bytesTotal: 400},
+			wantPcent: 50,
+		},
+		"error embedded in the stream": {
+			stream: `{"status":"Pulling from tinkerbell/tink-worker","id":"latest"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}
+`,
+			wantErr: "image pull reported an error: manifest unknown",
+		},
+		"error message without details": {
+			stream:  `{"error":"unauthorized: authentication required"}`,
+			wantErr: "image pull reported an error: unauthorized: authentication required",
+		},
+		"malformed stream": {
+			stream:  `{"status":`,
+			wantErr: "reading image pull stream failed: unexpected EOF",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := consumePullStream(logr.Discard(), strings.NewReader(tt.stream), "tink-worker", time.Hour)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got err %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.duration = 0
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			if got.percent() != tt.wantPcent {
+				t.Fatalf("got %v percent, want %v", got.percent(), tt.wantPcent)
+			}
+		})
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		wantErr bool
+	}{
+		"success": {
+			status: http.StatusOK,
+			body:   `{"status":"Status: Image is up to date for quay.io/tinkerbell/tink-worker:latest"}`,
+		},
+		"error in stream": {
+			status:  http.StatusOK,
+			body:    `{"errorDetail":{"message":"manifest for quay.io/tinkerbell/tink-worker:nope not found"},"error":"manifest for quay.io/tinkerbell/tink-worker:nope not found"}`,
+			wantErr: true,
+		},
+		"error response": {
+			status:  http.StatusUnauthorized,
+			body:    `{"message":"unauthorized: authentication required"}`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/images/create") {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			cli, err := client.NewClientWithOpts(client.WithHost(srv.URL), client.WithVersion("1.47"), client.WithHTTPClient(srv.Client()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = pullImage(context.Background(), logr.Discard(), cli, "quay.io/tinkerbell/tink-worker:latest", image.PullOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy   string
+		localID  string
+		embedded bool
+		want     bool
+		wantKind errorKind
+		// wantParseErr is set for policies that are not valid.
+		wantParseErr bool
+	}{
+		"default pulls":                          {want: true},
+		"default uses the embedded image":        {localID: "sha256:0123", embedded: true},
+		"always pulls the embedded image":        {policy: "always", localID: "sha256:0123", embedded: true, want: true},
+		"if-not-present pulls a missing image":   {policy: "if-not-present", want: true},
+		"if-not-present uses the local image":    {policy: "if-not-present", localID: "sha256:0123"},
+		"never uses the local image":             {policy: "never", localID: "sha256:0123"},
+		"never fails without a local image":      {policy: "never", wantKind: kindNotFound},
+		"never fails without the embedded image": {policy: "never", embedded: true, wantKind: kindNotFound},
+		"invalid":                                {policy: "IfNotPresent", wantParseErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := parseImagePullPolicy(tt.policy)
+			if (err != nil) != tt.wantParseErr {
+				t.Fatalf("got err %v, wantParseErr %v", err, tt.wantParseErr)
+			}
+			if tt.wantParseErr {
+				return
+			}
+			got, err := p.needsPull("quay.io/tinkerbell/tink-worker:latest", tt.localID, tt.embedded)
+			if tt.wantKind != "" {
+				if kindOf(err) != tt.wantKind {
+					t.Fatalf("got err %v of kind %q, want kind %q", err, kindOf(err), tt.wantKind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got needsPull %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
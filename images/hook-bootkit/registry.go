@@ -28,3 +28,11 @@ func useAuth(imageRef, registryHost string) bool {
 
 	return imageH == registryH
 }
+
+// registryAuth returns the credentials of cfg for pulling imageRef, or nil when useAuth is false.
+func (cfg tinkWorkerConfig) registryAuth(imageRef string) *registryAuth {
+	if !useAuth(imageRef, cfg.registry) {
+		return nil
+	}
+	return &registryAuth{username: cfg.username, password: cfg.password}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// retryPolicy describes how often and for how long an operation is retried.
+// A zero maxElapsed or maxAttempts means there is no limit.
+type retryPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsed      time.Duration
+	maxAttempts     int
+}
+
+// retryConfig holds the raw hook_retry_* values from the kernel command line.
+type retryConfig struct {
+	initialInterval string
+	maxInterval     string
+	maxElapsed      string
+	maxAttempts     string
+
+	permanentInterval    string
+	permanentMaxAttempts string
+}
+
+// defaultTransientPolicy retries transient errors, like an unreachable registry, forever.
+var defaultTransientPolicy = retryPolicy{
+	initialInterval: time.Second,
+	maxInterval:     time.Minute,
+}
+
+// defaultPermanentPolicy retries permanent errors, like denied authentication, a few times
+// in case they were caused by a misconfiguration on the server side that has since been fixed.
+var defaultPermanentPolicy = retryPolicy{
+	initialInterval: 30 * time.Second,
+	maxInterval:     30 * time.Second,
+	maxAttempts:     3,
+}
+
+// policies returns the transient and permanent retry policies, applying the configured values over the defaults.
+func (r retryConfig) policies() (transient, permanent retryPolicy, err error) {
+	transient, permanent = defaultTransientPolicy, defaultPermanentPolicy
+
+	var errs []error
+	parseDuration := func(key, v string, d *time.Duration) {
+		if v == "" {
+			return
+		}
+		p, err := time.ParseDuration(v)
+		if err != nil || p < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s=%q, must be a duration such as 30s or 5m", key, v))
+			return
+		}
+		*d = p
+	}
+	parseInt := func(key, v string, i *int) {
+		if v == "" {
+			return
+		}
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s=%q, must be a positive number", key, v))
+			return
+		}
+		*i = p
+	}
+	parseDuration("hook_retry_initial_interval", r.initialInterval, &transient.initialInterval)
+	parseDuration("hook_retry_max_interval", r.maxInterval, &transient.maxInterval)
+	parseDuration("hook_retry_max_elapsed", r.maxElapsed, &transient.maxElapsed)
+	parseInt("hook_retry_max_attempts", r.maxAttempts, &transient.maxAttempts)
+	parseDuration("hook_retry_permanent_interval", r.permanentInterval, &permanent.initialInterval)
+	permanent.maxInterval = permanent.initialInterval
+	parseInt("hook_retry_permanent_max_attempts", r.permanentMaxAttempts, &permanent.maxAttempts)
+
+	if transient.maxInterval < transient.initialInterval {
+		transient.maxInterval = transient.initialInterval
+	}
+
+	return transient, permanent, errors.Join(errs...)
+}
+
+// backOff returns a backoff.BackOff that implements the policy.
+func (p retryPolicy) backOff(ctx context.Context) backoff.BackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = p.initialInterval
+	bo.MaxInterval = p.maxInterval
+	bo.MaxElapsedTime = p.maxElapsed
+	bo.Reset()
+
+	var b backoff.BackOff = bo
+	if p.maxAttempts > 0 {
+		// The first attempt is not a retry.
+		b = backoff.WithMaxRetries(b, uint64(p.maxAttempts-1))
+	}
+	return backoff.WithContext(b, ctx)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestRetryPolicies(t *testing.T) {
+	tests := map[string]struct {
+		cfg           retryConfig
+		wantTransient retryPolicy
+		wantPermanent retryPolicy
+		wantErr       bool
+	}{
+		"defaults": {wantTransient: defaultTransientPolicy, wantPermanent: defaultPermanentPolicy},
+		"configured": {
+			cfg: retryConfig{
+				initialInterval:      "2s",
+				maxInterval:          "30s",
+				maxElapsed:           "10m",
+				maxAttempts:          "20",
+				permanentInterval:    "5m",
+				permanentMaxAttempts: "1",
+			},
+			wantTransient: retryPolicy{initialInterval: 2 * time.Second, maxInterval: 30 * time.Second, maxElapsed: 10 * time.Minute, maxAttempts: 20},
+			wantPermanent: retryPolicy{initialInterval: 5 * time.Minute, maxInterval: 5 * time.Minute, maxAttempts: 1},
+		},
+		"max interval below initial interval": {
+			cfg:           retryConfig{initialInterval: "2m"},
+			wantTransient: retryPolicy{initialInterval: 2 * time.Minute, maxInterval: 2 * time.Minute},
+			wantPermanent: defaultPermanentPolicy,
+		},
+		"invalid values keep the defaults": {
+			cfg:           retryConfig{initialInterval: "soon", maxAttempts: "-1"},
+			wantTransient: defaultTransientPolicy,
+			wantPermanent: defaultPermanentPolicy,
+			wantErr:       true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			transient, permanent, err := tt.cfg.policies()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if transient != tt.wantTransient {
+				t.Errorf("got transient policy %+v, want %+v", transient, tt.wantTransient)
+			}
+			if permanent != tt.wantPermanent {
+				t.Errorf("got permanent policy %+v, want %+v", permanent, tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	p := retryPolicy{initialInterval: time.Millisecond, maxInterval: time.Millisecond, maxAttempts: 3}
+	var attempts int
+	err := backoff.Retry(func() error {
+		attempts++
+		return errors.New("registry unreachable")
+	}, p.backOff(context.Background()))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if attempts != 3 {
+		t.Fatalf("got %d attempts, want 3", attempts)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/go-logr/logr"
+)
+
+// registryAuth holds the credentials used to pull from a private registry.
+type registryAuth struct {
+	username string
+	password string
+}
+
+// bindMount bind mounts source, a path as the container runtime sees it, to target in the container.
+type bindMount struct {
+	source   string
+	target   string
+	readOnly bool
+}
+
+// containerSpec is a runtime independent description of a container.
+type containerSpec struct {
+	name        string
+	image       string
+	env         []string
+	labels      map[string]string
+	mounts      []bindMount
+	devices     []deviceMapping
+	hostNetwork bool
+	privileged  bool
+	// capabilities are added to the default capabilities of unprivileged containers, in the CAP_ form.
+	capabilities []string
+	// memoryLimit is in bytes and nanoCPUs in billionths of a CPU; zero means no limit.
+	memoryLimit int64
+	nanoCPUs    int64
+	// restartPolicy is one of no, always, on-failure or unless-stopped; empty means no.
+	restartPolicy string
+}
+
+// containerStatus is the state of a container as reported by the container runtime.
+type containerStatus struct {
+	id           string
+	running      bool
+	exitCode     int
+	err          string
+	restartCount int
+}
+
+// containerRuntime is the container engine that runs tink-worker.
+type containerRuntime interface {
+	// Name is the name of the runtime, as used in container_runtime=.
+	Name() string
+	// Ping returns an error when the runtime API is not reachable.
+	Ping(ctx context.Context) error
+	// ImageID returns the ID of ref in the local image store, which is the digest of its config, or
+	// an empty ID when ref is not in the store.
+	ImageID(ctx context.Context, ref string) (string, error)
+	// Pull pulls ref, authenticating with auth when it is not nil.
+	Pull(ctx context.Context, ref string, auth *registryAuth) (pullStats, error)
+	// Load loads the images of a docker save or OCI archive and returns their references.
+	Load(ctx context.Context, archive io.Reader) ([]string, error)
+	// Inspect returns the status of the container with the given name or ID.
+	Inspect(ctx context.Context, name string) (containerStatus, error)
+	// Remove removes the container with the given name, killing it if it's running. A missing container is not an error.
+	Remove(ctx context.Context, name string) error
+	// Create creates a container and returns its ID.
+	Create(ctx context.Context, spec containerSpec) (string, error)
+	// Start starts the created container.
+	Start(ctx context.Context, id string) error
+	// Wait blocks until the container stops running and returns its exit code.
+	Wait(ctx context.Context, id string) (int, error)
+	// DefaultMounts returns the mounts tink-worker needs, with sources as the runtime sees them.
+	DefaultMounts() []bindMount
+	// Close releases the resources of the runtime client.
+	Close() error
+}
+
+// newContainerRuntime returns the container runtime selected with container_runtime=, defaulting to Docker.
+func newContainerRuntime(log logr.Logger, cfg tinkWorkerConfig) (containerRuntime, error) {
+	switch cfg.containerRuntime {
+	case "", "docker":
+		return newDockerRuntime(log)
+	case "containerd":
+		return newContainerdRuntime(log, cfg.containerdAddress)
+	case "podman":
+		return newPodmanRuntime(log, cfg.podmanAddress), nil
+	default:
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("unsupported container_runtime=%q, must be one of docker, containerd or podman", cfg.containerRuntime))
+	}
+}
+
+// encodeRegistryAuth returns auth in the base64 encoded JSON form of the X-Registry-Auth header,
+// which Docker and Podman both use.
+func encodeRegistryAuth(auth *registryAuth) (string, error) {
+	encodedJSON, err := json.Marshal(registry.AuthConfig{
+		Username: auth.username,
+		Password: strings.TrimSuffix(auth.password, "\n"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encodedJSON), nil
+}
+
+// containerGracePeriod is how long a started container must keep running to count as successfully started.
+var containerGracePeriod = 3 * time.Second
+
+// checkContainerRunning checks that the container is still running after the grace period.
+func checkContainerRunning(ctx context.Context, rt containerRuntime, containerID string, grace time.Duration) error {
+	wctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	if code, err := rt.Wait(wctx, containerID); err == nil {
+		return newBootstrapError(kindContainerCrash, fmt.Errorf("container exited with code %d", code))
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	status, err := rt.Inspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	if !status.running {
+		return newBootstrapError(kindContainerCrash, fmt.Errorf("container is not running, exit code %d: %s", status.exitCode, status.err))
+	}
+	return nil
+}
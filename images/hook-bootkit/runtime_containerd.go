@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// containerdNamespace is the containerd namespace tink-worker is run in.
+	containerdNamespace = "tinkerbell"
+	// defaultContainerdAddress is the socket of the HookOS containerd service.
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	// containerdLogFile is the host file the stdout and stderr of tink-worker are written to.
+	containerdLogFile = "/var/log/tink-worker.log"
+)
+
+// containerdDockerSocket is the path of the Docker API socket of hook-docker in the BootKit
+// container, where /var/run is the /var/run/docker of the host. tink-worker runs the workflow
+// actions with the Docker API, which containerd doesn't provide.
+var containerdDockerSocket = "/var/run/docker.sock"
+
+// containerdHostDockerSocket is the host path of containerdDockerSocket, the source of its bind
+// mount in tink-worker, as containerd resolves the sources of the mounts on the host.
+const containerdHostDockerSocket = "/var/run/docker/docker.sock"
+
+// containerdRuntime runs containers directly with the containerd of HookOS, so that tink-worker
+// keeps running when dockerd restarts. tink-worker still needs the Docker API of hook-docker to run
+// the actions.
+type containerdRuntime struct {
+	cli     *containerd.Client
+	log     logr.Logger
+	address string
+}
+
+func newContainerdRuntime(log logr.Logger, address string) (*containerdRuntime, error) {
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	if _, err := os.Stat(containerdDockerSocket); err != nil {
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("container_runtime=containerd needs the hook-docker service, as tink-worker runs the actions with its Docker API: %w", err))
+	}
+	cli, err := containerd.New(address, containerd.WithDefaultNamespace(containerdNamespace))
+	if err != nil {
+		return nil, err
+	}
+	return &containerdRuntime{cli: cli, log: log, address: address}, nil
+}
+
+func (c *containerdRuntime) Name() string {
+	return "containerd"
+}
+
+func (c *containerdRuntime) Ping(ctx context.Context) error {
+	_, err := c.cli.Version(ctx)
+	return err
+}
+
+func (c *containerdRuntime) ImageID(ctx context.Context, ref string) (string, error) {
+	ref, err := normalizeRef(ref)
+	if err != nil {
+		return "", err
+	}
+	img, err := c.cli.GetImage(ctx, ref)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	config, err := img.Config(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.Digest.String(), nil
+}
+
+// Pull pulls and unpacks ref. containerd does not report per layer progress, so the
+// returned stats hold the total image size once the pull is done.
+func (c *containerdRuntime) Pull(ctx context.Context, ref string, auth *registryAuth) (pullStats, error) {
+	ref, err := normalizeRef(ref)
+	if err != nil {
+		return pullStats{}, err
+	}
+	var authOpts []docker.AuthorizerOpt
+	if auth != nil {
+		authOpts = append(authOpts, docker.WithAuthCreds(func(string) (string, string, error) {
+			return auth.username, auth.password, nil
+		}))
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithAuthorizer(docker.NewDockerAuthorizer(authOpts...))),
+	})
+
+	start := time.Now()
+	c.log.Info("image pull", "imageName", ref, "status", "pulling with containerd")
+	img, err := c.cli.Pull(ctx, ref, containerd.WithPullUnpack, containerd.WithResolver(resolver))
+	if err != nil {
+		return pullStats{duration: time.Since(start)}, err
+	}
+	s := pullStats{duration: time.Since(start)}
+	if size, err := img.Size(ctx); err == nil {
+		s.bytes, s.bytesTotal = size, size
+	}
+	logPullStats(c.log, "image pull finished", ref, s)
+	return s, nil
+}
+
+// Load imports and unpacks the images of an archive.
+func (c *containerdRuntime) Load(ctx context.Context, archive io.Reader) ([]string, error) {
+	imgs, err := c.cli.Import(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(imgs))
+	for _, i := range imgs {
+		if err := containerd.NewImage(c.cli, i).Unpack(ctx, ""); err != nil {
+			return refs, fmt.Errorf("unpacking %s failed: %w", i.Name, err)
+		}
+		refs = append(refs, i.Name)
+	}
+	return refs, nil
+}
+
+// Inspect returns the status of the container. containerd does not restart containers,
+// so the restart count is always zero.
+func (c *containerdRuntime) Inspect(ctx context.Context, name string) (containerStatus, error) {
+	ctr, err := c.cli.LoadContainer(ctx, name)
+	if err != nil {
+		return containerStatus{}, err
+	}
+	s := containerStatus{id: ctr.ID()}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return s, nil
+		}
+		return containerStatus{}, err
+	}
+	ts, err := task.Status(ctx)
+	if err != nil {
+		return containerStatus{}, err
+	}
+	s.running = ts.Status == containerd.Running
+	s.exitCode = int(ts.ExitStatus)
+	return s, nil
+}
+
+func (c *containerdRuntime) Remove(ctx context.Context, name string) error {
+	ctr, err := c.cli.LoadContainer(ctx, name)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("loading existing %s container failed: %w", name, err)
+	}
+	if task, err := ctr.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !cerrdefs.IsNotFound(err) {
+			return fmt.Errorf("deleting the task of existing %s container failed: %w", name, err)
+		}
+	} else if !cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("loading the task of existing %s container failed: %w", name, err)
+	}
+	if err := ctr.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("removing existing %s container failed: %w", name, err)
+	}
+	return nil
+}
+
+// Create creates the container. containerd identifies containers by name, so the name is also the returned ID.
+func (c *containerdRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	ref, err := normalizeRef(spec.image)
+	if err != nil {
+		return "", err
+	}
+	img, err := c.cli.GetImage(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(img), oci.WithEnv(spec.env)}
+	if spec.privileged {
+		specOpts = append(specOpts, oci.WithPrivileged, oci.WithAllDevicesAllowed, oci.WithHostDevices)
+	}
+	if spec.hostNetwork {
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostHostsFile, oci.WithHostResolvconf)
+	}
+	if len(spec.capabilities) > 0 {
+		specOpts = append(specOpts, oci.WithAddedCapabilities(spec.capabilities))
+	}
+	for _, d := range spec.devices {
+		specOpts = append(specOpts, oci.WithDevices(d.hostPath, d.containerPath, "rwm"))
+	}
+	if spec.memoryLimit > 0 {
+		specOpts = append(specOpts, oci.WithMemoryLimit(uint64(spec.memoryLimit)))
+	}
+	if spec.nanoCPUs > 0 {
+		const period = 100000
+		specOpts = append(specOpts, oci.WithCPUCFS(spec.nanoCPUs*period/1e9, period))
+	}
+	if spec.restartPolicy != "" && spec.restartPolicy != "no" {
+		// containerd has no restart manager, crashes are reported by watchTinkWorker instead.
+		c.log.Info("restart policies are not supported by containerd, ignoring it", "restartPolicy", spec.restartPolicy)
+	}
+	var mounts []specs.Mount
+	for _, m := range spec.mounts {
+		options := []string{"rbind", "rw"}
+		if m.readOnly {
+			options = []string{"rbind", "ro"}
+		}
+		mounts = append(mounts, specs.Mount{Type: "bind", Source: m.source, Destination: m.target, Options: options})
+	}
+	specOpts = append(specOpts, oci.WithMounts(mounts))
+
+	ctr, err := c.cli.NewContainer(ctx, spec.name,
+		containerd.WithImage(img),
+		containerd.WithContainerLabels(spec.labels),
+		containerd.WithNewSnapshot(spec.name+"-snapshot", img),
+		containerd.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		return "", err
+	}
+	return ctr.ID(), nil
+}
+
+// Start creates and starts the task of the container, logging its output to containerdLogFile.
+func (c *containerdRuntime) Start(ctx context.Context, id string) error {
+	ctr, err := c.cli.LoadContainer(ctx, id)
+	if err != nil {
+		return err
+	}
+	task, err := ctr.NewTask(ctx, cio.LogFile(containerdLogFile))
+	if err != nil {
+		return err
+	}
+	return task.Start(ctx)
+}
+
+func (c *containerdRuntime) Wait(ctx context.Context, id string) (int, error) {
+	ctr, err := c.cli.LoadContainer(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	exitC, err := task.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case s := <-exitC:
+		code, _, err := s.Result()
+		return int(code), err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// DefaultMounts returns the tink-worker mounts. containerd runs on the host, so the sources are host paths.
+func (c *containerdRuntime) DefaultMounts() []bindMount {
+	return []bindMount{
+		{source: "/var/run/worker", target: "/worker"},
+		{source: c.address, target: defaultContainerdAddress},
+		{source: containerdHostDockerSocket, target: "/var/run/docker.sock"},
+		{source: "/dev", target: "/dev"},
+		{source: "/run", target: "/run"},
+	}
+}
+
+func (c *containerdRuntime) Close() error {
+	return c.cli.Close()
+}
+
+// normalizeRef returns the fully qualified form of ref, for example docker.io/library/alpine:latest for alpine.
+// Unlike the Docker daemon, containerd does not normalize image references itself.
+func normalizeRef(ref string) (string, error) {
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return "", err
+	}
+	return named.String(), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	tasktypes "github.com/containerd/containerd/api/types/task"
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeContainerd is a fake containerd API with the containers and tasks it was created with, and
+// no images.
+type fakeContainerd struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	tasks      map[string]*tasktypes.Process
+	// deleted are the deleted tasks and containers, in order.
+	deleted []string
+}
+
+// fakeVersion, fakeImages, fakeContainers and fakeTasks are the services of fakeContainerd.
+type (
+	fakeVersion struct {
+		versionapi.UnimplementedVersionServer
+	}
+	fakeImages struct {
+		imagesapi.UnimplementedImagesServer
+	}
+	fakeContainers struct {
+		containersapi.UnimplementedContainersServer
+		*fakeContainerd
+	}
+	fakeTasks struct {
+		tasksapi.UnimplementedTasksServer
+		*fakeContainerd
+	}
+)
+
+func (fakeVersion) Version(context.Context, *emptypb.Empty) (*versionapi.VersionResponse, error) {
+	return &versionapi.VersionResponse{Version: "v2.1.4"}, nil
+}
+
+func (fakeImages) Get(_ context.Context, r *imagesapi.GetImageRequest) (*imagesapi.GetImageResponse, error) {
+	return nil, grpcstatus.Errorf(codes.NotFound, "image %q: not found", r.Name)
+}
+
+func (f fakeContainers) Get(_ context.Context, r *containersapi.GetContainerRequest) (*containersapi.GetContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.containers[r.ID] {
+		return nil, grpcstatus.Errorf(codes.NotFound, "container %q in namespace %q: not found", r.ID, containerdNamespace)
+	}
+	return &containersapi.GetContainerResponse{Container: &containersapi.Container{ID: r.ID}}, nil
+}
+
+func (f fakeContainers) Delete(_ context.Context, r *containersapi.DeleteContainerRequest) (*emptypb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.containers, r.ID)
+	f.deleted = append(f.deleted, "container "+r.ID)
+	return &emptypb.Empty{}, nil
+}
+
+func (f fakeTasks) Get(_ context.Context, r *tasksapi.GetRequest) (*tasksapi.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.tasks[r.ContainerID]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "task %s: not found", r.ContainerID)
+	}
+	return &tasksapi.GetResponse{Process: p}, nil
+}
+
+func (f fakeTasks) Delete(_ context.Context, r *tasksapi.DeleteTaskRequest) (*tasksapi.DeleteResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.tasks[r.ContainerID]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "task %s: not found", r.ContainerID)
+	}
+	delete(f.tasks, r.ContainerID)
+	f.deleted = append(f.deleted, "task "+r.ContainerID)
+	return &tasksapi.DeleteResponse{ID: r.ContainerID, ExitStatus: p.ExitStatus}, nil
+}
+
+// fakeContainerdRuntime returns a containerdRuntime for a fake containerd API with the containers
+// and tasks of f.
+func fakeContainerdRuntime(t *testing.T, f *fakeContainerd) *containerdRuntime {
+	t.Helper()
+	// The path of a unix socket is limited to about 100 bytes, which a t.TempDir can exceed.
+	dir, err := os.MkdirTemp("", "containerd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	address := filepath.Join(dir, "containerd.sock")
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	versionapi.RegisterVersionServer(srv, fakeVersion{})
+	imagesapi.RegisterImagesServer(srv, fakeImages{})
+	containersapi.RegisterContainersServer(srv, fakeContainers{fakeContainerd: f})
+	tasksapi.RegisterTasksServer(srv, fakeTasks{fakeContainerd: f})
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	cli, err := containerd.New(address, containerd.WithDefaultNamespace(containerdNamespace), containerd.WithDefaultRuntime("io.containerd.runc.v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return &containerdRuntime{cli: cli, log: logr.Discard(), address: address}
+}
+
+func TestContainerdRuntimePing(t *testing.T) {
+	rt := fakeContainerdRuntime(t, &fakeContainerd{})
+	if err := rt.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerdRuntimeImageID(t *testing.T) {
+	rt := fakeContainerdRuntime(t, &fakeContainerd{})
+	id, err := rt.ImageID(context.Background(), "quay.io/tinkerbell/tink-worker:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		t.Errorf("got ID %q for a missing image, want none", id)
+	}
+}
+
+func TestContainerdRuntimeRemove(t *testing.T) {
+	tests := map[string]struct {
+		containers  map[string]bool
+		tasks       map[string]*tasktypes.Process
+		wantDeleted []string
+	}{
+		"no container":           {},
+		"container without task": {containers: map[string]bool{tinkWorkerContainerName: true}, wantDeleted: []string{"container tink-worker"}},
+		"container with a stopped task": {
+			containers:  map[string]bool{tinkWorkerContainerName: true},
+			tasks:       map[string]*tasktypes.Process{tinkWorkerContainerName: {ID: tinkWorkerContainerName, Status: tasktypes.Status_STOPPED, ExitStatus: 1}},
+			wantDeleted: []string{"task tink-worker", "container tink-worker"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := &fakeContainerd{containers: tt.containers, tasks: tt.tasks}
+			if f.containers == nil {
+				f.containers = map[string]bool{}
+			}
+			if f.tasks == nil {
+				f.tasks = map[string]*tasktypes.Process{}
+			}
+			rt := fakeContainerdRuntime(t, f)
+			if err := rt.Remove(context.Background(), tinkWorkerContainerName); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantDeleted, f.deleted); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestContainerdRuntimeInspect(t *testing.T) {
+	tests := map[string]struct {
+		task *tasktypes.Process
+		want containerStatus
+	}{
+		"running": {task: &tasktypes.Process{ID: tinkWorkerContainerName, Pid: 42, Status: tasktypes.Status_RUNNING}, want: containerStatus{id: tinkWorkerContainerName, running: true}},
+		"exited":  {task: &tasktypes.Process{ID: tinkWorkerContainerName, Status: tasktypes.Status_STOPPED, ExitStatus: 2}, want: containerStatus{id: tinkWorkerContainerName, exitCode: 2}},
+		"no task": {want: containerStatus{id: tinkWorkerContainerName}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := &fakeContainerd{containers: map[string]bool{tinkWorkerContainerName: true}, tasks: map[string]*tasktypes.Process{}}
+			if tt.task != nil {
+				f.tasks[tinkWorkerContainerName] = tt.task
+			}
+			rt := fakeContainerdRuntime(t, f)
+			got, err := rt.Inspect(context.Background(), tinkWorkerContainerName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(containerStatus{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNewContainerdRuntime(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "docker.sock")
+	tests := map[string]struct {
+		dockerSocket bool
+		wantKind     errorKind
+	}{
+		"with the Docker API of hook-docker": {dockerSocket: true},
+		"without hook-docker":                {wantKind: kindConfig},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			old := containerdDockerSocket
+			containerdDockerSocket = socket
+			t.Cleanup(func() { containerdDockerSocket = old })
+			os.Remove(socket)
+			if tt.dockerSocket {
+				if err := os.WriteFile(socket, nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rt, err := newContainerdRuntime(logr.Discard(), filepath.Join(dir, "containerd.sock"))
+			if tt.wantKind != "" {
+				var be *bootstrapError
+				if !errors.As(err, &be) || be.kind != tt.wantKind {
+					t.Fatalf("got err %v, want a %s error", err, tt.wantKind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rt.Close()
+			var mount *bindMount
+			for _, m := range rt.DefaultMounts() {
+				if m.target == "/var/run/docker.sock" {
+					mount = &m
+				}
+			}
+			if mount == nil {
+				t.Fatalf("the Docker API socket is not mounted into tink-worker: %v", rt.DefaultMounts())
+			}
+			// The source is resolved by containerd on the host, not in the BootKit container.
+			if mount.source != containerdHostDockerSocket {
+				t.Errorf("got the source %q of the Docker API socket, want the host path %q", mount.source, containerdHostDockerSocket)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/go-logr/logr"
+)
+
+// dockerRuntime runs containers through the Docker Engine API of hook-docker.
+type dockerRuntime struct {
+	cli *client.Client
+	log logr.Logger
+}
+
+func newDockerRuntime(log logr.Logger) (*dockerRuntime, error) {
+	// Create Docker client with API (socket)
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{cli: cli, log: log}, nil
+}
+
+func (d *dockerRuntime) Name() string {
+	return "docker"
+}
+
+func (d *dockerRuntime) Ping(ctx context.Context) error {
+	_, err := d.cli.Ping(ctx)
+	return err
+}
+
+func (d *dockerRuntime) ImageID(ctx context.Context, ref string) (string, error) {
+	inspect, _, err := d.cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
+func (d *dockerRuntime) Pull(ctx context.Context, ref string, auth *registryAuth) (pullStats, error) {
+	opts := image.PullOptions{}
+	if auth != nil {
+		encoded, err := encodeRegistryAuth(auth)
+		if err != nil {
+			return pullStats{}, err
+		}
+		opts.RegistryAuth = encoded
+	}
+	return pullImage(ctx, d.log, d.cli, ref, opts)
+}
+
+// Load loads the images of an archive with docker load. The references are parsed from the
+// "Loaded image" messages, which are the only report of the loaded images.
+func (d *dockerRuntime) Load(ctx context.Context, archive io.Reader) ([]string, error) {
+	resp, err := d.cli.ImageLoad(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var refs []string
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return refs, nil
+			}
+			return refs, fmt.Errorf("reading image load stream failed: %w", err)
+		}
+		if msg.Error != nil {
+			return refs, msg.Error
+		}
+		if ref, ok := strings.CutPrefix(strings.TrimSpace(msg.Stream), "Loaded image: "); ok {
+			refs = append(refs, ref)
+		} else if id, ok := strings.CutPrefix(strings.TrimSpace(msg.Stream), "Loaded image ID: "); ok {
+			refs = append(refs, id)
+		}
+	}
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, name string) (containerStatus, error) {
+	inspect, err := d.cli.ContainerInspect(ctx, name)
+	if err != nil {
+		return containerStatus{}, err
+	}
+	s := containerStatus{id: inspect.ID, restartCount: inspect.RestartCount}
+	if inspect.State != nil {
+		s.running = inspect.State.Running
+		s.exitCode = inspect.State.ExitCode
+		s.err = inspect.State.Error
+	}
+	return s, nil
+}
+
+func (d *dockerRuntime) Remove(ctx context.Context, name string) error {
+	cs, err := d.cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("listing containers, in order to find an existing %s container, failed: %w", name, err)
+	}
+	for _, c := range cs {
+		for _, n := range c.Names {
+			if n == "/"+name {
+				if err := d.cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+					return fmt.Errorf("removing existing %s container failed: %w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	cfg := &container.Config{
+		Image:        spec.image,
+		Env:          spec.env,
+		Labels:       spec.labels,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	hostCfg := &container.HostConfig{
+		Privileged: spec.privileged,
+		CapAdd:     spec.capabilities,
+		Resources: container.Resources{
+			Memory:   spec.memoryLimit,
+			NanoCPUs: spec.nanoCPUs,
+		},
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyMode(spec.restartPolicy)},
+	}
+	for _, d := range spec.devices {
+		hostCfg.Devices = append(hostCfg.Devices, container.DeviceMapping{
+			PathOnHost:        d.hostPath,
+			PathInContainer:   d.containerPath,
+			CgroupPermissions: "rwm",
+		})
+	}
+	if spec.hostNetwork {
+		hostCfg.NetworkMode = "host"
+	}
+	for _, m := range spec.mounts {
+		hostCfg.Mounts = append(hostCfg.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.source,
+			Target:   m.target,
+			ReadOnly: m.readOnly,
+		})
+	}
+	resp, err := d.cli.ContainerCreate(ctx, cfg, hostCfg, nil, nil, spec.name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *dockerRuntime) Start(ctx context.Context, id string) error {
+	return d.cli.ContainerStart(ctx, id, container.StartOptions{})
+}
+
+func (d *dockerRuntime) Wait(ctx context.Context, id string) (int, error) {
+	resultC, errC := d.cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case res := <-resultC:
+		if res.Error != nil && res.Error.Message != "" {
+			return int(res.StatusCode), fmt.Errorf("waiting for container %s failed: %s", id, res.Error.Message)
+		}
+		return int(res.StatusCode), nil
+	case err := <-errC:
+		return 0, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// DefaultMounts returns the tink-worker mounts. The sources are paths in the hook-docker container, where dockerd runs.
+func (d *dockerRuntime) DefaultMounts() []bindMount {
+	return []bindMount{
+		{source: "/worker", target: "/worker"},
+		{source: "/var/run/docker.sock", target: "/var/run/docker.sock"},
+		{source: "/dev", target: "/dev"},
+		{source: "/host_root/run", target: "/run"},
+	}
+}
+
+func (d *dockerRuntime) Close() error {
+	return d.cli.Close()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeDockerRuntime returns a dockerRuntime for a fake Docker API served by handler.
+func fakeDockerRuntime(t *testing.T, handler http.HandlerFunc) *dockerRuntime {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost(srv.URL), client.WithVersion("1.47"), client.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dockerRuntime{cli: cli, log: logr.Discard()}
+}
+
+func TestDockerRuntimeRemove(t *testing.T) {
+	tests := map[string]struct {
+		containers  string
+		wantRemoved []string
+	}{
+		"existing container": {
+			containers:  `[{"Id":"abc","Names":["/tink-worker"]},{"Id":"def","Names":["/other"]}]`,
+			wantRemoved: []string{"abc"},
+		},
+		"no container": {
+			containers: `[{"Id":"def","Names":["/other"]}]`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var removed []string
+			rt := fakeDockerRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/json"):
+					_, _ = w.Write([]byte(tt.containers))
+				case r.Method == http.MethodDelete:
+					removed = append(removed, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			})
+			if err := rt.Remove(context.Background(), tinkWorkerContainerName); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantRemoved, removed); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDockerRuntimeCreate(t *testing.T) {
+	var got struct {
+		container.Config
+		HostConfig container.HostConfig
+	}
+	var gotName string
+	rt := fakeDockerRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/create") {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		gotName = r.URL.Query().Get("name")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"Id":"abc"}`))
+	})
+
+	id, err := rt.Create(context.Background(), containerSpec{
+		name:          tinkWorkerContainerName,
+		image:         "quay.io/tinkerbell/tink-worker:latest",
+		env:           []string{"WORKER_ID=m1"},
+		labels:        map[string]string{"team": "provisioning"},
+		mounts:        rt.DefaultMounts(),
+		devices:       []deviceMapping{{hostPath: "/dev/kvm", containerPath: "/dev/kvm"}},
+		hostNetwork:   true,
+		privileged:    true,
+		capabilities:  []string{"CAP_SYS_ADMIN"},
+		memoryLimit:   1 << 30,
+		restartPolicy: "always",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "abc" {
+		t.Errorf("got ID %q, want abc", id)
+	}
+	if gotName != tinkWorkerContainerName {
+		t.Errorf("got name %q, want %q", gotName, tinkWorkerContainerName)
+	}
+	if got.Image != "quay.io/tinkerbell/tink-worker:latest" || !cmp.Equal(got.Env, []string{"WORKER_ID=m1"}) {
+		t.Errorf("unexpected config: image %q, env %v", got.Image, got.Env)
+	}
+	if !got.HostConfig.Privileged || got.HostConfig.NetworkMode != "host" {
+		t.Errorf("want a privileged container on the host network, got privileged %v, network %q", got.HostConfig.Privileged, got.HostConfig.NetworkMode)
+	}
+	if got.Labels["team"] != "provisioning" || !cmp.Equal([]string(got.HostConfig.CapAdd), []string{"CAP_SYS_ADMIN"}) ||
+		got.HostConfig.Memory != 1<<30 || got.HostConfig.RestartPolicy.Name != "always" || len(got.HostConfig.Devices) != 1 {
+		t.Errorf("unexpected labels, capabilities, limits, restart policy or devices: %+v, %+v", got.Labels, got.HostConfig)
+	}
+	var targets []string
+	for _, m := range got.HostConfig.Mounts {
+		targets = append(targets, m.Source+":"+m.Target)
+	}
+	want := []string{"/worker:/worker", "/var/run/docker.sock:/var/run/docker.sock", "/dev:/dev", "/host_root/run:/run"}
+	if diff := cmp.Diff(want, targets); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDockerRuntimeInspect(t *testing.T) {
+	rt := fakeDockerRuntime(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"Id":"abc","RestartCount":2,"State":{"Running":false,"ExitCode":137,"Error":"killed"}}`))
+	})
+	got, err := rt.Inspect(context.Background(), tinkWorkerContainerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := containerStatus{id: "abc", exitCode: 137, err: "killed", restartCount: 2}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(containerStatus{})); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCheckContainerRunning(t *testing.T) {
+	tests := map[string]struct {
+		exitsAfter time.Duration
+		running    bool
+		wantKind   errorKind
+	}{
+		"keeps running":            {exitsAfter: time.Minute, running: true},
+		"exits during grace":       {exitsAfter: 0, wantKind: kindContainerCrash},
+		"stopped after grace ends": {exitsAfter: time.Minute, running: false, wantKind: kindContainerCrash},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := fakeDockerRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/wait") {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(tt.exitsAfter):
+					}
+					_, _ = w.Write([]byte(`{"StatusCode":1}`))
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]any{"Id": "abc", "State": map[string]any{"Running": tt.running}})
+			})
+			err := checkContainerRunning(context.Background(), rt, "abc", 100*time.Millisecond)
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if got := kindOf(err); got != tt.wantKind {
+				t.Fatalf("got kind %q, want %q (error: %v)", got, tt.wantKind, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// defaultPodmanAddress is the socket of the Podman system service.
+	defaultPodmanAddress = "/run/podman/podman.sock"
+	// podmanAPIPrefix is the versioned path of the libpod REST API.
+	podmanAPIPrefix = "/v4.0.0/libpod"
+)
+
+// podmanRuntime runs containers through the libpod REST API of a Podman system service.
+type podmanRuntime struct {
+	client  *http.Client
+	baseURL string
+	address string
+	log     logr.Logger
+}
+
+func newPodmanRuntime(log logr.Logger, address string) *podmanRuntime {
+	if address == "" {
+		address = defaultPodmanAddress
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", address)
+		},
+	}
+	return &podmanRuntime{
+		client:  &http.Client{Transport: transport},
+		baseURL: "http://podman" + podmanAPIPrefix,
+		address: address,
+		log:     log,
+	}
+}
+
+// podmanError is an error response of the libpod API.
+type podmanError struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+func (p *podmanError) Error() string {
+	return p.Message
+}
+
+// Unwrap maps the HTTP status of the response to an errdefs error, so that classify can tell the kind of the failure.
+func (p *podmanError) Unwrap() error {
+	switch p.Response {
+	case http.StatusNotFound:
+		return cerrdefs.ErrNotFound
+	case http.StatusUnauthorized:
+		return cerrdefs.ErrUnauthenticated
+	case http.StatusForbidden:
+		return cerrdefs.ErrPermissionDenied
+	case http.StatusBadRequest:
+		return cerrdefs.ErrInvalidArgument
+	case http.StatusConflict:
+		return cerrdefs.ErrConflict
+	case http.StatusServiceUnavailable:
+		return cerrdefs.ErrUnavailable
+	}
+	return nil
+}
+
+// do sends a request to the libpod API and returns the response when its status is one of want.
+// Any other status is returned as a *podmanError.
+func (p *podmanRuntime) do(ctx context.Context, method, path string, query url.Values, header http.Header, body any, want ...int) (*http.Response, error) {
+	// A reader is sent as is, other bodies as JSON.
+	r, raw := body.(io.Reader)
+	if body != nil && !raw {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := p.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && !raw {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range want {
+		if resp.StatusCode == w {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	perr := &podmanError{Response: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(perr); err != nil || perr.Message == "" {
+		perr.Message = fmt.Sprintf("unexpected status %d from %s %s", resp.StatusCode, method, path)
+	}
+	perr.Response = resp.StatusCode
+	return nil, perr
+}
+
+func (p *podmanRuntime) Name() string {
+	return "podman"
+}
+
+func (p *podmanRuntime) Ping(ctx context.Context) error {
+	resp, err := p.do(ctx, http.MethodGet, "/_ping", nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ImageID returns the ID of ref, which libpod reports without the sha256: prefix of Docker.
+func (p *podmanRuntime) ImageID(ctx context.Context, ref string) (string, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/images/"+url.PathEscape(ref)+"/json", nil, nil, nil, http.StatusOK)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	var inspect struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return "", fmt.Errorf("decoding the image inspect response failed: %w", err)
+	}
+	if inspect.ID != "" && !strings.Contains(inspect.ID, ":") {
+		return "sha256:" + inspect.ID, nil
+	}
+	return inspect.ID, nil
+}
+
+// Load loads the images of an archive.
+func (p *podmanRuntime) Load(ctx context.Context, archive io.Reader) ([]string, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/images/load", nil, http.Header{"Content-Type": {"application/x-tar"}}, archive, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var report struct {
+		Names []string `json:"Names"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("decoding the image load response failed: %w", err)
+	}
+	return report.Names, nil
+}
+
+// podmanPullReport is a single message of the libpod image pull stream.
+type podmanPullReport struct {
+	Stream string   `json:"stream"`
+	Error  string   `json:"error"`
+	Images []string `json:"images"`
+	ID     string   `json:"id"`
+}
+
+// Pull pulls ref. libpod does not report download progress, so only the duration of the returned stats is set.
+func (p *podmanRuntime) Pull(ctx context.Context, ref string, auth *registryAuth) (pullStats, error) {
+	header := http.Header{}
+	if auth != nil {
+		encoded, err := encodeRegistryAuth(auth)
+		if err != nil {
+			return pullStats{}, err
+		}
+		header.Set("X-Registry-Auth", encoded)
+	}
+	start := time.Now()
+	resp, err := p.do(ctx, http.MethodPost, "/images/pull", url.Values{"reference": {ref}, "policy": {"always"}}, header, nil, http.StatusOK)
+	if err != nil {
+		return pullStats{}, err
+	}
+	defer resp.Body.Close()
+
+	// Like with Docker, the pull request succeeds before the pull does, so the stream is checked for errors.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg podmanPullReport
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return pullStats{duration: time.Since(start)}, fmt.Errorf("reading image pull stream failed: %w", err)
+		}
+		if msg.Error != "" {
+			return pullStats{duration: time.Since(start)}, fmt.Errorf("image pull reported an error: %s", msg.Error)
+		}
+		if s := strings.TrimSpace(msg.Stream); s != "" {
+			p.log.Info("image pull", "imageName", ref, "status", s)
+		}
+	}
+	s := pullStats{duration: time.Since(start)}
+	logPullStats(p.log, "image pull finished", ref, s)
+	return s, nil
+}
+
+// podmanInspect is the part of the libpod container inspect response bootkit uses.
+type podmanInspect struct {
+	ID           string `json:"Id"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Running  bool   `json:"Running"`
+		ExitCode int    `json:"ExitCode"`
+		Error    string `json:"Error"`
+	} `json:"State"`
+}
+
+func (p *podmanRuntime) Inspect(ctx context.Context, name string) (containerStatus, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return containerStatus{}, err
+	}
+	defer resp.Body.Close()
+	var inspect podmanInspect
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return containerStatus{}, fmt.Errorf("decoding container inspect response failed: %w", err)
+	}
+	return containerStatus{
+		id:           inspect.ID,
+		running:      inspect.State.Running,
+		exitCode:     inspect.State.ExitCode,
+		err:          inspect.State.Error,
+		restartCount: inspect.RestartCount,
+	}, nil
+}
+
+func (p *podmanRuntime) Remove(ctx context.Context, name string) error {
+	resp, err := p.do(ctx, http.MethodDelete, "/containers/"+url.PathEscape(name), url.Values{"force": {"true"}}, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("removing existing %s container failed: %w", name, err)
+	}
+	return resp.Body.Close()
+}
+
+// podmanMount is a mount of the libpod container create request.
+type podmanMount struct {
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// podmanNamespace is a namespace of the libpod container create request.
+type podmanNamespace struct {
+	NSMode string `json:"nsmode"`
+}
+
+// podmanDevice is a device of the libpod container create request.
+type podmanDevice struct {
+	Path string `json:"path"`
+}
+
+// podmanResources are the resource limits of the libpod container create request.
+type podmanResources struct {
+	Memory *podmanMemory `json:"memory,omitempty"`
+	CPU    *podmanCPU    `json:"cpu,omitempty"`
+}
+
+type podmanMemory struct {
+	Limit int64 `json:"limit"`
+}
+
+type podmanCPU struct {
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+}
+
+// podmanSpec is the part of the libpod SpecGenerator bootkit uses to create containers.
+type podmanSpec struct {
+	Name           string            `json:"name"`
+	Image          string            `json:"image"`
+	Env            map[string]string `json:"env,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Mounts         []podmanMount     `json:"mounts,omitempty"`
+	Devices        []podmanDevice    `json:"devices,omitempty"`
+	NetNS          *podmanNamespace  `json:"netns,omitempty"`
+	Privileged     bool              `json:"privileged,omitempty"`
+	CapAdd         []string          `json:"cap_add,omitempty"`
+	ResourceLimits *podmanResources  `json:"resource_limits,omitempty"`
+	RestartPolicy  string            `json:"restart_policy,omitempty"`
+}
+
+func (p *podmanRuntime) Create(ctx context.Context, spec containerSpec) (string, error) {
+	ps := podmanSpec{
+		Name:          spec.name,
+		Image:         spec.image,
+		Env:           map[string]string{},
+		Labels:        spec.labels,
+		Privileged:    spec.privileged,
+		CapAdd:        spec.capabilities,
+		RestartPolicy: spec.restartPolicy,
+	}
+	for _, d := range spec.devices {
+		// libpod takes devices as host:container in a single path.
+		ps.Devices = append(ps.Devices, podmanDevice{Path: d.hostPath + ":" + d.containerPath})
+	}
+	if spec.memoryLimit > 0 || spec.nanoCPUs > 0 {
+		ps.ResourceLimits = &podmanResources{}
+		if spec.memoryLimit > 0 {
+			ps.ResourceLimits.Memory = &podmanMemory{Limit: spec.memoryLimit}
+		}
+		if spec.nanoCPUs > 0 {
+			const period = 100000
+			ps.ResourceLimits.CPU = &podmanCPU{Quota: spec.nanoCPUs * period / 1e9, Period: period}
+		}
+	}
+	for _, e := range spec.env {
+		k, v, _ := strings.Cut(e, "=")
+		ps.Env[k] = v
+	}
+	if spec.hostNetwork {
+		ps.NetNS = &podmanNamespace{NSMode: "host"}
+	}
+	for _, m := range spec.mounts {
+		options := []string{"rbind"}
+		if m.readOnly {
+			options = append(options, "ro")
+		}
+		ps.Mounts = append(ps.Mounts, podmanMount{Type: "bind", Source: m.source, Destination: m.target, Options: options})
+	}
+
+	resp, err := p.do(ctx, http.MethodPost, "/containers/create", nil, nil, ps, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("decoding container create response failed: %w", err)
+	}
+	return created.ID, nil
+}
+
+func (p *podmanRuntime) Start(ctx context.Context, id string) error {
+	resp, err := p.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil, nil, nil, http.StatusNoContent, http.StatusNotModified)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p *podmanRuntime) Wait(ctx context.Context, id string) (int, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/wait", url.Values{"condition": {"stopped"}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("decoding container wait response %q failed: %w", b, err)
+	}
+	return code, nil
+}
+
+// DefaultMounts returns the tink-worker mounts. Podman runs on the host, so the sources are host paths.
+// Podman serves a Docker compatible API on its socket, so it is mounted where tink-worker expects the Docker socket.
+func (p *podmanRuntime) DefaultMounts() []bindMount {
+	return []bindMount{
+		{source: "/var/run/worker", target: "/worker"},
+		{source: p.address, target: "/var/run/docker.sock"},
+		{source: "/dev", target: "/dev"},
+		{source: "/run", target: "/run"},
+	}
+}
+
+func (p *podmanRuntime) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
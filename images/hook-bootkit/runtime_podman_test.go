@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakePodmanRuntime returns a podmanRuntime for a fake libpod API served by handler.
+func fakePodmanRuntime(t *testing.T, handler http.HandlerFunc) *podmanRuntime {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &podmanRuntime{client: srv.Client(), baseURL: srv.URL + podmanAPIPrefix, address: defaultPodmanAddress, log: logr.Discard()}
+}
+
+func TestPodmanRuntimeRemove(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		wantErr bool
+	}{
+		"existing container": {status: http.StatusOK, body: `[{"Id":"abc"}]`},
+		"no container":       {status: http.StatusNotFound, body: `{"cause":"no such container","message":"no container with name or ID \"tink-worker\" found: no such container","response":404}`},
+		"daemon error":       {status: http.StatusInternalServerError, body: `{"cause":"oops","message":"oops","response":500}`, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete || r.URL.Path != podmanAPIPrefix+"/containers/tink-worker" || r.URL.Query().Get("force") != "true" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			if err := rt.Remove(context.Background(), tinkWorkerContainerName); (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPodmanRuntimeCreate(t *testing.T) {
+	var got podmanSpec
+	rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != podmanAPIPrefix+"/containers/create" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"Id":"abc","Warnings":[]}`))
+	})
+
+	id, err := rt.Create(context.Background(), containerSpec{
+		name:        tinkWorkerContainerName,
+		image:       "quay.io/tinkerbell/tink-worker:latest",
+		env:         []string{"WORKER_ID=m1", "TINKERBELL_TLS="},
+		mounts:      rt.DefaultMounts(),
+		hostNetwork: true,
+		privileged:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "abc" {
+		t.Errorf("got ID %q, want abc", id)
+	}
+	want := podmanSpec{
+		Name:  tinkWorkerContainerName,
+		Image: "quay.io/tinkerbell/tink-worker:latest",
+		Env:   map[string]string{"WORKER_ID": "m1", "TINKERBELL_TLS": ""},
+		Mounts: []podmanMount{
+			{Type: "bind", Source: "/var/run/worker", Destination: "/worker", Options: []string{"rbind"}},
+			{Type: "bind", Source: defaultPodmanAddress, Destination: "/var/run/docker.sock", Options: []string{"rbind"}},
+			{Type: "bind", Source: "/dev", Destination: "/dev", Options: []string{"rbind"}},
+			{Type: "bind", Source: "/run", Destination: "/run", Options: []string{"rbind"}},
+		},
+		NetNS:      &podmanNamespace{NSMode: "host"},
+		Privileged: true,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestPodmanRuntimeInspect(t *testing.T) {
+	rt := fakePodmanRuntime(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"Id":"abc","RestartCount":2,"State":{"Running":false,"ExitCode":137,"Error":"killed"}}`))
+	})
+	got, err := rt.Inspect(context.Background(), tinkWorkerContainerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := containerStatus{id: "abc", exitCode: 137, err: "killed", restartCount: 2}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(containerStatus{})); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestPodmanRuntimePull(t *testing.T) {
+	tests := map[string]struct {
+		status   int
+		body     string
+		wantKind errorKind
+	}{
+		"success": {
+			status: http.StatusOK, body: `{"stream":"Trying to pull quay.io/tinkerbell/tink-worker:latest...\n"}` + "\n" + `{"images":["abc"],"id":"abc"}`,
+		},
+		"error in stream": {
+			status: http.StatusOK, body: `{"error":"unauthorized: authentication required"}`,
+			wantKind: kindAuth,
+		},
+		"error response": {
+			status: http.StatusNotFound, body: `{"cause":"manifest unknown","message":"manifest unknown","response":404}`,
+			wantKind: kindNotFound,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != podmanAPIPrefix+"/images/pull" || r.URL.Query().Get("reference") != "quay.io/tinkerbell/tink-worker:latest" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+				}
+				if r.Header.Get("X-Registry-Auth") == "" {
+					t.Error("missing X-Registry-Auth header")
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			_, err := rt.Pull(context.Background(), "quay.io/tinkerbell/tink-worker:latest", &registryAuth{username: "u", password: "p"})
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if got := kindOf(err); got != tt.wantKind {
+				t.Fatalf("got kind %q, want %q (error: %v)", got, tt.wantKind, err)
+			}
+		})
+	}
+}
+
+func TestCheckContainerRunningPodman(t *testing.T) {
+	tests := map[string]struct {
+		exitsAfter time.Duration
+		running    bool
+		wantKind   errorKind
+	}{
+		"keeps running":            {exitsAfter: time.Minute, running: true},
+		"exits during grace":       {exitsAfter: 0, wantKind: kindContainerCrash},
+		"stopped after grace ends": {exitsAfter: time.Minute, running: false, wantKind: kindContainerCrash},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt := fakePodmanRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/wait") {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(tt.exitsAfter):
+					}
+					_, _ = w.Write([]byte("1"))
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]any{"Id": "abc", "State": map[string]any{"Running": tt.running}})
+			})
+			err := checkContainerRunning(context.Background(), rt, "abc", 100*time.Millisecond)
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if got := kindOf(err); got != tt.wantKind {
+				t.Fatalf("got kind %q, want %q (error: %v)", got, tt.wantKind, err)
+			}
+		})
+	}
+}
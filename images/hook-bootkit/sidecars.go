@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/distribution/reference"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sidecar is an additional container run alongside tink-worker, such as a telemetry agent or a log shipper.
+// Sidecars are declared with hook_sidecars=, either as base64 encoded JSON or as an http(s) URL to fetch the JSON from:
+//
+//	[
+//	  {"name": "inventory", "image": "ghcr.io/example/inventory:v1", "order": 1},
+//	  {"name": "logs", "image": "ghcr.io/example/shipper:v2", "afterTinkWorker": true,
+//	   "mounts": [{"source": "/var/log", "target": "/host/log", "readOnly": true}]}
+//	]
+//
+// All the tink_worker_spec= fields can be used to customize a sidecar.
+type sidecar struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Order is the start order, lower first. Sidecars with the same order start in the order they are declared.
+	Order int `json:"order,omitempty"`
+	// AfterTinkWorker starts the sidecar once tink-worker is running, instead of before tink-worker.
+	AfterTinkWorker bool `json:"afterTinkWorker,omitempty"`
+
+	specFragment
+}
+
+var sidecarName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// loadSidecars returns the sidecars in value, sorted by start order. An empty value returns no sidecars.
+func loadSidecars(ctx context.Context, value string) ([]sidecar, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var sidecars []sidecar
+	if err := loadJSONValue(ctx, "hook_sidecars", value, &sidecars); err != nil {
+		return nil, err
+	}
+	if err := validateSidecars(sidecars); err != nil {
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("invalid hook_sidecars: %w", err))
+	}
+	sort.SliceStable(sidecars, func(i, j int) bool { return sidecars[i].Order < sidecars[j].Order })
+	return sidecars, nil
+}
+
+func validateSidecars(sidecars []sidecar) error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, s := range sidecars {
+		switch {
+		case !sidecarName.MatchString(s.Name):
+			errs = append(errs, fmt.Errorf("sidecar %q: name must be a valid container name", s.Name))
+		case s.Name == tinkWorkerContainerName:
+			errs = append(errs, fmt.Errorf("sidecar %q: name is reserved", s.Name))
+		case seen[s.Name]:
+			errs = append(errs, fmt.Errorf("sidecar %q: duplicate name", s.Name))
+		}
+		seen[s.Name] = true
+		if _, err := reference.ParseNormalizedNamed(s.Image); err != nil {
+			errs = append(errs, fmt.Errorf("sidecar %q: invalid image %q: %w", s.Name, s.Image, err))
+		}
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("sidecar %q: %w", s.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// spec returns the container spec of the sidecar. Sidecars run unprivileged on the host network
+// with the worker ID and proxy settings in their environment, unless their fragment says otherwise.
+func (s sidecar) spec(cfg tinkWorkerConfig) containerSpec {
+	spec := containerSpec{
+		name:  s.Name,
+		image: s.Image,
+		env: []string{
+			fmt.Sprintf("WORKER_ID=%s", cfg.workerID),
+			fmt.Sprintf("HTTP_PROXY=%s", cfg.httpProxy),
+			fmt.Sprintf("HTTPS_PROXY=%s", cfg.httpsProxy),
+			fmt.Sprintf("NO_PROXY=%s", cfg.noProxy),
+		},
+		hostNetwork: true,
+	}
+	return s.specFragment.merge(spec)
+}
+
+// startSidecars pulls and starts the sidecars in order, using the same registry auth and pull retries as
+// tink-worker. It returns the specs of the started sidecars, or an error for the first one that failed.
+func startSidecars(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, sidecars []sidecar, pullPolicy retryPolicy) ([]containerSpec, error) {
+	var started []containerSpec
+	for _, s := range sidecars {
+		spec, err := startSidecar(ctx, log, rt, cfg, s, pullPolicy)
+		if err != nil {
+			return started, err
+		}
+		started = append(started, spec)
+	}
+	return started, nil
+}
+
+// startSidecarsAfter starts the sidecars that run once tink-worker is running, in order. tink-worker is
+// already running, so a sidecar that fails to start doesn't fail the bootstrap: the failure is logged
+// and reported on /status. It returns the specs of all the sidecars, so that watchTinkWorker keeps
+// starting the failed ones.
+func startSidecarsAfter(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, sidecars []sidecar, pullPolicy retryPolicy) []containerSpec {
+	specs := make([]containerSpec, 0, len(sidecars))
+	for _, s := range sidecars {
+		spec, err := startSidecar(ctx, log, rt, cfg, s, pullPolicy)
+		if err != nil {
+			log.Error(err, "starting sidecar failed, will try again", "sidecar", s.Name, "errorKind", kindOf(err))
+		}
+		status.setSidecar(s.Name, err)
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// startSidecar pulls and starts the sidecar s, and returns its spec.
+func startSidecar(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, s sidecar, pullPolicy retryPolicy) (containerSpec, error) {
+	spec := s.spec(cfg)
+	sctx, span := startSpan(ctx, "start sidecar", attribute.String("sidecar.name", s.Name), attribute.String("image.name", s.Image))
+	log.Info("Pulling sidecar image", "sidecar", s.Name, "imageName", s.Image)
+	if _, _, err := pullWithRetry(sctx, log, rt, s.Image, cfg.registryAuth(s.Image), true, pullPolicy); err != nil {
+		err = classify(fmt.Errorf("pulling the image of sidecar %s failed: %w", s.Name, err))
+		endSpan(span, err)
+		return spec, err
+	}
+	if _, err := launchContainer(sctx, log, rt, spec); err != nil {
+		err = classify(fmt.Errorf("starting sidecar %s failed: %w", s.Name, err))
+		endSpan(span, err)
+		return spec, err
+	}
+	endSpan(span, nil)
+	return spec, nil
+}
+
+// launchContainer replaces any existing container with the same name by a new one created from spec,
+// starts it and checks that it keeps running. Every step is traced, and the failures to create and
+// start the container are counted, the same for tink-worker and the sidecars.
+func launchContainer(ctx context.Context, log logr.Logger, rt containerRuntime, spec containerSpec) (string, error) {
+	log.Info("Removing any existing container", "name", spec.name)
+	rctx, span := startSpan(ctx, "remove container", attribute.String("container.name", spec.name))
+	if err := rt.Remove(rctx, spec.name); err != nil {
+		err = classify(fmt.Errorf("failed to remove existing %s container: %w", spec.name, err))
+		endSpan(span, err)
+		return "", err
+	}
+	endSpan(span, nil)
+
+	log.Info("Creating container", "name", spec.name, "imageName", spec.image)
+	cctx, span := startSpan(ctx, "create container", attribute.String("container.name", spec.name), attribute.String("image.name", spec.image))
+	id, err := rt.Create(cctx, spec)
+	if err != nil {
+		containerCreateFailures.Inc()
+		err = classify(fmt.Errorf("creating %s container failed: %w", spec.name, err))
+		endSpan(span, err)
+		return "", err
+	}
+	span.SetAttributes(attribute.String("container.id", id))
+	endSpan(span, nil)
+
+	log.Info("Starting container", "name", spec.name, "id", id)
+	sctx, span := startSpan(ctx, "start container", attribute.String("container.name", spec.name), attribute.String("container.id", id))
+	if err := rt.Start(sctx, id); err != nil {
+		containerStartFailures.Inc()
+		err = classify(fmt.Errorf("starting %s container failed: %w", spec.name, err))
+		endSpan(span, err)
+		return "", err
+	}
+	endSpan(span, nil)
+
+	kctx, span := startSpan(ctx, "check container", attribute.String("container.name", spec.name), attribute.String("container.id", id))
+	if err := checkContainerRunning(kctx, rt, id, containerGracePeriod); err != nil {
+		err = classify(fmt.Errorf("checking if %s container is running failed: %w", spec.name, err))
+		endSpan(span, err)
+		return "", err
+	}
+	endSpan(span, nil)
+	return id, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadSidecars(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := map[string]struct {
+		value     string
+		wantNames []string
+		wantErr   bool
+	}{
+		"empty": {},
+		"sorted by order": {
+			value:     b64(`[{"name":"logs","image":"ghcr.io/example/shipper:v2","order":2},{"name":"inventory","image":"ghcr.io/example/inventory:v1","order":1},{"name":"bmc","image":"ghcr.io/example/bmc:v1","order":1}]`),
+			wantNames: []string{"inventory", "bmc", "logs"},
+		},
+		"with spec fields": {
+			value:     b64(`[{"name":"logs","image":"ghcr.io/example/shipper:v2","afterTinkWorker":true,"mounts":[{"source":"/var/log","target":"/host/log","readOnly":true}]}]`),
+			wantNames: []string{"logs"},
+		},
+		"reserved name":  {value: b64(`[{"name":"tink-worker","image":"ghcr.io/example/agent:v1"}]`), wantErr: true},
+		"duplicate name": {value: b64(`[{"name":"a","image":"ghcr.io/example/a:v1"},{"name":"a","image":"ghcr.io/example/a:v2"}]`), wantErr: true},
+		"invalid name":   {value: b64(`[{"name":"-a","image":"ghcr.io/example/a:v1"}]`), wantErr: true},
+		"invalid image":  {value: b64(`[{"name":"a","image":"Example/A"}]`), wantErr: true},
+		"invalid spec":   {value: b64(`[{"name":"a","image":"ghcr.io/example/a:v1","env":["NOPE"]}]`), wantErr: true},
+		"unknown field":  {value: b64(`[{"name":"a","image":"ghcr.io/example/a:v1","command":["sh"]}]`), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadSidecars(context.Background(), tt.value)
+			if tt.wantErr {
+				if kindOf(err) != kindConfig {
+					t.Fatalf("want a configuration error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, s := range got {
+				names = append(names, s.Name)
+			}
+			if diff := cmp.Diff(tt.wantNames, names); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestSidecarSpec(t *testing.T) {
+	cfg := tinkWorkerConfig{workerID: "m1", httpProxy: "http://proxy:3128"}
+	s := sidecar{
+		Name:         "logs",
+		Image:        "ghcr.io/example/shipper:v2",
+		specFragment: specFragment{Env: []string{"LEVEL=debug"}, Mounts: []specMount{{Source: "/var/log", Target: "/host/log", ReadOnly: true}}},
+	}
+	want := containerSpec{
+		name:        "logs",
+		image:       "ghcr.io/example/shipper:v2",
+		env:         []string{"WORKER_ID=m1", "HTTP_PROXY=http://proxy:3128", "HTTPS_PROXY=", "NO_PROXY=", "LEVEL=debug"},
+		mounts:      []bindMount{{source: "/var/log", target: "/host/log", readOnly: true}},
+		hostNetwork: true,
+	}
+	if diff := cmp.Diff(want, s.spec(cfg), cmp.AllowUnexported(containerSpec{}, bindMount{})); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSuperviseSidecar(t *testing.T) {
+	grace := containerGracePeriod
+	containerGracePeriod = 100 * time.Millisecond
+	t.Cleanup(func() { containerGracePeriod = grace })
+
+	tests := map[string]struct {
+		inspect      string
+		inspectCode  int
+		imageMissing bool
+		wantPull     bool
+		wantCreate   bool
+	}{
+		"running":       {inspect: `{"Id":"abc","State":{"Running":true}}`, inspectCode: http.StatusOK},
+		"stopped":       {inspect: `{"Id":"abc","State":{"Running":false,"ExitCode":2}}`, inspectCode: http.StatusOK, wantCreate: true},
+		"not found":     {inspect: `{"message":"No such container: logs"}`, inspectCode: http.StatusNotFound, wantCreate: true},
+		"never started": {inspect: `{"message":"No such container: logs"}`, inspectCode: http.StatusNotFound, imageMissing: true, wantPull: true, wantCreate: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var pulled, created, started bool
+			inspected := 0
+			rt := fakeDockerRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/json") && strings.Contains(r.URL.Path, "/containers/logs"):
+					w.WriteHeader(tt.inspectCode)
+					_, _ = w.Write([]byte(tt.inspect))
+					inspected++
+				case strings.Contains(r.URL.Path, "/images/ghcr.io/example/shipper:v2/json"):
+					if tt.imageMissing && !pulled {
+						w.WriteHeader(http.StatusNotFound)
+						_, _ = w.Write([]byte(`{"message":"No such image: ghcr.io/example/shipper:v2"}`))
+						return
+					}
+					_, _ = w.Write([]byte(`{"Id":"sha256:1234"}`))
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					pulled = true
+					_, _ = w.Write([]byte(`{"status":"Status: Downloaded newer image for ghcr.io/example/shipper:v2"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					_, _ = w.Write([]byte(`[]`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					created = true
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{"Id":"def"}`))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					started = true
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/wait"):
+					<-r.Context().Done()
+				case strings.HasSuffix(r.URL.Path, "/containers/def/json"):
+					_, _ = w.Write([]byte(`{"Id":"def","State":{"Running":true}}`))
+				default:
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			})
+
+			superviseSidecar(context.Background(), logr.Discard(), rt, tinkWorkerConfig{}, nil, containerSpec{name: "logs", image: "ghcr.io/example/shipper:v2"})
+			if pulled != tt.wantPull {
+				t.Errorf("got pulled %v, want %v", pulled, tt.wantPull)
+			}
+			if created != tt.wantCreate || started != tt.wantCreate {
+				t.Errorf("got created %v, started %v, want %v", created, started, tt.wantCreate)
+			}
+			if inspected != 1 {
+				t.Errorf("got %d inspects of the sidecar, want 1", inspected)
+			}
+		})
+	}
+}
+
+func TestStartSidecarsAfter(t *testing.T) {
+	grace := containerGracePeriod
+	containerGracePeriod = 100 * time.Millisecond
+	t.Cleanup(func() { containerGracePeriod = grace })
+	t.Cleanup(func() { status.setSidecar("logs", nil) })
+
+	// The image of logs can't be pulled, inventory starts.
+	rt := fakeDockerRuntime(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create") && r.URL.Query().Get("fromImage") == "ghcr.io/example/shipper":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"manifest for ghcr.io/example/shipper:v2 not found: manifest unknown"}`))
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			_, _ = w.Write([]byte(`{"status":"Status: Downloaded newer image for ghcr.io/example/inventory:v1"}`))
+		case strings.Contains(r.URL.Path, "/images/"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"No such image"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Id":"def"}`))
+		case strings.HasSuffix(r.URL.Path, "/start"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/wait"):
+			<-r.Context().Done()
+		case strings.HasSuffix(r.URL.Path, "/containers/def/json"):
+			_, _ = w.Write([]byte(`{"Id":"def","State":{"Running":true}}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	})
+	sidecars := []sidecar{
+		{Name: "logs", Image: "ghcr.io/example/shipper:v2", AfterTinkWorker: true},
+		{Name: "inventory", Image: "ghcr.io/example/inventory:v1", AfterTinkWorker: true},
+	}
+	policy := retryPolicy{initialInterval: time.Millisecond, maxInterval: time.Millisecond, maxAttempts: 1}
+
+	specs := startSidecarsAfter(context.Background(), logr.Discard(), rt, tinkWorkerConfig{}, sidecars, policy)
+	var names []string
+	for _, s := range specs {
+		names = append(names, s.name)
+	}
+	if diff := cmp.Diff([]string{"logs", "inventory"}, names); diff != "" {
+		t.Errorf("the failed sidecar must still be supervised: %s", diff)
+	}
+	status.mu.Lock()
+	errs := status.SidecarErrors
+	status.mu.Unlock()
+	if _, ok := errs["logs"]; !ok || len(errs) != 1 {
+		t.Errorf("got sidecar errors %v, want only logs", errs)
+	}
+}
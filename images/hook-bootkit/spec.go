@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// specFragment customizes the tink-worker container. It is supplied with tink_worker_spec=, either as
+// base64 encoded JSON or as an http(s) URL to fetch the JSON from, and is merged over the default spec.
+//
+//	{
+//	  "mounts": [{"source": "/lib/firmware", "target": "/lib/firmware", "readOnly": true}],
+//	  "env": ["FOO=bar"],
+//	  "labels": {"team": "provisioning"},
+//	  "devices": ["/dev/kvm", "/dev/ipmi0:/dev/ipmi0"],
+//	  "privileged": false,
+//	  "capabilities": ["SYS_ADMIN", "NET_ADMIN"],
+//	  "resources": {"memory": "512m", "cpus": "1.5"},
+//	  "restartPolicy": "on-failure"
+//	}
+type specFragment struct {
+	Mounts        []specMount       `json:"mounts,omitempty"`
+	Env           []string          `json:"env,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Devices       []string          `json:"devices,omitempty"`
+	Privileged    *bool             `json:"privileged,omitempty"`
+	Capabilities  []string          `json:"capabilities,omitempty"`
+	Resources     specResources     `json:"resources,omitempty"`
+	RestartPolicy string            `json:"restartPolicy,omitempty"`
+}
+
+// specMount is a bind mount in a specFragment.
+type specMount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// specResources are the resource limits in a specFragment.
+type specResources struct {
+	// Memory is a size such as 512m or 2g.
+	Memory string `json:"memory,omitempty"`
+	// CPUs is a number of CPUs such as 0.5 or 2.
+	CPUs string `json:"cpus,omitempty"`
+}
+
+// deviceMapping makes the host device hostPath available as containerPath.
+type deviceMapping struct {
+	hostPath      string
+	containerPath string
+}
+
+var (
+	capabilityName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	envName        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// restartPolicies are the restart policies a specFragment can set.
+var restartPolicies = map[string]bool{"no": true, "always": true, "on-failure": true, "unless-stopped": true}
+
+// loadSpecFragment returns the fragment in value, which is base64 encoded JSON or an http(s) URL to fetch
+// the JSON from. An empty value returns a nil fragment. Malformed and invalid fragments are configuration errors.
+func loadSpecFragment(ctx context.Context, value string) (*specFragment, error) {
+	if value == "" {
+		return nil, nil
+	}
+	f := &specFragment{}
+	if err := loadJSONValue(ctx, "tink_worker_spec", value, f); err != nil {
+		return nil, err
+	}
+	if err := f.validate(); err != nil {
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("invalid tink_worker_spec: %w", err))
+	}
+	return f, nil
+}
+
+// loadJSONValue decodes the JSON in the value of the kernel command line key into v. The value is
+// base64 encoded JSON or an http(s) URL to fetch the JSON from. Unknown fields are not allowed.
+func loadJSONValue(ctx context.Context, key, value string, v any) error {
+	var data []byte
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		b, err := fetchJSONValue(ctx, key, value)
+		if err != nil {
+			return err
+		}
+		data = b
+	} else {
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			if b, err = base64.RawURLEncoding.DecodeString(value); err != nil {
+				return newBootstrapError(kindConfig, fmt.Errorf("%s is neither an http(s) URL nor base64 encoded: %w", key, err))
+			}
+		}
+		data = b
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newBootstrapError(kindConfig, fmt.Errorf("decoding %s failed: %w", key, err))
+	}
+	return nil
+}
+
+func fetchJSONValue(ctx context.Context, key, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, newBootstrapError(kindConfig, fmt.Errorf("invalid %s URL: %w", key, err))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s failed: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("fetching %s from %s failed: %s", key, url, resp.Status)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, newBootstrapError(kindConfig, err)
+		}
+		return nil, newBootstrapError(kindNetwork, err)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// validate returns all the problems of the fragment.
+func (f *specFragment) validate() error {
+	var errs []error
+	for _, m := range f.Mounts {
+		if !filepath.IsAbs(m.Source) || !filepath.IsAbs(m.Target) {
+			errs = append(errs, fmt.Errorf("mount %s:%s: source and target must be absolute paths", m.Source, m.Target))
+		}
+	}
+	for _, e := range f.Env {
+		if k, _, ok := strings.Cut(e, "="); !ok || !envName.MatchString(k) {
+			errs = append(errs, fmt.Errorf("env %q: must be NAME=value", e))
+		}
+	}
+	for k := range f.Labels {
+		if k == "" {
+			errs = append(errs, errors.New("labels: empty label name"))
+		}
+	}
+	for _, d := range f.Devices {
+		if _, err := parseDevice(d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, c := range f.Capabilities {
+		if !capabilityName.MatchString(strings.TrimPrefix(strings.ToUpper(c), "CAP_")) {
+			errs = append(errs, fmt.Errorf("capability %q: not a capability name", c))
+		}
+	}
+	if f.Resources.Memory != "" {
+		if m, err := units.RAMInBytes(f.Resources.Memory); err != nil || m <= 0 {
+			errs = append(errs, fmt.Errorf("resources.memory %q: must be a size such as 512m", f.Resources.Memory))
+		}
+	}
+	if f.Resources.CPUs != "" {
+		if c, err := strconv.ParseFloat(f.Resources.CPUs, 64); err != nil || c <= 0 {
+			errs = append(errs, fmt.Errorf("resources.cpus %q: must be a positive number", f.Resources.CPUs))
+		}
+	}
+	if f.RestartPolicy != "" && !restartPolicies[f.RestartPolicy] {
+		errs = append(errs, fmt.Errorf("restartPolicy %q: must be one of no, always, on-failure or unless-stopped", f.RestartPolicy))
+	}
+	return errors.Join(errs...)
+}
+
+// parseDevice parses a device in the hostPath[:containerPath] form.
+func parseDevice(d string) (deviceMapping, error) {
+	host, ctr, ok := strings.Cut(d, ":")
+	if !ok {
+		ctr = host
+	}
+	if !strings.HasPrefix(host, "/dev/") || !strings.HasPrefix(ctr, "/dev/") {
+		return deviceMapping{}, fmt.Errorf("device %q: must be /dev/<host device>[:/dev/<container device>]", d)
+	}
+	return deviceMapping{hostPath: host, containerPath: ctr}, nil
+}
+
+// merge returns spec with the fragment applied. Mounts and env vars of the fragment replace those
+// of spec with the same target or name. The fragment must have been validated.
+func (f *specFragment) merge(spec containerSpec) containerSpec {
+	if f == nil {
+		return spec
+	}
+	spec.mounts = slices.Clone(spec.mounts)
+	spec.env = slices.Clone(spec.env)
+	spec.labels = maps.Clone(spec.labels)
+
+	for _, m := range f.Mounts {
+		bm := bindMount{source: m.Source, target: m.Target, readOnly: m.ReadOnly}
+		replaced := false
+		for i := range spec.mounts {
+			if spec.mounts[i].target == m.Target {
+				spec.mounts[i], replaced = bm, true
+			}
+		}
+		if !replaced {
+			spec.mounts = append(spec.mounts, bm)
+		}
+	}
+
+	for _, e := range f.Env {
+		k, _, _ := strings.Cut(e, "=")
+		replaced := false
+		for i := range spec.env {
+			if strings.HasPrefix(spec.env[i], k+"=") {
+				spec.env[i], replaced = e, true
+			}
+		}
+		if !replaced {
+			spec.env = append(spec.env, e)
+		}
+	}
+
+	if len(f.Labels) > 0 && spec.labels == nil {
+		spec.labels = map[string]string{}
+	}
+	for k, v := range f.Labels {
+		spec.labels[k] = v
+	}
+	for _, d := range f.Devices {
+		dm, _ := parseDevice(d)
+		spec.devices = append(spec.devices, dm)
+	}
+	if f.Privileged != nil {
+		spec.privileged = *f.Privileged
+	}
+	for _, c := range f.Capabilities {
+		spec.capabilities = append(spec.capabilities, "CAP_"+strings.TrimPrefix(strings.ToUpper(c), "CAP_"))
+	}
+	if f.Resources.Memory != "" {
+		spec.memoryLimit, _ = units.RAMInBytes(f.Resources.Memory)
+	}
+	if f.Resources.CPUs != "" {
+		cpus, _ := strconv.ParseFloat(f.Resources.CPUs, 64)
+		spec.nanoCPUs = int64(cpus * 1e9)
+	}
+	if f.RestartPolicy != "" {
+		spec.restartPolicy = f.RestartPolicy
+	}
+	return spec
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadSpecFragment(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/spec.json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"env":["FOO=bar"]}`))
+	}))
+	defer srv.Close()
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := map[string]struct {
+		value    string
+		want     *specFragment
+		wantKind errorKind
+	}{
+		"empty": {},
+		"base64": {
+			value: b64(`{"mounts":[{"source":"/lib/firmware","target":"/lib/firmware","readOnly":true}]}`),
+			want:  &specFragment{Mounts: []specMount{{Source: "/lib/firmware", Target: "/lib/firmware", ReadOnly: true}}},
+		},
+		"url": {
+			value: srv.URL + "/spec.json",
+			want:  &specFragment{Env: []string{"FOO=bar"}},
+		},
+		"url not found":   {value: srv.URL + "/missing.json", wantKind: kindConfig},
+		"not base64":      {value: "{not base64}", wantKind: kindConfig},
+		"malformed json":  {value: b64(`{"env":`), wantKind: kindConfig},
+		"unknown field":   {value: b64(`{"mount":[]}`), wantKind: kindConfig},
+		"invalid content": {value: b64(`{"restartPolicy":"sometimes"}`), wantKind: kindConfig},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadSpecFragment(context.Background(), tt.value)
+			if tt.wantKind != "" {
+				if got := kindOf(err); got != tt.wantKind {
+					t.Fatalf("got kind %q, want %q (error: %v)", got, tt.wantKind, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestSpecFragmentValidate(t *testing.T) {
+	no := false
+	tests := map[string]struct {
+		fragment specFragment
+		wantErr  bool
+	}{
+		"valid": {fragment: specFragment{
+			Mounts:        []specMount{{Source: "/lib/firmware", Target: "/lib/firmware"}},
+			Env:           []string{"FOO=bar", "EMPTY="},
+			Labels:        map[string]string{"team": "provisioning"},
+			Devices:       []string{"/dev/kvm", "/dev/ipmi0:/dev/ipmi1"},
+			Privileged:    &no,
+			Capabilities:  []string{"SYS_ADMIN", "cap_net_admin"},
+			Resources:     specResources{Memory: "512m", CPUs: "1.5"},
+			RestartPolicy: "on-failure",
+		}},
+		"relative mount":  {fragment: specFragment{Mounts: []specMount{{Source: "firmware", Target: "/lib/firmware"}}}, wantErr: true},
+		"env without =":   {fragment: specFragment{Env: []string{"FOO"}}, wantErr: true},
+		"bad env name":    {fragment: specFragment{Env: []string{"1FOO=bar"}}, wantErr: true},
+		"non /dev device": {fragment: specFragment{Devices: []string{"/etc/passwd"}}, wantErr: true},
+		"bad capability":  {fragment: specFragment{Capabilities: []string{"SYS ADMIN"}}, wantErr: true},
+		"bad memory":      {fragment: specFragment{Resources: specResources{Memory: "lots"}}, wantErr: true},
+		"zero cpus":       {fragment: specFragment{Resources: specResources{CPUs: "0"}}, wantErr: true},
+		"bad restart":     {fragment: specFragment{RestartPolicy: "sometimes"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.fragment.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpecFragmentMerge(t *testing.T) {
+	defaults := func() containerSpec {
+		return containerSpec{
+			name:        tinkWorkerContainerName,
+			image:       "quay.io/tinkerbell/tink-worker:latest",
+			env:         []string{"WORKER_ID=m1", "HTTP_PROXY="},
+			mounts:      []bindMount{{source: "/worker", target: "/worker"}, {source: "/dev", target: "/dev"}},
+			hostNetwork: true,
+			privileged:  true,
+		}
+	}
+	no := false
+	tests := map[string]struct {
+		fragment *specFragment
+		want     containerSpec
+	}{
+		"nil fragment": {want: defaults()},
+		"everything": {
+			fragment: &specFragment{
+				Mounts:        []specMount{{Source: "/lib/firmware", Target: "/lib/firmware", ReadOnly: true}, {Source: "/var/worker", Target: "/worker"}},
+				Env:           []string{"HTTP_PROXY=http://proxy:3128", "FOO=bar"},
+				Labels:        map[string]string{"team": "provisioning"},
+				Devices:       []string{"/dev/kvm"},
+				Privileged:    &no,
+				Capabilities:  []string{"sys_admin"},
+				Resources:     specResources{Memory: "512m", CPUs: "1.5"},
+				RestartPolicy: "always",
+			},
+			want: containerSpec{
+				name:          tinkWorkerContainerName,
+				image:         "quay.io/tinkerbell/tink-worker:latest",
+				env:           []string{"WORKER_ID=m1", "HTTP_PROXY=http://proxy:3128", "FOO=bar"},
+				labels:        map[string]string{"team": "provisioning"},
+				mounts:        []bindMount{{source: "/var/worker", target: "/worker"}, {source: "/dev", target: "/dev"}, {source: "/lib/firmware", target: "/lib/firmware", readOnly: true}},
+				devices:       []deviceMapping{{hostPath: "/dev/kvm", containerPath: "/dev/kvm"}},
+				hostNetwork:   true,
+				capabilities:  []string{"CAP_SYS_ADMIN"},
+				memoryLimit:   512 * 1024 * 1024,
+				nanoCPUs:      1500000000,
+				restartPolicy: "always",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			base := defaults()
+			got := tt.fragment.merge(base)
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(containerSpec{}, bindMount{}, deviceMapping{})); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(defaults(), base, cmp.AllowUnexported(containerSpec{}, bindMount{}, deviceMapping{})); diff != "" {
+				t.Errorf("merge modified the default spec: %s", diff)
+			}
+		})
+	}
+}
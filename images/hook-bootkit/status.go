@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// bootState is the state of the tink-worker bootstrap.
+type bootState string
+
+const (
+	stateBootstrapping bootState = "bootstrapping"
+	stateRunning       bootState = "running"
+	// stateNeedsOperator is terminal: BootKit gave up and someone has to fix the configuration or the environment.
+	stateNeedsOperator bootState = "needs_operator"
+)
+
+// bootStatus is the bootstrap status that is served on the /status endpoint.
+type bootStatus struct {
+	mu sync.Mutex
+
+	State       bootState `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	ErrorKind   errorKind `json:"errorKind,omitempty"`
+	Permanent   bool      `json:"permanent,omitempty"`
+	ContainerID string    `json:"containerID,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	// LLDP is the content of lldpFile: the switch ports the interfaces are cabled to.
+	LLDP json.RawMessage `json:"lldp,omitempty"`
+	// Clock is the content of timeSyncFile: the NTP server the clock was set from and the clock skew.
+	Clock json.RawMessage `json:"clock,omitempty"`
+	// Preflight is the report of the last network preflight checks.
+	Preflight *preflightReport `json:"preflight,omitempty"`
+	// Prefetch is the progress of the images of prefetch_images=.
+	Prefetch []prefetchImage `json:"prefetch,omitempty"`
+	// SidecarErrors are the errors of the sidecars that failed to start, by name.
+	SidecarErrors map[string]string `json:"sidecarErrors,omitempty"`
+}
+
+var (
+	// lldpFile is where hook-network writes the LLDP neighbors it discovered at boot.
+	lldpFile = "/worker/lldp.json"
+	// timeSyncFile is where hook-network reports the time sync at boot.
+	timeSyncFile = "/run/network/time-sync.json"
+)
+
+var status = &bootStatus{State: stateBootstrapping, UpdatedAt: time.Now().UTC()}
+
+// setFailure records a failed bootstrap attempt.
+func (s *bootStatus) setFailure(attempt int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = stateBootstrapping
+	s.Attempts = attempt
+	s.LastError = err.Error()
+	s.ErrorKind = kindOf(err)
+	s.Permanent = isPermanent(err)
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// setRunning records that the tink-worker container is running.
+func (s *bootStatus) setRunning(attempt int, containerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = stateRunning
+	s.Attempts = attempt
+	s.LastError = ""
+	s.ErrorKind = ""
+	s.Permanent = false
+	s.ContainerID = containerID
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// setPreflight records the report of the network preflight checks.
+func (s *bootStatus) setPreflight(r preflightReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Preflight = &r
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// setPrefetch records the progress of the prefetched images.
+func (s *bootStatus) setPrefetch(images []prefetchImage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Prefetch = slices.Clone(images)
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// setSidecar records whether the sidecar name failed to start with err, or is running when err is nil.
+func (s *bootStatus) setSidecar(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.SidecarErrors, name)
+	} else {
+		if s.SidecarErrors == nil {
+			s.SidecarErrors = map[string]string{}
+		}
+		s.SidecarErrors[name] = err.Error()
+	}
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// setNeedsOperator moves the bootstrap into the terminal needs_operator state.
+func (s *bootStatus) setNeedsOperator() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = stateNeedsOperator
+	s.UpdatedAt = time.Now().UTC()
+}
+
+// ServeHTTP writes the status as JSON, with the LLDP neighbors and the time sync once hook-network reported them.
+func (s *bootStatus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	lldp, clock := readJSONFile(lldpFile), readJSONFile(timeSyncFile)
+	s.mu.Lock()
+	s.LLDP, s.Clock = lldp, clock
+	b, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// readJSONFile returns the content of a JSON file, or nil when it does not exist or is not valid JSON.
+func readJSONFile(name string) json.RawMessage {
+	b, err := os.ReadFile(name)
+	if err != nil || !json.Valid(b) {
+		return nil
+	}
+	return b
+}
+
+// announceNeedsOperator writes a banner about the terminal failure to the console, so
+// whoever looks at the machine sees why provisioning stopped.
+func announceNeedsOperator(err error) {
+	f, oerr := os.OpenFile("/dev/console", os.O_WRONLY, 0)
+	if oerr != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "\n"+
+		"******************************************************************\n"+
+		"* HookOS: bootstrapping tink-worker failed and needs an operator *\n"+
+		"******************************************************************\n"+
+		"error kind: %s\nerror: %v\n\n", kindOf(err), err)
+}
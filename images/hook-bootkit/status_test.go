@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStatusReports(t *testing.T) {
+	tests := map[string]struct {
+		lldp      string
+		clock     string
+		wantLLDP  string
+		wantClock string
+	}{
+		"not reported yet": {},
+		"reported": {
+			lldp:      `[{"interface":"eth0","mac":"de:ad:be:ef:00:01","chassisID":"00:11:22:33:44:55","portID":"Ethernet12"}]`,
+			clock:     `{"servers":["10.0.0.123"],"server":"10.0.0.123","synced":true,"skewSeconds":-7200.5}`,
+			wantLLDP:  `[{"interface":"eth0","mac":"de:ad:be:ef:00:01","chassisID":"00:11:22:33:44:55","portID":"Ethernet12"}]`,
+			wantClock: `{"servers":["10.0.0.123"],"server":"10.0.0.123","synced":true,"skewSeconds":-7200.5}`,
+		},
+		"invalid": {lldp: `[{"interface":`, clock: `{"servers":`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			lldpFile, timeSyncFile = filepath.Join(dir, "lldp.json"), filepath.Join(dir, "time-sync.json")
+			t.Cleanup(func() { lldpFile, timeSyncFile = "/worker/lldp.json", "/run/network/time-sync.json" })
+			for name, content := range map[string]string{lldpFile: tt.lldp, timeSyncFile: tt.clock} {
+				if content == "" {
+					continue
+				}
+				if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			(&bootStatus{State: stateRunning}).ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+			var got struct {
+				State bootState       `json:"state"`
+				LLDP  json.RawMessage `json:"lldp"`
+				Clock json.RawMessage `json:"clock"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.State != stateRunning {
+				t.Errorf("got state %q, want %q", got.State, stateRunning)
+			}
+			if diff := cmp.Diff(tt.wantLLDP, string(got.LLDP)); diff != "" {
+				t.Errorf("lldp: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantClock, string(got.Clock)); diff != "" {
+				t.Errorf("clock: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/tinkerbell/hook/hook-bootkit"
+
+// setupTracing configures the global OpenTelemetry tracer provider to export spans to the OTLP/HTTP endpoint.
+// The endpoint can either be a URL (http://10.1.1.1:4318) or a host:port, in which case HTTPS is used.
+// When endpoint is empty tracing stays disabled and the returned shutdown function is a no-op.
+func setupTracing(ctx context.Context, endpoint, workerID string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opt otlptracehttp.Option
+	if strings.Contains(endpoint, "://") {
+		opt = otlptracehttp.WithEndpointURL(endpoint)
+	} else {
+		opt = otlptracehttp.WithEndpoint(endpoint)
+	}
+	exp, err := otlptracehttp.New(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("hook-bootkit"),
+			attribute.String("tinkerbell.worker_id", workerID),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a span for a bootstrap phase.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording err on it when it is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceEnv returns the W3C trace context of ctx as environment variables so that
+// the spans of the process receiving them can join the boot trace.
+func traceEnv(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	env := make([]string, 0, len(carrier))
+	for k, v := range carrier {
+		env = append(env, strings.ToUpper(k)+"="+v)
+	}
+	return env
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/go-logr/logr"
+)
+
+// watchTinkWorker periodically inspects the tink-worker container until ctx is canceled.
+// It keeps the restart count metric up to date and reports a crash event whenever the
+// container stops running or is restarted by the container runtime.
+// Sidecars that stopped running are reported and recreated from their spec.
+func watchTinkWorker(ctx context.Context, log logr.Logger, cfg tinkWorkerConfig, events *eventReporter, sidecars []containerSpec, interval time.Duration) {
+	rt, err := newContainerRuntime(log, cfg)
+	if err != nil {
+		log.Error(err, "unable to create container runtime client for watching tink-worker")
+		return
+	}
+	defer rt.Close()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var restarts int
+	running := true
+	for {
+		if s, err := rt.Inspect(ctx, tinkWorkerContainerName); err == nil {
+			tinkWorkerRestarts.Set(float64(s.restartCount))
+			if s.restartCount > restarts || (running && !s.running) {
+				log.Info("tink-worker container crashed", "exitCode", s.exitCode, "restartCount", s.restartCount)
+				events.emit(eventWorkerCrashed, map[string]string{
+					"exit_code":     strconv.Itoa(s.exitCode),
+					"restart_count": strconv.Itoa(s.restartCount),
+					"error":         s.err,
+				})
+			}
+			restarts = s.restartCount
+			running = s.running
+		}
+		for _, spec := range sidecars {
+			superviseSidecar(ctx, log, rt, cfg, events, spec)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// superviseSidecar recreates the sidecar when it is not running anymore, or was never started, pulling
+// its image first when it is missing.
+func superviseSidecar(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, events *eventReporter, spec containerSpec) {
+	s, err := rt.Inspect(ctx, spec.name)
+	if err == nil && s.running {
+		return
+	}
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		log.Error(err, "inspecting sidecar failed", "sidecar", spec.name)
+		return
+	}
+	log.Info("sidecar container stopped, restarting it", "sidecar", spec.name, "exitCode", s.exitCode)
+	events.emit(eventSidecarCrashed, map[string]string{
+		"name":      spec.name,
+		"exit_code": strconv.Itoa(s.exitCode),
+		"error":     s.err,
+	})
+	sidecarRestarts.WithLabelValues(spec.name).Inc()
+	err = restartSidecar(ctx, log, rt, cfg, spec)
+	if err != nil {
+		log.Error(err, "restarting sidecar failed, will try again", "sidecar", spec.name)
+	}
+	status.setSidecar(spec.name, err)
+}
+
+// restartSidecar pulls the image of the sidecar when it is not in the image store, and launches it.
+func restartSidecar(ctx context.Context, log logr.Logger, rt containerRuntime, cfg tinkWorkerConfig, spec containerSpec) error {
+	id, err := rt.ImageID(ctx, spec.image)
+	if err != nil {
+		return fmt.Errorf("checking the local image of sidecar %s failed: %w", spec.name, err)
+	}
+	if id == "" {
+		if _, err := rt.Pull(ctx, spec.image, cfg.registryAuth(spec.image)); err != nil {
+			return fmt.Errorf("pulling the image of sidecar %s failed: %w", spec.name, err)
+		}
+	}
+	_, err = launchContainer(ctx, log, rt, spec)
+	return err
+}
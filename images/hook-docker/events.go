@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// Lifecycle event types reported by hook-docker.
+const (
+	eventNetworkUp       = "network_up"
+	eventDockerReady     = "docker_ready"
+	eventRebootRequested = "reboot_requested"
+)
+
+// eventSpoolDir is where events are buffered until they are delivered.
+// /var/run is shared with hook-bootkit, which spools its events in a sibling directory.
+const eventSpoolDir = "/var/run/hook-events/hook-docker"
+
+// errEventRejected is returned by post when the webhook rejects an event with a client error other
+// than 408 Request Timeout or 429 Too Many Requests, so that sending it again can't succeed.
+var errEventRejected = errors.New("event rejected by the webhook")
+
+// event is a structured lifecycle event that is POSTed to the hook_events_url.
+type event struct {
+	Type      string            `json:"type"`
+	Source    string            `json:"source"`
+	WorkerID  string            `json:"worker_id,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// eventReporter buffers events to disk and delivers them, in order, to an HTTP webhook.
+// A nil *eventReporter is valid and drops all events.
+type eventReporter struct {
+	url      string
+	workerID string
+	dir      string
+	client   *http.Client
+
+	seqMu   sync.Mutex
+	seq     uint64
+	flushMu sync.Mutex
+	wake    chan struct{}
+}
+
+// newEventReporter returns an eventReporter that spools events in dir and POSTs them to url.
+// It returns nil when url is empty.
+func newEventReporter(url, workerID, dir string) *eventReporter {
+	if url == "" {
+		return nil
+	}
+	return &eventReporter{
+		url:      url,
+		workerID: workerID,
+		dir:      dir,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// emit writes the event to the spool directory and wakes up the sender.
+func (e *eventReporter) emit(typ string, details map[string]string) {
+	if e == nil {
+		return
+	}
+	ev := event{Type: typ, Source: "hook-docker", WorkerID: e.workerID, Timestamp: time.Now().UTC(), Details: details}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Println("unable to marshal event", typ, err)
+		return
+	}
+
+	e.seqMu.Lock()
+	e.seq++
+	// The name sorts in emit order, which is the order events are delivered in.
+	name := fmt.Sprintf("%020d-%06d.json", ev.Timestamp.UnixNano(), e.seq)
+	e.seqMu.Unlock()
+
+	if err := os.MkdirAll(e.dir, 0o700); err != nil {
+		fmt.Println("unable to create event spool directory", e.dir, err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(e.dir, name), b, 0o600); err != nil {
+		fmt.Println("unable to spool event", typ, err)
+		return
+	}
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers spooled events until ctx is canceled. Failed deliveries are retried with an exponential backoff.
+func (e *eventReporter) run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = 0
+	bo.MaxInterval = time.Minute
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wake:
+		case <-time.After(wait):
+		}
+		if err := e.flush(ctx); err != nil {
+			wait = bo.NextBackOff()
+			fmt.Println("delivering events failed, will retry in", wait, err)
+			continue
+		}
+		bo.Reset()
+		wait = time.Minute
+	}
+}
+
+// flush POSTs all spooled events in order, removing each one once it has been delivered or
+// rejected by the webhook.
+func (e *eventReporter) flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		loc := filepath.Join(e.dir, name)
+		b, err := os.ReadFile(loc)
+		if err != nil {
+			return err
+		}
+		if err := e.post(ctx, b); err != nil {
+			if !errors.Is(err, errEventRejected) {
+				return err
+			}
+			// Retrying a rejected event can't succeed, and would hold back the events after it.
+			fmt.Println("dropping the event rejected by the webhook", string(b), err)
+		}
+		if err := os.Remove(loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends a single event to the webhook.
+func (e *eventReporter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status code %d from %s", errEventRejected, resp.StatusCode, e.url)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code from %s: %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// watchNetwork reports a network_up event once an interface has a global unicast address.
+func watchNetwork(ctx context.Context, events *eventReporter) {
+	for {
+		ifaces, err := net.Interfaces()
+		if err == nil {
+			for _, iface := range ifaces {
+				if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+					continue
+				}
+				addrs, err := iface.Addrs()
+				if err != nil {
+					continue
+				}
+				for _, a := range addrs {
+					if ipn, ok := a.(*net.IPNet); ok && ipn.IP.IsGlobalUnicast() {
+						events.emit(eventNetworkUp, map[string]string{"interface": iface.Name, "address": ipn.String()})
+						return
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForDocker reports a docker_ready event once the Docker API answers on the unix socket.
+func waitForDocker(ctx context.Context, events *eventReporter, socket string) {
+	c := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	start := time.Now()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/_ping", nil)
+		if err != nil {
+			return
+		}
+		if resp, err := c.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				events.emit(eventDockerReady, map[string]string{"startup_duration": time.Since(start).String()})
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestEventReporterFlush(t *testing.T) {
+	tests := map[string]struct {
+		status    int
+		wantErr   bool
+		wantTypes []string
+		wantLeft  int
+	}{
+		"delivered in order":                   {status: http.StatusAccepted, wantTypes: []string{eventNetworkUp, eventDockerReady, eventRebootRequested}},
+		"webhook failure keeps events spooled": {status: http.StatusServiceUnavailable, wantErr: true, wantTypes: []string{eventNetworkUp}, wantLeft: 3},
+		"rate limit keeps events spooled":      {status: http.StatusTooManyRequests, wantErr: true, wantTypes: []string{eventNetworkUp}, wantLeft: 3},
+		"rejected events are dropped":          {status: http.StatusBadRequest, wantTypes: []string{eventNetworkUp, eventDockerReady, eventRebootRequested}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ev event
+				if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+					t.Errorf("unable to decode event: %v", err)
+				}
+				mu.Lock()
+				got = append(got, ev.Type)
+				mu.Unlock()
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			e := newEventReporter(srv.URL, "worker", dir)
+			e.emit(eventNetworkUp, nil)
+			e.emit(eventDockerReady, nil)
+			e.emit(eventRebootRequested, map[string]string{"reason": "test"})
+
+			err := e.flush(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.wantTypes) {
+				t.Fatalf("got events %v, want %v", got, tt.wantTypes)
+			}
+			for i := range got {
+				if got[i] != tt.wantTypes[i] {
+					t.Fatalf("got events %v, want %v", got, tt.wantTypes)
+				}
+			}
+			left, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != tt.wantLeft {
+				t.Fatalf("got %d spooled events, want %d", len(left), tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestNilEventReporter(t *testing.T) {
+	var e *eventReporter
+	e.emit(eventNetworkUp, nil)
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := newEventReporter("", "", t.TempDir()); got != nil {
+		t.Fatalf("expected a nil reporter without a URL, got %v", got)
+	}
+}
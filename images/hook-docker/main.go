@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,6 +18,18 @@ type tinkConfig struct {
 	httpProxy          string
 	httpsProxy         string
 	noProxy            string
+	// metricsAddr is the address to serve Prometheus metrics on; empty disables the metrics endpoint.
+	metricsAddr string
+	// eventsURL is the HTTP webhook lifecycle events are POSTed to; empty disables event reporting.
+	eventsURL string
+	workerID  string
+	// peerCache enables the registry mirror that shares the image blobs with the other HookOS machines on the same L2.
+	peerCache     bool
+	peerCachePort int
+	// peerCacheSecret is shared by the machines of the peer cache, which only serve their blobs to each other.
+	peerCacheSecret string
+	// peerCacheMaxMB is the size in MiB of the blobs the peer cache keeps.
+	peerCacheMaxMB int
 }
 
 type dockerConfig struct {
@@ -23,17 +37,10 @@ type dockerConfig struct {
 	LogDriver          string            `json:"log-driver,omitempty"`
 	LogOpts            map[string]string `json:"log-opts,omitempty"`
 	InsecureRegistries []string          `json:"insecure-registries,omitempty"`
+	RegistryMirrors    []string          `json:"registry-mirrors,omitempty"`
 }
 
-func run() error {
-	// Parse the cmdline in order to find the urls for the repository and path to the cert
-	content, err := os.ReadFile("/proc/cmdline")
-	if err != nil {
-		return err
-	}
-	cmdLines := strings.Split(string(content), " ")
-	cfg := parseCmdLine(cmdLines)
-
+func run(cfg tinkConfig, events *eventReporter) error {
 	fmt.Println("Starting the Docker Engine")
 
 	d := dockerConfig{
@@ -44,9 +51,12 @@ func run() error {
 		},
 		InsecureRegistries: cfg.insecureRegistries,
 	}
+	if cfg.peerCache {
+		d.RegistryMirrors = []string{fmt.Sprintf("http://127.0.0.1:%d", cfg.peerCachePort)}
+	}
 	path := "/etc/docker"
 	// Create the directory for the docker config
-	err = os.MkdirAll(path, os.ModeDir)
+	err := os.MkdirAll(path, os.ModeDir)
 	if err != nil {
 		return err
 	}
@@ -70,18 +80,42 @@ func run() error {
 
 	cmd.Env = append(os.Environ(), myEnvs...)
 
-	err = cmd.Run()
-	if err != nil {
+	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return nil
+	dockerd.setStarted()
+	defer dockerd.setStopped()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go waitForDocker(ctx, events, "/var/run/docker.sock")
+
+	return cmd.Wait()
 }
 
 func main() {
 	fmt.Println("Starting Docker")
-	go rebootWatch()
+	ctx := context.Background()
+	// Parse the cmdline in order to find the urls for the repository and path to the cert
+	content, err := readCmdLine(ctx, "/proc/cmdline", cmdLineRetryInterval)
+	if err != nil {
+		fmt.Println("error reading /proc/cmdline", err)
+		return
+	}
+	cfg := parseCmdLine(strings.Split(content, " "))
+
+	if cfg.metricsAddr != "" {
+		go serveMetrics(ctx, cfg.metricsAddr)
+	}
+	events := newEventReporter(cfg.eventsURL, cfg.workerID, eventSpoolDir)
+	go events.run(ctx)
+	go watchNetwork(ctx, events)
+	go rebootWatch(events)
+	if cfg.peerCache {
+		go servePeerCache(ctx, cfg)
+	}
 	for {
-		if err := run(); err != nil {
+		if err := run(cfg, events); err != nil {
 			fmt.Println("error starting up Docker", err)
 			fmt.Println("will retry in 10 seconds")
 			time.Sleep(10 * time.Second)
@@ -102,36 +136,98 @@ func (d dockerConfig) writeToDisk(loc string) error {
 	return nil
 }
 
+// cmdLineRetryInterval is how long to wait before reading the kernel command line again.
+const cmdLineRetryInterval = 10 * time.Second
+
+// readCmdLine reads the kernel command line from file. Docker can't be configured without it, so a
+// failed read is retried every interval until it succeeds or ctx is done.
+func readCmdLine(ctx context.Context, file string, interval time.Duration) (string, error) {
+	for {
+		content, err := os.ReadFile(file)
+		if err == nil {
+			return string(content), nil
+		}
+		fmt.Println("error reading", file, err)
+		fmt.Println("will retry in", interval)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
 // parseCmdLine will parse the command line.
 func parseCmdLine(cmdLines []string) (cfg tinkConfig) {
+	cfg.peerCachePort = defaultPeerCachePort
+	cfg.peerCacheMaxMB = defaultPeerCacheMaxMB
 	for i := range cmdLines {
-		cmdLine := strings.SplitN(cmdLines[i], "=", 2)
-		if len(cmdLine) == 0 {
-			continue
-		}
+		key, value, hasValue := strings.Cut(cmdLines[i], "=")
+		value = strings.TrimSpace(value)
 
-		switch cmd := strings.TrimSpace(cmdLine[0]); cmd {
+		switch strings.TrimSpace(key) {
 		case "syslog_host":
-			cfg.syslogHost = strings.TrimSpace(cmdLine[1])
+			cfg.syslogHost = value
 		case "insecure_registries":
-			cfg.insecureRegistries = strings.Split(strings.TrimSpace(cmdLine[1]), ",")
+			cfg.insecureRegistries = strings.Split(value, ",")
 		case "HTTP_PROXY":
-			cfg.httpProxy = strings.TrimSpace(cmdLine[1])
+			cfg.httpProxy = value
 		case "HTTPS_PROXY":
-			cfg.httpsProxy = strings.TrimSpace(cmdLine[1])
+			cfg.httpsProxy = value
 		case "NO_PROXY":
-			cfg.noProxy = strings.TrimSpace(cmdLine[1])
+			cfg.noProxy = value
+		case "hook_docker_metrics_addr":
+			cfg.metricsAddr = value
+		case "hook_events_url":
+			cfg.eventsURL = value
+		case "worker_id":
+			cfg.workerID = value
+		case "hook_peer_cache":
+			// A bare hook_peer_cache enables the peer cache, like hook_peer_cache=true.
+			cfg.peerCache = !hasValue
+			if hasValue {
+				cfg.peerCache, _ = strconv.ParseBool(value)
+			}
+		case "hook_peer_cache_port":
+			if port, err := strconv.Atoi(value); err == nil && port > 0 && port <= 65535 {
+				cfg.peerCachePort = port
+			} else {
+				fmt.Println("ignoring invalid hook_peer_cache_port", value)
+			}
+		case "hook_peer_cache_secret":
+			cfg.peerCacheSecret = value
+		case "hook_peer_cache_max_mb":
+			if size, err := strconv.Atoi(value); err == nil && size > 0 {
+				cfg.peerCacheMaxMB = size
+			} else {
+				fmt.Println("ignoring invalid hook_peer_cache_max_mb", value)
+			}
 		}
 	}
+	if cfg.peerCache && cfg.peerCacheSecret == "" {
+		fmt.Println("hook_peer_cache needs the hook_peer_cache_secret shared by the machines, not starting the peer cache")
+		cfg.peerCache = false
+	}
 	return cfg
 }
 
-func rebootWatch() {
+func rebootWatch(events *eventReporter) {
 	fmt.Println("Starting Reboot Watcher")
 
 	// Forever loop
+	reported := false
 	for {
 		if fileExists("/worker/reboot") {
+			if !reported {
+				reported = true
+				events.emit(eventRebootRequested, nil)
+				// Give the event a chance to be delivered; the spool doesn't survive the reboot.
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := events.flush(ctx); err != nil {
+					fmt.Println("delivering events before reboot failed", err)
+				}
+				cancel()
+			}
 			cmd := exec.Command("/sbin/reboot")
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
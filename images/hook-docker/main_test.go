@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestWriteToDisk(t *testing.T) {
@@ -44,3 +48,69 @@ func TestWriteToDisk(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCmdLine(t *testing.T) {
+	tests := map[string]struct {
+		cmdLine       string
+		wantPeerCache bool
+		wantPort      int
+		wantMaxMB     int
+		wantSyslog    string
+	}{
+		"defaults":                  {cmdLine: "console=ttyS0 syslog_host=10.0.0.1", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB, wantSyslog: "10.0.0.1"},
+		"peer cache":                {cmdLine: "hook_peer_cache=true hook_peer_cache_secret=s3cret hook_peer_cache_port=6000 hook_peer_cache_max_mb=256", wantPeerCache: true, wantPort: 6000, wantMaxMB: 256},
+		"bare peer cache":           {cmdLine: "hook_peer_cache hook_peer_cache_secret=s3cret", wantPeerCache: true, wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+		"peer cache without secret": {cmdLine: "hook_peer_cache=true", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+		"disabled peer cache":       {cmdLine: "hook_peer_cache=false hook_peer_cache_secret=s3cret", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+		"bare keys with values":     {cmdLine: "syslog_host hook_peer_cache_port worker_id", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+		"invalid port":              {cmdLine: "hook_peer_cache_port=70000", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+		"invalid size":              {cmdLine: "hook_peer_cache_max_mb=0", wantPort: defaultPeerCachePort, wantMaxMB: defaultPeerCacheMaxMB},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := parseCmdLine(strings.Split(tt.cmdLine, " "))
+			if got.peerCache != tt.wantPeerCache || got.peerCachePort != tt.wantPort || got.peerCacheMaxMB != tt.wantMaxMB || got.syslogHost != tt.wantSyslog {
+				t.Errorf("got peer cache %v on port %d of %d MiB and syslog host %q, want %v on port %d of %d MiB and %q",
+					got.peerCache, got.peerCachePort, got.peerCacheMaxMB, got.syslogHost, tt.wantPeerCache, tt.wantPort, tt.wantMaxMB, tt.wantSyslog)
+			}
+		})
+	}
+}
+
+func TestReadCmdLine(t *testing.T) {
+	tests := map[string]struct {
+		// createAfter is when the file is created; negative never creates it.
+		createAfter time.Duration
+		want        string
+		wantErr     bool
+	}{
+		"exists":         {createAfter: 0, want: "hook_peer_cache=true"},
+		"appears later":  {createAfter: 50 * time.Millisecond, want: "hook_peer_cache=true"},
+		"never readable": {createAfter: -1, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "cmdline")
+			create := func() {
+				if err := os.WriteFile(file, []byte(tt.want), 0o644); err != nil {
+					t.Error(err)
+				}
+			}
+			switch {
+			case tt.createAfter == 0:
+				create()
+			case tt.createAfter > 0:
+				time.AfterFunc(tt.createAfter, create)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := readCmdLine(ctx, file, 10*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// dockerdState tracks when the currently running dockerd was started.
+type dockerdState struct {
+	mu      sync.Mutex
+	started time.Time
+	starts  int
+}
+
+var dockerd = &dockerdState{}
+
+var (
+	dockerdStarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hook_docker_dockerd_starts_total",
+		Help: "Number of times dockerd was started.",
+	})
+	dockerdRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hook_docker_dockerd_restarts_total",
+		Help: "Number of times dockerd was restarted after exiting.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hook_docker_dockerd_uptime_seconds",
+		Help: "Seconds since the currently running dockerd was started; 0 when dockerd is not running.",
+	}, dockerd.uptime)
+	peerCacheBlobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hook_docker_peer_cache_blobs_total",
+		Help: "Number of blobs served by the peer cache, by source: cache, peer or upstream for dockerd, served for the peers.",
+	}, []string{"source"})
+	peerCacheBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hook_docker_peer_cache_bytes_total",
+		Help: "Number of bytes of the blobs served by the peer cache, by source: cache, peer or upstream for dockerd, served for the peers.",
+	}, []string{"source"})
+)
+
+// setStarted records that dockerd was started, counting it as a restart if it was started before.
+func (d *dockerdState) setStarted() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = time.Now()
+	if d.starts > 0 {
+		dockerdRestarts.Inc()
+	}
+	d.starts++
+	dockerdStarts.Inc()
+}
+
+// setStopped records that dockerd exited.
+func (d *dockerdState) setStopped() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = time.Time{}
+}
+
+// uptime returns the number of seconds the current dockerd has been running.
+func (d *dockerdState) uptime() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started.IsZero() {
+		return 0
+	}
+	return time.Since(d.started).Seconds()
+}
+
+// serveMetrics exposes the Prometheus metrics on addr until ctx is canceled.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+	}()
+
+	fmt.Println("Serving metrics on", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("metrics server failed", err)
+	}
+}
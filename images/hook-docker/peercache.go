@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peerCacheDir is where the blobs of the peer cache are stored.
+	peerCacheDir = "/var/lib/hook-peer-cache"
+	// defaultPeerCachePort is the port of the peer cache without hook_peer_cache_port=.
+	defaultPeerCachePort = 5050
+	// peerCacheGroup is the multicast group the peer caches announce their blobs on. The TTL of
+	// multicast is 1 by default, so the announcements do not leave the L2 segment.
+	peerCacheGroup = "239.255.50.50:5051"
+	// peerAnnounceInterval is how often the blobs are announced. Peers are forgotten after three
+	// missed announcements.
+	peerAnnounceInterval = 5 * time.Second
+	// defaultPeerCacheMaxMB is the size in MiB the cache is pruned to, oldest blobs first, without
+	// hook_peer_cache_max_mb=. The blobs are kept in memory like the rest of HookOS.
+	defaultPeerCacheMaxMB = 512
+	// peerTokenHeader holds the HMAC of the digest with the shared secret, which the peers need to
+	// fetch a blob.
+	peerTokenHeader = "Hook-Peer-Token"
+	// maxAnnouncedBlobs is how many of the newest blobs are announced.
+	maxAnnouncedBlobs = 1024
+	// blobsPerAnnouncement keeps the announcements in a single packet below the usual MTU.
+	blobsPerAnnouncement = 16
+	// dockerHubRegistry is the registry the peer cache mirrors. dockerd only uses registry mirrors
+	// for Docker Hub.
+	dockerHubRegistry = "https://registry-1.docker.io"
+)
+
+// peerAnnouncement is the multicast announcement of the blobs in the cache of a peer. The address
+// of the peer is the source address of the announcement.
+type peerAnnouncement struct {
+	ID    string   `json:"id"`
+	Port  int      `json:"port"`
+	Blobs []string `json:"blobs"`
+}
+
+// peerCache is a registry mirror for dockerd that caches the blobs it serves, and fetches the
+// blobs from the other HookOS machines on the same L2 before fetching them from the registry.
+// Every blob is verified against its digest before it is cached, and blobs from peers are verified
+// before they are served. The registry mirror is only served to dockerd on the loopback interface,
+// and the blobs are only served to the peers that know the shared secret.
+type peerCache struct {
+	dir      string
+	upstream *url.URL
+	// id tells the own announcements apart from the announcements of the peers.
+	id     string
+	port   int
+	secret []byte
+	// maxBytes is the size the cache is pruned to.
+	maxBytes int64
+	client   *http.Client
+	proxy    *httputil.ReverseProxy
+	peers    *peerSet
+	// changed wakes up announce when a blob was added to the cache.
+	changed chan struct{}
+}
+
+// newPeerCache returns a peerCache of at most maxBytes of blobs in dir that mirrors upstream, is
+// served on port and shares the blobs with the peers that know secret. The registry is reached
+// through httpsProxy, if set, and everything with dial.
+func newPeerCache(dir, upstream string, port int, secret string, maxBytes int64, httpsProxy string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*peerCache, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream registry: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			// The peers are on the same L2 and never reached through the proxy.
+			if httpsProxy == "" || r.URL.Scheme != "https" {
+				return nil, nil
+			}
+			return url.Parse(httpsProxy)
+		},
+		DialContext:           dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+	return &peerCache{
+		dir:      dir,
+		upstream: u,
+		id:       hex.EncodeToString(id),
+		port:     port,
+		secret:   []byte(secret),
+		maxBytes: maxBytes,
+		client:   &http.Client{Transport: transport},
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(u)
+			},
+			Transport: transport,
+		},
+		peers:   &peerSet{blobs: map[string]map[string]time.Time{}},
+		changed: make(chan struct{}, 1),
+	}, nil
+}
+
+// servePeerCache runs the peer cache of hook_peer_cache= until ctx is canceled.
+func servePeerCache(ctx context.Context, cfg tinkConfig) {
+	c, err := newPeerCache(peerCacheDir, dockerHubRegistry, cfg.peerCachePort, cfg.peerCacheSecret, int64(cfg.peerCacheMaxMB)<<20, cfg.httpsProxy, (&net.Dialer{Timeout: 30 * time.Second}).DialContext)
+	if err != nil {
+		fmt.Println("unable to create the peer cache", err)
+		return
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port))
+	if err != nil {
+		fmt.Println("unable to listen for the peer cache", err)
+		return
+	}
+	go func() {
+		recv, send := joinPeerGroup(ctx)
+		if recv == nil {
+			return
+		}
+		go c.discover(ctx, recv)
+		c.announce(ctx, send)
+	}()
+
+	srv := &http.Server{Handler: c, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	fmt.Println("Serving the peer cache on", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("peer cache failed", err)
+	}
+}
+
+// joinPeerGroup returns the connections to receive and send announcements on peerCacheGroup. The
+// group can only be joined once the network is up, so it is retried until ctx is canceled.
+func joinPeerGroup(ctx context.Context) (*net.UDPConn, *net.UDPConn) {
+	group, err := net.ResolveUDPAddr("udp4", peerCacheGroup)
+	if err != nil {
+		fmt.Println("invalid peer cache group", err)
+		return nil, nil
+	}
+	for {
+		recv, err := net.ListenMulticastUDP("udp4", nil, group)
+		if err == nil {
+			send, err := net.DialUDP("udp4", nil, group)
+			if err == nil {
+				return recv, send
+			}
+			recv.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(peerAnnounceInterval):
+		}
+	}
+}
+
+// ServeHTTP serves the blobs of the cache to dockerd on /v2/<name>/blobs/<digest> and to the peers
+// on /peer/blobs/<digest>, and proxies the rest of the registry API to the upstream registry. The
+// registry API is only served on the loopback interface, as it passes on the credentials of
+// dockerd.
+func (c *peerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if digest, ok := strings.CutPrefix(r.URL.Path, "/peer/blobs/"); ok {
+		c.servePeer(w, r, digest)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !fromLoopback(r) {
+		http.Error(w, "the registry mirror is only served to the local dockerd", http.StatusForbidden)
+		return
+	}
+	if digest, ok := blobDigest(r.URL.Path); ok && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		c.serveBlob(w, r, digest)
+		return
+	}
+	c.proxy.ServeHTTP(w, r)
+}
+
+// fromLoopback returns whether r comes from the loopback interface.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsLoopback()
+}
+
+// blobDigest returns the digest of a /v2/<name>/blobs/<digest> path, when it is a SHA-256 digest.
+func blobDigest(p string) (string, bool) {
+	i := strings.LastIndex(p, "/blobs/")
+	if i <= len("/v2") {
+		return "", false
+	}
+	digest := p[i+len("/blobs/"):]
+	return digest, validDigest(digest)
+}
+
+// validDigest returns whether digest is a SHA-256 digest, the only algorithm of the cache.
+func validDigest(digest string) bool {
+	sum, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(sum) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range sum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// serveBlob serves a blob to dockerd from the cache, from a peer that announced it or from the
+// upstream registry, in that order.
+func (c *peerCache) serveBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	if c.serveCached(w, r, digest, "cache") {
+		return
+	}
+	if r.Method == http.MethodHead {
+		c.proxy.ServeHTTP(w, r)
+		return
+	}
+	for _, peer := range c.peers.lookup(digest, time.Now()) {
+		if err := c.fetchPeer(r.Context(), peer, digest); err != nil {
+			fmt.Println("fetching blob from peer failed", peer, digest, err)
+			continue
+		}
+		if c.serveCached(w, r, digest, "peer") {
+			return
+		}
+	}
+	c.fetchUpstream(w, r, digest)
+}
+
+// serveCached serves the blob from the cache, if it is there, and counts it as coming from source.
+func (c *peerCache) serveCached(w http.ResponseWriter, r *http.Request, digest, source string) bool {
+	f, err := os.Open(c.blobFile(digest))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	if r.Method == http.MethodGet {
+		peerCacheBlobs.WithLabelValues(source).Inc()
+		peerCacheBytes.WithLabelValues(source).Add(float64(info.Size()))
+	}
+	return true
+}
+
+// servePeer serves a blob to a peer that knows the shared secret, only from the cache.
+func (c *peerCache) servePeer(w http.ResponseWriter, r *http.Request, digest string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(peerTokenHeader)), []byte(c.peerToken(digest))) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !validDigest(digest) || !c.serveCached(w, r, digest, "served") {
+		http.NotFound(w, r)
+	}
+}
+
+// peerToken returns the token of a peer to fetch the blob digest: the HMAC of the digest with the
+// shared secret, so that the secret itself is not sent over the network.
+func (c *peerCache) peerToken(digest string) string {
+	m := hmac.New(sha256.New, c.secret)
+	m.Write([]byte(digest))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// fetchPeer downloads the blob from the peer into the cache.
+func (c *peerCache) fetchPeer(ctx context.Context, peer, digest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/peer/blobs/"+digest, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(peerTokenHeader, c.peerToken(digest))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	_, err = c.store(resp.Body, digest, nil)
+	return err
+}
+
+// fetchUpstream streams the blob from the upstream registry to dockerd, with its credentials, and
+// caches it when it matches its digest. The errors of the registry, such as 401 Unauthorized, are
+// passed on to dockerd, which verifies the digest of the blob itself too.
+func (c *peerCache) fetchUpstream(w http.ResponseWriter, r *http.Request, digest string) {
+	u := *c.upstream
+	u.Path = r.URL.Path
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The Authorization header is dropped by the client when the registry redirects to a CDN.
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	n, err := c.store(resp.Body, digest, w)
+	if err != nil {
+		fmt.Println("caching blob from the registry failed", digest, err)
+		return
+	}
+	peerCacheBlobs.WithLabelValues("upstream").Inc()
+	peerCacheBytes.WithLabelValues("upstream").Add(float64(n))
+}
+
+// store writes the blob read from r to the cache, and to tee if it is not nil. The blob is only
+// added to the cache when it matches digest. It returns the size of the blob.
+func (c *peerCache) store(r io.Reader, digest string, tee io.Writer) (int64, error) {
+	tmp, err := os.CreateTemp(c.dir, ".download-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	dst := io.MultiWriter(tmp, h)
+	if tee != nil {
+		dst = io.MultiWriter(tmp, h, tee)
+	}
+	n, err := io.Copy(dst, r)
+	if err != nil {
+		return n, err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return n, fmt.Errorf("digest mismatch: got %s, want %s", got, digest)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmp.Name(), c.blobFile(digest)); err != nil {
+		return n, err
+	}
+	c.prune(c.maxBytes)
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+	return n, nil
+}
+
+// blobFile is the file of a blob in the cache.
+func (c *peerCache) blobFile(digest string) string {
+	return filepath.Join(c.dir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+// cachedBlob is a blob in the cache.
+type cachedBlob struct {
+	digest  string
+	size    int64
+	modTime time.Time
+}
+
+// blobs returns the blobs in the cache, the newest first.
+func (c *peerCache) blobs() []cachedBlob {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+	var blobs []cachedBlob
+	for _, e := range entries {
+		digest := "sha256:" + e.Name()
+		if !e.Type().IsRegular() || !validDigest(digest) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, cachedBlob{digest: digest, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].modTime.After(blobs[j].modTime) })
+	return blobs
+}
+
+// prune removes the oldest blobs until the cache is at most maxBytes.
+func (c *peerCache) prune(maxBytes int64) {
+	var total int64
+	for _, b := range c.blobs() {
+		total += b.size
+		if total > maxBytes {
+			_ = os.Remove(c.blobFile(b.digest))
+		}
+	}
+}
+
+// announce sends the announcements of the blobs in the cache to conn every peerAnnounceInterval,
+// and when a blob was added, until ctx is canceled.
+func (c *peerCache) announce(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := c.sendAnnouncements(conn); err != nil {
+			fmt.Println("announcing the peer cache failed", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.changed:
+		case <-time.After(peerAnnounceInterval):
+		}
+	}
+}
+
+// sendAnnouncements sends the newest maxAnnouncedBlobs blobs of the cache to conn, in as many
+// announcements as needed.
+func (c *peerCache) sendAnnouncements(conn net.Conn) error {
+	blobs := c.blobs()
+	if len(blobs) > maxAnnouncedBlobs {
+		blobs = blobs[:maxAnnouncedBlobs]
+	}
+	for i := 0; i < len(blobs); i += blobsPerAnnouncement {
+		a := peerAnnouncement{ID: c.id, Port: c.port}
+		for _, b := range blobs[i:min(i+blobsPerAnnouncement, len(blobs))] {
+			a.Blobs = append(a.Blobs, b.digest)
+		}
+		p, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discover records the blobs of the announcements of the peers received on conn until ctx is
+// canceled.
+func (c *peerCache) discover(ctx context.Context, conn net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("receiving peer announcements failed", err)
+			}
+			return
+		}
+		var a peerAnnouncement
+		if err := json.Unmarshal(buf[:n], &a); err != nil || a.ID == c.id || a.Port <= 0 || a.Port > 65535 {
+			continue
+		}
+		src, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		peer := "http://" + net.JoinHostPort(src.IP.String(), strconv.Itoa(a.Port))
+		now := time.Now()
+		c.peers.add(peer, a.Blobs, now, now.Add(3*peerAnnounceInterval))
+	}
+}
+
+// peerSet is the peers that announced each blob.
+type peerSet struct {
+	mu sync.Mutex
+	// blobs maps the digests to the peers and when they expire.
+	blobs map[string]map[string]time.Time
+}
+
+// add records that peer has the blobs until expires, and forgets the peers that expired before
+// now, so that the blobs of the machines that left the segment do not pile up.
+func (s *peerSet) add(peer string, blobs []string, now, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for digest, peers := range s.blobs {
+		for p, e := range peers {
+			if now.After(e) {
+				delete(peers, p)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.blobs, digest)
+		}
+	}
+	for _, digest := range blobs {
+		if !validDigest(digest) {
+			continue
+		}
+		if s.blobs[digest] == nil {
+			s.blobs[digest] = map[string]time.Time{}
+		}
+		s.blobs[digest][peer] = expires
+	}
+}
+
+// lookup returns the peers that have the blob at now, and forgets the expired ones.
+func (s *peerSet) lookup(digest string, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []string
+	for peer, expires := range s.blobs[digest] {
+		if now.After(expires) {
+			delete(s.blobs[digest], peer)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	if len(s.blobs[digest]) == 0 {
+		delete(s.blobs, digest)
+	}
+	sort.Strings(peers)
+	return peers
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeRegistry is an upstream registry serving blobs to clients with a token.
+type fakeRegistry struct {
+	mu    sync.Mutex
+	blobs map[string]string
+	// fetches counts the GETs of each blob.
+	fetches map[string]int
+}
+
+func newFakeRegistry(blobs ...string) *fakeRegistry {
+	r := &fakeRegistry{blobs: map[string]string{}, fetches: map[string]int{}}
+	for _, b := range blobs {
+		r.blobs[blobDigestOf(b)] = b
+	}
+	return r
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example/token",service="registry.example"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	digest, ok := blobDigest(r.URL.Path)
+	f.mu.Lock()
+	blob, found := f.blobs[digest]
+	if r.Method == http.MethodGet {
+		f.fetches[digest]++
+	}
+	f.mu.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = io.WriteString(w, blob)
+}
+
+func (f *fakeRegistry) fetched(digest string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[digest]
+}
+
+func blobDigestOf(blob string) string {
+	h := sha256.Sum256([]byte(blob))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// testPeerSecret is the shared secret of the peer caches of the tests.
+const testPeerSecret = "peer secret"
+
+func newTestPeerCache(t *testing.T, upstream string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *peerCache {
+	t.Helper()
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := newPeerCache(t.TempDir(), upstream, defaultPeerCachePort, testPeerSecret, defaultPeerCacheMaxMB<<20, "", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// getBlob GETs a blob of alpine from the mirror at url, like dockerd does.
+func getBlob(t *testing.T, client *http.Client, url, digest string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url+"/v2/library/alpine/blobs/"+digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestBlobDigest(t *testing.T) {
+	digest := blobDigestOf("layer")
+	tests := map[string]struct {
+		path   string
+		want   string
+		wantOK bool
+	}{
+		"blob":              {path: "/v2/library/alpine/blobs/" + digest, want: digest, wantOK: true},
+		"nested repository": {path: "/v2/tinkerbell/actions/blobs/blobs/" + digest, want: digest, wantOK: true},
+		"manifest":          {path: "/v2/library/alpine/manifests/latest"},
+		"no repository":     {path: "/v2/blobs/" + digest},
+		"upload":            {path: "/v2/library/alpine/blobs/uploads/", want: "uploads/"},
+		"sha512":            {path: "/v2/library/alpine/blobs/sha512:" + strings.Repeat("ab", 64), want: "sha512:" + strings.Repeat("ab", 64)},
+		"upper case":        {path: "/v2/library/alpine/blobs/" + strings.ToUpper(digest), want: strings.ToUpper(digest)},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := blobDigest(tt.path)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPeerCache(t *testing.T) {
+	layer, corrupted, private := "a layer of alpine", "a corrupted layer", "a layer of the peer only"
+	registry := newFakeRegistry(layer, corrupted)
+	// The registry serves another blob than the digest of corrupted.
+	registry.blobs[blobDigestOf(corrupted)] = "not " + corrupted
+	upstream := httptest.NewServer(registry)
+	t.Cleanup(upstream.Close)
+
+	a := newTestPeerCache(t, upstream.URL, nil)
+	mirrorA := httptest.NewServer(a)
+	t.Cleanup(mirrorA.Close)
+	b := newTestPeerCache(t, upstream.URL, nil)
+	mirrorB := httptest.NewServer(b)
+	t.Cleanup(mirrorB.Close)
+	// liar announces every blob and serves garbage.
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "garbage")
+	}))
+	t.Cleanup(liar.Close)
+	if _, err := a.store(strings.NewReader(private), blobDigestOf(private), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fetches the layer from the registry and caches it.
+	if code, got := getBlob(t, mirrorA.Client(), mirrorA.URL, blobDigestOf(layer)); code != http.StatusOK || got != layer {
+		t.Fatalf("got %d %q from A, want the layer", code, got)
+	}
+	if _, err := os.Stat(a.blobFile(blobDigestOf(layer))); err != nil {
+		t.Errorf("the layer is not in the cache of A: %v", err)
+	}
+
+	// B fetches the blobs announced by A from A, skipping the liar.
+	all := []string{blobDigestOf(layer), blobDigestOf(private), blobDigestOf(corrupted)}
+	b.peers.add(liar.URL, all, time.Now(), time.Now().Add(time.Minute))
+	b.peers.add(mirrorA.URL, all, time.Now(), time.Now().Add(time.Minute))
+	for _, blob := range []string{layer, private} {
+		if code, got := getBlob(t, mirrorB.Client(), mirrorB.URL, blobDigestOf(blob)); code != http.StatusOK || got != blob {
+			t.Errorf("got %d %q from B, want %q", code, got, blob)
+		}
+	}
+	if n := registry.fetched(blobDigestOf(layer)); n != 1 {
+		t.Errorf("the registry served the layer %d times, want 1", n)
+	}
+
+	// A blob that does not match its digest is passed on, for dockerd to reject it, but not cached.
+	if _, got := getBlob(t, mirrorB.Client(), mirrorB.URL, blobDigestOf(corrupted)); got != "not "+corrupted {
+		t.Errorf("got %q from B, want the blob of the registry", got)
+	}
+	if _, err := os.Stat(b.blobFile(blobDigestOf(corrupted))); err == nil {
+		t.Error("the corrupted blob is in the cache of B")
+	}
+
+	// The errors of the registry are passed on to dockerd.
+	resp, err := http.Get(mirrorB.URL + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("got %s with WWW-Authenticate %q from /v2/, want the challenge of the registry", resp.Status, resp.Header.Get("WWW-Authenticate"))
+	}
+	if code, _ := getBlob(t, mirrorB.Client(), mirrorB.URL, blobDigestOf("missing")); code != http.StatusNotFound {
+		t.Errorf("got %d for a missing blob, want %d", code, http.StatusNotFound)
+	}
+
+	// The peers are only served from the cache, and need the token of the shared secret.
+	other := newTestPeerCache(t, upstream.URL, nil)
+	other.secret = []byte("another secret")
+	tests := map[string]struct {
+		digest string
+		token  string
+		want   int
+	}{
+		"cached":         {digest: blobDigestOf(layer), token: b.peerToken(blobDigestOf(layer)), want: http.StatusOK},
+		"missing":        {digest: blobDigestOf("missing"), token: b.peerToken(blobDigestOf("missing")), want: http.StatusNotFound},
+		"path traversal": {digest: "sha256:..%2F..%2Fetc", token: b.peerToken("sha256:../../etc"), want: http.StatusNotFound},
+		"no token":       {digest: blobDigestOf(layer), want: http.StatusForbidden},
+		"other secret":   {digest: blobDigestOf(layer), token: other.peerToken(blobDigestOf(layer)), want: http.StatusForbidden},
+		"other blob":     {digest: blobDigestOf(layer), token: b.peerToken(blobDigestOf(private)), want: http.StatusForbidden},
+	}
+	for name, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, mirrorB.URL+"/peer/blobs/"+tt.digest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(peerTokenHeader, tt.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %s for the blob of a peer, want %d", name, resp.Status, tt.want)
+		}
+	}
+}
+
+func TestPeerCacheLoopback(t *testing.T) {
+	c := newTestPeerCache(t, "http://registry.example", nil)
+	digest := blobDigestOf("layer")
+	if _, err := c.store(strings.NewReader("layer"), digest, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		remoteAddr string
+		want       int
+	}{
+		"IPv4 loopback":        {remoteAddr: "127.0.0.1:40000", want: http.StatusOK},
+		"IPv6 loopback":        {remoteAddr: "[::1]:40000", want: http.StatusOK},
+		"IPv4-mapped loopback": {remoteAddr: "[::ffff:127.0.0.1]:40000", want: http.StatusOK},
+		"peer":                 {remoteAddr: "192.0.2.1:40000", want: http.StatusForbidden},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerCachePrune(t *testing.T) {
+	c := newTestPeerCache(t, "http://registry.example", nil)
+	blobs := []string{"oldest blob", "older blob", "newest blob"}
+	for i, blob := range blobs {
+		if _, err := c.store(strings.NewReader(blob), blobDigestOf(blob), nil); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i-len(blobs)) * time.Minute)
+		if err := os.Chtimes(c.blobFile(blobDigestOf(blob)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.prune(int64(len("older blob") + len("newest blob")))
+
+	var got []string
+	for _, b := range c.blobs() {
+		got = append(got, b.digest)
+	}
+	want := []string{blobDigestOf("newest blob"), blobDigestOf("older blob")}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPeerSet(t *testing.T) {
+	now := time.Now()
+	digest := blobDigestOf("layer")
+	s := &peerSet{blobs: map[string]map[string]time.Time{}}
+	s.add("http://192.0.2.1:5050", []string{digest, "not a digest"}, now, now.Add(time.Minute))
+	s.add("http://192.0.2.2:5050", []string{digest}, now, now.Add(time.Second))
+
+	if got, want := s.lookup(digest, now), []string{"http://192.0.2.1:5050", "http://192.0.2.2:5050"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.lookup(digest, now.Add(10*time.Second)), []string{"http://192.0.2.1:5050"}; !slices.Equal(got, want) {
+		t.Errorf("got %v after the second peer expired, want %v", got, want)
+	}
+	if got := s.lookup("not a digest", now); got != nil {
+		t.Errorf("got %v for an invalid digest, want none", got)
+	}
+	s.lookup(digest, now.Add(time.Hour))
+	if len(s.blobs) != 0 {
+		t.Errorf("got %v after all peers expired, want none", s.blobs)
+	}
+
+	// The expired peers are also forgotten when an announcement is recorded, without a lookup.
+	other := blobDigestOf("other layer")
+	s.add("http://192.0.2.1:5050", []string{digest}, now, now.Add(time.Minute))
+	s.add("http://192.0.2.3:5050", []string{other}, now.Add(time.Hour), now.Add(time.Hour+time.Minute))
+	if _, ok := s.blobs[digest]; ok || len(s.blobs[other]) != 1 {
+		t.Errorf("got %v after an announcement, want only the peer of the other layer", s.blobs)
+	}
+}
+
+func TestPeerAnnouncements(t *testing.T) {
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, err := net.Dial("udp4", recv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { send.Close() })
+
+	a := newTestPeerCache(t, "http://registry.example", nil)
+	a.port = 6060
+	b := newTestPeerCache(t, "http://registry.example", nil)
+	var want []string
+	for i := range blobsPerAnnouncement + 1 {
+		blob := fmt.Sprintf("layer %d", i)
+		if _, err := a.store(strings.NewReader(blob), blobDigestOf(blob), nil); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, blobDigestOf(blob))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go b.discover(ctx, recv)
+	// B ignores its own announcements.
+	if err := b.sendAnnouncements(send); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.store(strings.NewReader("layer of B"), blobDigestOf("layer of B"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sendAnnouncements(send); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sendAnnouncements(send); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return len(b.peers.lookup(want[0], time.Now())) > 0 && len(b.peers.lookup(want[len(want)-1], time.Now())) > 0
+	})
+	for _, digest := range want {
+		if got := b.peers.lookup(digest, time.Now()); !slices.Equal(got, []string{"http://127.0.0.1:6060"}) {
+			t.Errorf("got peers %v of %s, want A", got, digest)
+		}
+	}
+	if got := b.peers.lookup(blobDigestOf("layer of B"), time.Now()); got != nil {
+		t.Errorf("got peers %v of the own blob, want none", got)
+	}
+}
+
+// waitFor waits up to 10 seconds for cond to be true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPeerCacheNetns runs two peer caches in network namespaces connected by a veth pair, like two
+// HookOS machines on the same L2. It needs root and iproute2.
+func TestPeerCacheNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create network namespaces")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs ip to create network namespaces")
+	}
+	nsA, nsB := fmt.Sprintf("hook-peer-a-%d", os.Getpid()), fmt.Sprintf("hook-peer-b-%d", os.Getpid())
+	ip := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	for _, ns := range []string{nsA, nsB} {
+		if out, err := exec.Command("ip", "netns", "add", ns).CombinedOutput(); err != nil {
+			t.Skipf("creating a network namespace failed: %v: %s", err, out)
+		}
+		t.Cleanup(func() { _ = exec.Command("ip", "netns", "delete", ns).Run() })
+	}
+	ip("link", "add", "veth0", "netns", nsA, "type", "veth", "peer", "name", "veth0", "netns", nsB)
+	for ns, addr := range map[string]string{nsA: "10.231.0.1/24", nsB: "10.231.0.2/24"} {
+		ip("-n", ns, "addr", "add", addr, "dev", "veth0")
+		ip("-n", ns, "link", "set", "veth0", "up")
+		ip("-n", ns, "link", "set", "lo", "up")
+		ip("-n", ns, "route", "add", "224.0.0.0/4", "dev", "veth0")
+	}
+
+	// The registry is in the namespace of A, and reachable from B over the veth pair.
+	layer := "a layer of alpine"
+	registry := newFakeRegistry(layer)
+	var upstream net.Listener
+	if err := inNetns(nsA, func() (err error) {
+		upstream, err = net.Listen("tcp4", "10.231.0.1:0")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	registrySrv := &http.Server{Handler: registry}
+	go func() { _ = registrySrv.Serve(upstream) }()
+	t.Cleanup(func() { registrySrv.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	// dialIn dials from ns, for the caches and the dockerd of each namespace.
+	dialIn := func(ns string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+			if nerr := inNetns(ns, func() error {
+				conn, err = (&net.Dialer{}).DialContext(ctx, network, addr)
+				return nil
+			}); nerr != nil {
+				return nil, nerr
+			}
+			return conn, err
+		}
+	}
+	caches := map[string]*peerCache{}
+	for _, ns := range []string{nsA, nsB} {
+		c := newTestPeerCache(t, "http://"+upstream.Addr().String(), dialIn(ns))
+		var ln net.Listener
+		var recv, send *net.UDPConn
+		if err := inNetns(ns, func() (err error) {
+			if ln, err = net.Listen("tcp4", fmt.Sprintf(":%d", c.port)); err != nil {
+				return err
+			}
+			recv, send = joinPeerGroup(ctx)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: c}
+		go func() { _ = srv.Serve(ln) }()
+		t.Cleanup(func() { srv.Close() })
+		go c.discover(ctx, recv)
+		go c.announce(ctx, send)
+		caches[ns] = c
+	}
+
+	mirror := fmt.Sprintf("http://127.0.0.1:%d", defaultPeerCachePort)
+	clientIn := func(ns string) *http.Client {
+		return &http.Client{Transport: &http.Transport{DialContext: dialIn(ns)}}
+	}
+	if code, got := getBlob(t, clientIn(nsA), mirror, blobDigestOf(layer)); code != http.StatusOK || got != layer {
+		t.Fatalf("got %d %q from A, want the layer", code, got)
+	}
+	// A announces the layer as soon as it is cached.
+	waitFor(t, func() bool { return len(caches[nsB].peers.lookup(blobDigestOf(layer), time.Now())) > 0 })
+	if got, want := caches[nsB].peers.lookup(blobDigestOf(layer), time.Now()), []string{fmt.Sprintf("http://10.231.0.1:%d", defaultPeerCachePort)}; !slices.Equal(got, want) {
+		t.Errorf("got peers %v of the layer in B, want %v", got, want)
+	}
+	if code, got := getBlob(t, clientIn(nsB), mirror, blobDigestOf(layer)); code != http.StatusOK || got != layer {
+		t.Fatalf("got %d %q from B, want the layer", code, got)
+	}
+	if n := registry.fetched(blobDigestOf(layer)); n != 1 {
+		t.Errorf("the registry served the layer %d times, want 1", n)
+	}
+}
+
+// inNetns runs f in the network namespace ns. The sockets created by f stay in ns.
+func inNetns(ns string, f func() error) error {
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	target, err := os.Open("/var/run/netns/" + ns)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	ferr := f()
+	// The thread is left locked, and so discarded, if it cannot go back to its namespace.
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		return err
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/distribution/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// embeddedImage is an image of the embedded image manifest that BootKit verifies the image store
+// against, in the format of pull-images.sh.
+type embeddedImage struct {
+	Reference string `json:"reference"`
+	// Digest is the image ID, the digest of the image config.
+	Digest string `json:"digest"`
+}
+
+// dockerManifest is an image of the manifest.json of docker save.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// archiveBlob is a blob of the archive, read with open.
+type archiveBlob struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// archive is an image archive that is both an OCI image layout and a docker save archive, like
+// the archives of docker save since Docker 25, so that docker load, podman load and containerd
+// import it. Every blob is stored once, even when it is shared by several images.
+type archive struct {
+	blobs     map[v1.Hash]archiveBlob
+	index     []v1.Descriptor
+	manifests []dockerManifest
+	images    []embeddedImage
+	// zstdDir is where the layers recompressed with zstd are written; empty keeps the layers as
+	// they are.
+	zstdDir string
+	// recompressed are the zstd layers by the digest of the original layer.
+	recompressed map[v1.Hash]v1.Descriptor
+}
+
+// newArchive returns an empty archive. With a zstdDir, the layers that are not compressed with
+// zstd yet are recompressed into it.
+func newArchive(zstdDir string) *archive {
+	return &archive{
+		blobs:        map[v1.Hash]archiveBlob{},
+		zstdDir:      zstdDir,
+		recompressed: map[v1.Hash]v1.Descriptor{},
+	}
+}
+
+// add adds img to the archive as the normalized references refs.
+func (a *archive) add(img v1.Image, refs []string) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	a.addBytes(configName, rawConfig)
+
+	converted := false
+	layers := make([]string, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if a.zstdDir != "" && desc.MediaType != types.OCILayerZStd && desc.MediaType.IsDistributable() {
+			if desc, err = a.recompress(layer, desc); err != nil {
+				return fmt.Errorf("recompressing the layer %s failed: %w", manifest.Layers[i].Digest, err)
+			}
+			manifest.Layers[i] = desc
+			converted = true
+		} else {
+			a.blobs[desc.Digest] = archiveBlob{size: desc.Size, open: layer.Compressed}
+		}
+		layers[i] = blobPath(desc.Digest)
+	}
+	if converted {
+		// The zstd layers are only valid in OCI manifests. The config is the same, and so is the
+		// image ID.
+		manifest.MediaType = types.OCIManifestSchema1
+		manifest.Config.MediaType = types.OCIConfigJSON
+		if rawManifest, err = json.Marshal(manifest); err != nil {
+			return err
+		}
+	}
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return err
+	}
+	a.addBytes(manifestDigest, rawManifest)
+
+	dm := dockerManifest{Config: blobPath(configName), RepoTags: []string{}, Layers: layers}
+	for _, ref := range refs {
+		desc := v1.Descriptor{
+			MediaType:   manifest.MediaType,
+			Size:        int64(len(rawManifest)),
+			Digest:      manifestDigest,
+			Annotations: map[string]string{annotationImageName: ref},
+		}
+		if desc.MediaType == "" {
+			desc.MediaType = types.OCIManifestSchema1
+		}
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return err
+		}
+		// Images can only be tagged, not named by their digest, in docker save archives.
+		if tagged, ok := named.(reference.NamedTagged); ok {
+			desc.Annotations[annotationRefName] = tagged.Tag()
+			dm.RepoTags = append(dm.RepoTags, reference.FamiliarString(tagged))
+		}
+		a.index = append(a.index, desc)
+		a.images = append(a.images, embeddedImage{Reference: ref, Digest: configName.String()})
+	}
+	a.manifests = append(a.manifests, dm)
+	return nil
+}
+
+// addBytes adds the blob b with digest h.
+func (a *archive) addBytes(h v1.Hash, b []byte) {
+	a.blobs[h] = archiveBlob{size: int64(len(b)), open: func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}}
+}
+
+// recompress adds the layer of desc compressed with zstd, and returns its descriptor. The
+// encoder runs on a single goroutine, so that the output is the same at every build.
+func (a *archive) recompress(layer v1.Layer, desc v1.Descriptor) (v1.Descriptor, error) {
+	if d, ok := a.recompressed[desc.Digest]; ok {
+		return d, nil
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(a.zstdDir, "layer-*")
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer tmp.Close()
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, h)}
+	enc, err := zstd.NewWriter(counter, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if _, err := io.Copy(enc, rc); err != nil {
+		enc.Close()
+		return v1.Descriptor{}, err
+	}
+	if err := enc.Close(); err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return v1.Descriptor{}, err
+	}
+	digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+	file := filepath.Join(a.zstdDir, digest.Hex)
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return v1.Descriptor{}, err
+	}
+	d := v1.Descriptor{MediaType: types.OCILayerZStd, Size: counter.n, Digest: digest}
+	a.blobs[digest] = archiveBlob{size: counter.n, open: func() (io.ReadCloser, error) { return os.Open(file) }}
+	a.recompressed[desc.Digest] = d
+	return d, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// blobPath is the path of a blob in an OCI image layout.
+func blobPath(h v1.Hash) string {
+	return path.Join("blobs", h.Algorithm, h.Hex)
+}
+
+// writeTo writes the archive to w. The archive only depends on the images and mtime: the blobs are
+// sorted by digest, and the files have the same owner, mode and modification time mtime.
+func (a *archive) writeTo(w io.Writer, mtime time.Time) error {
+	tw := tar.NewWriter(w)
+	header := func(name string, typ byte, size int64) *tar.Header {
+		mode := int64(0o644)
+		if typ == tar.TypeDir {
+			mode = 0o755
+		}
+		return &tar.Header{Typeflag: typ, Name: name, Size: size, Mode: mode, ModTime: mtime.UTC().Truncate(time.Second), Format: tar.FormatPAX}
+	}
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(header(dir, tar.TypeDir, 0)); err != nil {
+			return err
+		}
+	}
+	digests := make([]v1.Hash, 0, len(a.blobs))
+	for h := range a.blobs {
+		digests = append(digests, h)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].String() < digests[j].String() })
+	for _, h := range digests {
+		b := a.blobs[h]
+		if err := tw.WriteHeader(header(blobPath(h), tar.TypeReg, b.size)); err != nil {
+			return err
+		}
+		if err := copyBlob(tw, h, b); err != nil {
+			return fmt.Errorf("writing the blob %s failed: %w", h, err)
+		}
+	}
+
+	index, err := json.Marshal(v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: a.index})
+	if err != nil {
+		return err
+	}
+	manifests, err := json.Marshal(a.manifests)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{
+		{"index.json", index},
+		{"manifest.json", manifests},
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+	} {
+		if err := tw.WriteHeader(header(f.name, tar.TypeReg, int64(len(f.b)))); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.b); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyBlob copies the blob b to w, and verifies its size and digest h.
+func copyBlob(w io.Writer, h v1.Hash, b archiveBlob) error {
+	if h.Algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s", h.Algorithm)
+	}
+	rc, err := b.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, sum), io.LimitReader(rc, b.size+1))
+	if err != nil {
+		return err
+	}
+	if n != b.size {
+		return fmt.Errorf("size mismatch: got %d bytes, want %d", n, b.size)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != h.Hex {
+		return fmt.Errorf("digest mismatch: got sha256:%s", got)
+	}
+	return nil
+}
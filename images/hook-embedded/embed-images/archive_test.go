@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testImages pushes the images of images.txt to an in-memory registry and an OCI image layout, and
+// returns the images.txt, the references the images are embedded as, in order, and the images by
+// reference.
+func testImages(t *testing.T) (string, []string, map[string]v1.Image) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// worker shares the layers of base.
+	worker, err := mutate.AppendLayers(base, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: base, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	push := func(ref string, img remote.Taggable) {
+		r, err := name.ParseReference(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch img := img.(type) {
+		case v1.Image:
+			err = remote.Write(r, img)
+		case v1.ImageIndex:
+			err = remote.WriteIndex(r, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	push(host+"/library/base:v1", multi)
+	push(host+"/tinkerbell/tink-worker:v0.10.0", worker)
+
+	action, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "layout")
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(action, layout.WithAnnotations(map[string]string{annotationRefName: "v1"})); err != nil {
+		t.Fatal(err)
+	}
+
+	images := host + "/library/base:v1\n" +
+		host + "/tinkerbell/tink-worker:v0.10.0 tink-worker:v0.10.0\n" +
+		"oci:" + dir + ":v1 127.0.0.1/embedded/actions/cexec true\n"
+	refs := []string{host + "/library/base:v1", "docker.io/library/tink-worker:v0.10.0", host + "/tinkerbell/tink-worker:v0.10.0", "127.0.0.1/embedded/actions/cexec:latest"}
+	return images, refs, map[string]v1.Image{
+		host + "/library/base:v1":                 base,
+		"docker.io/library/tink-worker:v0.10.0":   worker,
+		host + "/tinkerbell/tink-worker:v0.10.0":  worker,
+		"127.0.0.1/embedded/actions/cexec:latest": action,
+	}
+}
+
+// embed runs embed-images and returns the output directory.
+func embed(t *testing.T, images string, compress bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	imagesFile := filepath.Join(dir, "images.txt")
+	if err := os.WriteFile(imagesFile, []byte(images), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "images")
+	if err := run(context.Background(), imagesFile, "linux/amd64", output, compress); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// readArchive returns the files of the archive.
+func readArchive(t *testing.T, file string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.ModTime.Unix() != 0 {
+			t.Errorf("%s has the owner %d:%d and modification time %v, want 0:0 and the Unix epoch", hdr.Name, hdr.Uid, hdr.Gid, hdr.ModTime)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	images, refs, want := testImages(t)
+
+	for mode, compress := range map[string]bool{"as is": false, "zstd": true} {
+		t.Run(mode, func(t *testing.T) {
+			output := embed(t, images, compress)
+			archive := filepath.Join(output, archiveFile)
+			b, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(b)
+			checksum, err := os.ReadFile(archive + ".sha256")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := hex.EncodeToString(sum[:]) + "  " + archiveFile + "\n"; string(checksum) != want {
+				t.Errorf("got checksum %q, want %q", checksum, want)
+			}
+
+			// The archive is reproducible.
+			again, err := os.ReadFile(filepath.Join(embed(t, images, compress), archiveFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, again) {
+				t.Error("the archives of the same images differ")
+			}
+
+			// The embedded image manifest has the image IDs of the images.
+			var manifest []embeddedImage
+			b, err = os.ReadFile(filepath.Join(output, manifestFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			wantManifest := []embeddedImage{}
+			for _, ref := range refs {
+				id, err := want[ref].ConfigName()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantManifest = append(wantManifest, embeddedImage{Reference: ref, Digest: id.String()})
+			}
+			if diff := cmp.Diff(wantManifest, manifest); diff != "" {
+				t.Errorf("embedded image manifest: %s", diff)
+			}
+
+			// The blobs shared by base and tink-worker are stored once: the 3 configs and manifests,
+			// the 2 layers of base, the layer of tink-worker and the layer of cexec.
+			files := readArchive(t, archive)
+			var blobs int
+			for f := range files {
+				if strings.HasPrefix(f, "blobs/sha256/") && f != "blobs/sha256/" {
+					blobs++
+				}
+			}
+			if blobs != 10 {
+				t.Errorf("got %d blobs, want 10", blobs)
+			}
+
+			// docker load reads manifest.json, and containerd index.json.
+			for ref, img := range want {
+				wantID, err := img.ConfigName()
+				if err != nil {
+					t.Fatal(err)
+				}
+				tag, err := name.NewTag(ref)
+				if err != nil {
+					t.Fatal(err)
+				}
+				loaded, err := tarball.ImageFromPath(archive, &tag)
+				if err != nil {
+					t.Fatalf("docker save image %s: %v", ref, err)
+				}
+				checkImage(t, loaded, wantID, compress)
+			}
+			dir := t.TempDir()
+			for f, b := range files {
+				if strings.HasSuffix(f, "/") {
+					continue
+				}
+				if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, f), b, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for ref, img := range want {
+				wantID, err := img.ConfigName()
+				if err != nil {
+					t.Fatal(err)
+				}
+				loaded, err := layoutImage(dir+":"+ref, v1.Platform{OS: "linux", Architecture: "amd64"})
+				if err != nil {
+					t.Fatalf("OCI image %s: %v", ref, err)
+				}
+				checkImage(t, loaded, wantID, compress)
+			}
+		})
+	}
+}
+
+// checkImage checks that img has the image ID wantID, and layers that match the diff IDs of its
+// config, compressed with zstd if compressed.
+func checkImage(t *testing.T, img v1.Image, wantID v1.Hash, compressed bool) {
+	t.Helper()
+	id, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != wantID {
+		t.Errorf("got image ID %s, want %s", id, wantID)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != len(cfg.RootFS.DiffIDs) {
+		t.Fatalf("got %d layers, want %d", len(layers), len(cfg.RootFS.DiffIDs))
+	}
+	for i, l := range layers {
+		if compressed {
+			c, err := l.Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			magic := make([]byte, 4)
+			_, err = io.ReadFull(c, magic)
+			c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+				t.Errorf("layer %d is not compressed with zstd", i)
+			}
+		}
+		rc, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffID, _, err := v1.SHA256(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diffID != cfg.RootFS.DiffIDs[i] {
+			t.Errorf("layer %d has the diff ID %s, want %s", i, diffID, cfg.RootFS.DiffIDs[i])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ociPrefix marks the sources of images.txt that are OCI image layouts, as oci:DIR, oci:DIR:NAME
+// or oci:DIR@DIGEST.
+const ociPrefix = "oci:"
+
+// annotationImageName is the full reference of an image in the index of an image layout, as
+// written by containerd and docker save. annotationRefName is the tag.
+const (
+	annotationImageName = "io.containerd.image.name"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+)
+
+// imageSpec is a line of images.txt, in the format of pull-images.sh: the source image, an
+// optional additional tag of the image, and whether only the additional tag is embedded.
+type imageSpec struct {
+	source         string
+	tag            string
+	removeOriginal bool
+}
+
+// parseImagesFile parses images.txt. Empty lines and comments are skipped.
+func parseImagesFile(r io.Reader) ([]imageSpec, error) {
+	var specs []imageSpec
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: too many fields, want <source image> [<additional tag> [<remove original tag>]]", n)
+		}
+		spec := imageSpec{source: fields[0]}
+		if len(fields) > 1 {
+			spec.tag = fields[1]
+		}
+		if len(fields) > 2 {
+			if fields[2] != "true" && fields[2] != "false" {
+				return nil, fmt.Errorf("line %d: invalid remove original tag %q, must be true or false", n, fields[2])
+			}
+			spec.removeOriginal = fields[2] == "true"
+		}
+		if _, err := spec.references(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, s.Err()
+}
+
+// references returns the normalized references the image is embedded as. An image of an OCI
+// image layout is only embedded as its additional tag.
+func (s imageSpec) references() ([]string, error) {
+	var refs []string
+	switch {
+	case strings.HasPrefix(s.source, ociPrefix):
+		if s.tag == "" {
+			return nil, fmt.Errorf("the image of the OCI image layout %s needs an additional tag", s.source)
+		}
+		refs = []string{s.tag}
+	case s.tag == "":
+		refs = []string{s.source}
+	case s.removeOriginal:
+		refs = []string{s.tag}
+	default:
+		refs = []string{s.tag, s.source}
+	}
+	for i, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image reference %q: %w", ref, err)
+		}
+		refs[i] = reference.TagNameOnly(named).String()
+	}
+	return refs, nil
+}
+
+// fetch returns the image of the source for platform, from its registry or OCI image layout.
+func (s imageSpec) fetch(ctx context.Context, platform v1.Platform) (v1.Image, error) {
+	if dir, ok := strings.CutPrefix(s.source, ociPrefix); ok {
+		return layoutImage(dir, platform)
+	}
+	ref, err := name.ParseReference(s.source)
+	if err != nil {
+		return nil, err
+	}
+	return remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithPlatform(platform))
+}
+
+// layoutImage returns the image for platform of the OCI image layout of spec, which is DIR,
+// DIR:NAME to select the image by its name or tag, or DIR@DIGEST to select it by its digest.
+// Without a name or digest, the layout must have a single image or index.
+func layoutImage(spec string, platform v1.Platform) (v1.Image, error) {
+	dir, want := spec, ""
+	// The name can be a full image reference, with slashes and a tag, so the directory ends at the
+	// first separator, unless the whole spec is a directory.
+	if _, err := os.Stat(filepath.Join(spec, "index.json")); err != nil {
+		if i := strings.IndexAny(spec, ":@"); i >= 0 {
+			dir, want = spec[:i], spec[i+1:]
+		}
+	}
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading the OCI image layout %s failed: %w", dir, err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var found []v1.Descriptor
+	for _, d := range m.Manifests {
+		if want == "" || d.Digest.String() == want || d.Annotations[annotationRefName] == want || d.Annotations[annotationImageName] == want {
+			found = append(found, d)
+		}
+	}
+	if len(found) != 1 {
+		return nil, fmt.Errorf("%d images of the OCI image layout %s match %q, want 1", len(found), dir, want)
+	}
+	return platformImage(idx, found[0], platform)
+}
+
+// platformImage returns the image of d in idx, or when d is an index, its image for platform.
+func platformImage(idx v1.ImageIndex, d v1.Descriptor, platform v1.Platform) (v1.Image, error) {
+	if d.MediaType.IsImage() {
+		return idx.Image(d.Digest)
+	}
+	if !d.MediaType.IsIndex() {
+		return nil, fmt.Errorf("%s has the unsupported media type %s", d.Digest, d.MediaType)
+	}
+	child, err := idx.ImageIndex(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	m, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range m.Manifests {
+		if c.Platform != nil && c.Platform.Satisfies(platform) {
+			return platformImage(child, c, platform)
+		}
+	}
+	return nil, fmt.Errorf("the index %s has no image for %s", d.Digest, platform)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestParseImagesFile(t *testing.T) {
+	tests := map[string]struct {
+		images  string
+		want    []imageSpec
+		wantErr bool
+	}{
+		"example": {
+			images: "# comment\n\nquay.io/tinkerbell/tink-worker:v0.10.0\n" +
+				"quay.io/tinkerbell/tink-worker:v0.10.0 tink-worker:v0.10.0 true\n" +
+				"quay.io/tinkerbell/actions/image2disk embedded/actions/image2disk\n" +
+				"oci:layouts/cexec:v1 127.0.0.1/embedded/actions/cexec false\n",
+			want: []imageSpec{
+				{source: "quay.io/tinkerbell/tink-worker:v0.10.0"},
+				{source: "quay.io/tinkerbell/tink-worker:v0.10.0", tag: "tink-worker:v0.10.0", removeOriginal: true},
+				{source: "quay.io/tinkerbell/actions/image2disk", tag: "embedded/actions/image2disk"},
+				{source: "oci:layouts/cexec:v1", tag: "127.0.0.1/embedded/actions/cexec"},
+			},
+		},
+		"too many fields":        {images: "alpine alpine:3.20 true extra\n", wantErr: true},
+		"invalid remove":         {images: "alpine alpine:3.20 yes\n", wantErr: true},
+		"invalid reference":      {images: "Alpine\n", wantErr: true},
+		"OCI layout without tag": {images: "oci:layouts/cexec\n", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseImagesFile(strings.NewReader(tt.images))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(imageSpec{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestImageSpecReferences(t *testing.T) {
+	tests := map[string]struct {
+		spec imageSpec
+		want []string
+	}{
+		"source":          {spec: imageSpec{source: "alpine"}, want: []string{"docker.io/library/alpine:latest"}},
+		"additional tag":  {spec: imageSpec{source: "quay.io/tinkerbell/tink-worker:v0.10.0", tag: "tink-worker:v0.10.0"}, want: []string{"docker.io/library/tink-worker:v0.10.0", "quay.io/tinkerbell/tink-worker:v0.10.0"}},
+		"remove original": {spec: imageSpec{source: "quay.io/tinkerbell/actions/cexec", tag: "127.0.0.1/embedded/actions/cexec", removeOriginal: true}, want: []string{"127.0.0.1/embedded/actions/cexec:latest"}},
+		"OCI layout":      {spec: imageSpec{source: "oci:layouts/cexec", tag: "127.0.0.1/embedded/actions/cexec:v1"}, want: []string{"127.0.0.1/embedded/actions/cexec:v1"}},
+		"digest":          {spec: imageSpec{source: "alpine@sha256:" + strings.Repeat("ab", 32)}, want: []string{"docker.io/library/alpine@sha256:" + strings.Repeat("ab", 32)}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.spec.references()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLayoutImage(t *testing.T) {
+	amd64, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendIndex(multi, layout.WithAnnotations(map[string]string{annotationRefName: "multi"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(single, layout.WithAnnotations(map[string]string{annotationImageName: "quay.io/tinkerbell/single:v1"})); err != nil {
+		t.Fatal(err)
+	}
+	digest := func(img v1.Image) string {
+		h, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.String()
+	}
+
+	tests := map[string]struct {
+		spec     string
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		"tag amd64":      {spec: dir + ":multi", platform: "linux/amd64", want: digest(amd64)},
+		"tag arm64":      {spec: dir + ":multi", platform: "linux/arm64", want: digest(arm64)},
+		"image name":     {spec: dir + ":quay.io/tinkerbell/single:v1", platform: "linux/amd64", want: digest(single)},
+		"digest":         {spec: dir + "@" + digest(single), platform: "linux/arm64", want: digest(single)},
+		"no platform":    {spec: dir + ":multi", platform: "linux/riscv64", wantErr: true},
+		"ambiguous":      {spec: dir, platform: "linux/amd64", wantErr: true},
+		"no such image":  {spec: dir + ":missing", platform: "linux/amd64", wantErr: true},
+		"no such layout": {spec: t.TempDir(), platform: "linux/amd64", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			platform, err := v1.ParsePlatform(tt.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := layoutImage(tt.spec, *platform)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && digest(img) != tt.want {
+				t.Errorf("got image %s, want %s", digest(img), tt.want)
+			}
+		})
+	}
+}
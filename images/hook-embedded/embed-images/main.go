@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// archiveFile is the image archive BootKit imports into the image store of hook-docker at boot.
+	archiveFile = "embedded-images.tar"
+	// manifestFile is the embedded image manifest BootKit verifies the image store against.
+	manifestFile = "embedded-images.json"
+)
+
+// embed-images builds the embedded images of HookOS from registries and OCI image layouts, without
+// a Docker daemon. It writes to the output directory the image archive, with its checksum in the
+// sha256sum format, and the embedded image manifest.
+//
+// The archive is reproducible: the same images give the same archive, with the modification times
+// of SOURCE_DATE_EPOCH, or of the Unix epoch when it is not set.
+func main() {
+	images := flag.String("images", "images.txt", "the images to embed, in the format of images.txt.example")
+	platform := flag.String("platform", "linux/amd64", "the platform of the images, such as linux/arm64")
+	output := flag.String("output", "images", "the directory to write "+archiveFile+" and "+manifestFile+" to")
+	compress := flag.Bool("zstd", false, "recompress the layers with zstd")
+	flag.Parse()
+
+	if err := run(context.Background(), *images, *platform, *output, *compress); err != nil {
+		fmt.Println("error embedding images:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, imagesFile, platform, output string, compress bool) error {
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return err
+	}
+	mtime, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(imagesFile)
+	if err != nil {
+		return err
+	}
+	specs, err := parseImagesFile(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", imagesFile, err)
+	}
+
+	var zstdDir string
+	if compress {
+		if zstdDir, err = os.MkdirTemp("", "embed-images-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(zstdDir)
+	}
+	a := newArchive(zstdDir)
+	for _, spec := range specs {
+		refs, err := spec.references()
+		if err != nil {
+			return err
+		}
+		img, err := spec.fetch(ctx, *p)
+		if err != nil {
+			return fmt.Errorf("fetching %s failed: %w", spec.source, err)
+		}
+		if err := a.add(img, refs); err != nil {
+			return fmt.Errorf("adding %s failed: %w", spec.source, err)
+		}
+		fmt.Println("embedding", spec.source, "as", refs)
+	}
+	return write(a, output, mtime)
+}
+
+// write writes the archive, its checksum and the embedded image manifest to dir.
+func write(a *archive, dir string, mtime time.Time) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, archiveFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	if err := a.writeTo(io.MultiWriter(tmp, h), mtime); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	archive := filepath.Join(dir, archiveFile)
+	if err := os.Rename(tmp.Name(), archive); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := os.WriteFile(archive+".sha256", []byte(sum+"  "+archiveFile+"\n"), 0o644); err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(a.images)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), manifest, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d images in %d blobs to %s, sha256 %s\n", len(a.images), len(a.blobs), archive, sum)
+	return nil
+}
+
+// sourceDateEpoch returns the time of SOURCE_DATE_EPOCH, or the Unix epoch.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH=%q: %w", v, err)
+	}
+	return time.Unix(sec, 0), nil
+}
@@ -115,6 +115,27 @@ function main() {
 
     # We need to copy /var/lib/docker to /var/lib/docker-embedded in order for HookOS to use the Docker images in its build.
     docker exec "${dind_container}" sh -c "cp -a /var/lib/docker/* /var/lib/docker-embedded/"    
+
+    # Write the manifest of the embedded images, which BootKit verifies against the image store at boot.
+    # The digest is the image ID, the digest of the image config, as docker load does not keep the repository digests.
+    local manifest="[" separator="" reference digest
+    while IFS=" " read -r first_image image_tag remove_original || [ -n "${first_image}" ] ; do
+        local references=("${first_image}")
+        if [[ "${image_tag}" != "" ]]; then
+            references=("${image_tag}")
+            if [[ "${remove_original}" != "true" ]]; then
+                references+=("${first_image}")
+            fi
+        fi
+        for reference in "${references[@]}"; do
+            digest=$(docker exec "${dind_container}" docker image inspect --format '{{.Id}}' "${reference}")
+            manifest+="${separator}{\"reference\":\"${reference}\",\"digest\":\"${digest}\"}"
+            separator=","
+        done
+    done < "${images_file}"
+    manifest+="]"
+    echo -e "Writing the embedded image manifest: ${manifest}"
+    docker exec "${dind_container}" sh -c "echo '${manifest}' > /var/lib/docker-embedded/embedded-images.json"
 }
 
 arch="${1-amd64}"
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// bondConfig is a bond created over the interfaces with the given MAC addresses.
+// Mode defaults to 802.3ad (LACP) and MIIMon to 100ms.
+type bondConfig struct {
+	Name       string         `json:"name,omitempty"`
+	Interfaces []hardwareAddr `json:"interfaces"`
+	Mode       string         `json:"mode,omitempty"`
+	// MIIMon is the link monitoring interval in milliseconds.
+	MIIMon *int `json:"miimon,omitempty"`
+	// LACPRate is how often the link partner sends LACPDUs in 802.3ad mode, slow or fast.
+	LACPRate string `json:"lacpRate,omitempty"`
+}
+
+const (
+	defaultBondName   = "bond0"
+	defaultBondMode   = "802.3ad"
+	defaultBondMIIMon = 100
+)
+
+func (b *bondConfig) setDefaults() {
+	if b.Name == "" {
+		b.Name = defaultBondName
+	}
+	if b.Mode == "" {
+		b.Mode = defaultBondMode
+	}
+	if b.MIIMon == nil {
+		m := defaultBondMIIMon
+		b.MIIMon = &m
+	}
+}
+
+func (b bondConfig) validate() error {
+	var errs []error
+	if b.Name == "" || len(b.Name) >= unix.IFNAMSIZ || slices.ContainsFunc([]rune(b.Name), func(r rune) bool { return r == '/' || r == ':' || r <= ' ' }) {
+		errs = append(errs, fmt.Errorf("invalid bond name %q", b.Name))
+	}
+	if len(b.Interfaces) == 0 {
+		errs = append(errs, errors.New("bond: at least one interface is required"))
+	}
+	for i, mac := range b.Interfaces {
+		if slices.ContainsFunc(b.Interfaces[:i], func(m hardwareAddr) bool { return m.String() == mac.String() }) {
+			errs = append(errs, fmt.Errorf("bond: duplicate interface %v", mac))
+		}
+	}
+	if netlink.StringToBondMode(b.Mode) == netlink.BOND_MODE_UNKNOWN {
+		errs = append(errs, fmt.Errorf("bond: unknown mode %q", b.Mode))
+	}
+	if b.MIIMon != nil && *b.MIIMon < 0 {
+		errs = append(errs, fmt.Errorf("bond: miimon %d must not be negative", *b.MIIMon))
+	}
+	switch {
+	case b.LACPRate == "":
+	case netlink.StringToBondLacpRate(b.LACPRate) == netlink.BOND_LACP_RATE_UNKNOWN:
+		errs = append(errs, fmt.Errorf("bond: lacpRate %q must be slow or fast", b.LACPRate))
+	case netlink.StringToBondMode(b.Mode) != netlink.BOND_MODE_802_3AD:
+		errs = append(errs, errors.New("bond: lacpRate is only supported in 802.3ad mode"))
+	}
+	return errors.Join(errs...)
+}
+
+// ensureBond returns the bond b, creating it when it does not exist, with the interfaces of b enslaved to it.
+// Interfaces have to be down to be enslaved, the bond brings them up once they are.
+func (c *configurator) ensureBond(links []netlink.Link, b bondConfig) (netlink.Link, error) {
+	bond, err := c.nl.LinkByName(b.Name)
+	if err != nil {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = b.Name
+		nb := netlink.NewLinkBond(attrs)
+		nb.Mode = netlink.StringToBondMode(b.Mode)
+		if b.MIIMon != nil {
+			nb.Miimon = *b.MIIMon
+		}
+		if b.LACPRate != "" {
+			nb.LacpRate = netlink.StringToBondLacpRate(b.LACPRate)
+		}
+		if err := c.nl.LinkAdd(nb); err != nil {
+			return nil, fmt.Errorf("creating bond %s failed: %w", b.Name, err)
+		}
+		if bond, err = c.nl.LinkByName(b.Name); err != nil {
+			return nil, fmt.Errorf("looking up bond %s failed: %w", b.Name, err)
+		}
+	} else if _, ok := bond.(*netlink.Bond); !ok {
+		return nil, fmt.Errorf("interface %s exists but is not a bond", b.Name)
+	}
+
+	for _, mac := range b.Interfaces {
+		slave := findLink(links, net.HardwareAddr(mac))
+		if slave == nil {
+			return nil, fmt.Errorf("bond %s: no interface with MAC address %v", b.Name, mac)
+		}
+		if slave.Attrs().MasterIndex == bond.Attrs().Index {
+			continue
+		}
+		if err := c.nl.LinkSetDown(slave); err != nil {
+			return nil, fmt.Errorf("bond %s: bringing down %s failed: %w", b.Name, slave.Attrs().Name, err)
+		}
+		if err := c.nl.LinkSetMasterByIndex(slave, bond.Attrs().Index); err != nil {
+			return nil, fmt.Errorf("bond %s: enslaving %s failed: %w", b.Name, slave.Attrs().Name, err)
+		}
+	}
+	return bond, nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// networkConfig is the static network configuration of the machine.
+// It is declared with hook_network=, as base64 encoded JSON:
+//
+//	{
+//	  "interfaces": [
+//	    {"mac": "de:ad:be:ef:fe:ed", "vlan": 100, "mtu": 9000,
+//	     "addresses": ["192.168.2.193/24", "2001:db8::193/64"],
+//	     "routes": [{"via": "192.168.2.1"}, {"to": "::/0", "via": "2001:db8::1"}]},
+//	    {"bond": {"name": "bond1", "interfaces": ["de:ad:be:ef:00:01", "de:ad:be:ef:00:02"], "mode": "802.3ad", "lacpRate": "fast"},
+//	     "dhcp": true}
+//	  ],
+//	  "hostname": "myserver",
+//	  "dns": ["1.1.1.1", "2606:4700:4700::1111"],
+//	  "search": ["example.com"],
+//	  "ntp": ["time.example.com"]
+//	}
+//
+// or with ipam=, either URL-style key/values, where ip, gw, dns, search, ntp and bond can be repeated
+// or comma separated:
+//
+//	ipam=mac=de-ad-be-ef-fe-ed&vlan=100&ip=192.168.2.193/24&ip=2001:db8::193/64&gw=192.168.2.1&gw=2001:db8::1&dns=1.1.1.1,2606:4700:4700::1111&ipv6=static
+//	ipam=bond=de-ad-be-ef-fe-ed,de-ad-be-ef-fe-ee&bond_mode=802.3ad&bond_miimon=100&bond_lacp_rate=fast&vlan=100&dhcp=true
+//
+// or the legacy, IPv4 only, colon separated fields:
+//
+//	ipam=<mac>:<vlan>:<ip>:<netmask>:<gateway>:<hostname>:<dns>:<search>:<ntp>
+type networkConfig struct {
+	Interfaces []interfaceConfig `json:"interfaces"`
+	Hostname   string            `json:"hostname,omitempty"`
+	DNS        []netip.Addr      `json:"dns,omitempty"`
+	Search     []string          `json:"search,omitempty"`
+	NTP        []string          `json:"ntp,omitempty"`
+}
+
+// interfaceConfig is the configuration of a single interface, selected by its MAC address, or of a bond
+// created over several interfaces. When VLAN is set, the addresses and routes are configured on a VLAN
+// interface on top of it.
+type interfaceConfig struct {
+	MAC       hardwareAddr   `json:"mac,omitempty"`
+	Bond      *bondConfig    `json:"bond,omitempty"`
+	VLAN      int            `json:"vlan,omitempty"`
+	MTU       int            `json:"mtu,omitempty"`
+	Addresses []netip.Prefix `json:"addresses,omitempty"`
+	Routes    []routeConfig  `json:"routes,omitempty"`
+	// IPv6 is how the interface gets its IPv6 configuration, one of the ipv6Mode values.
+	// When empty, the kernel defaults apply.
+	IPv6 ipv6Mode `json:"ipv6,omitempty"`
+	// DHCP runs the DHCP client on the interface, in addition to any static addresses.
+	DHCP bool `json:"dhcp,omitempty"`
+	// Lifetimes are the lifetimes of the addresses leased by the built-in DHCP client. The other
+	// addresses are permanent.
+	Lifetimes map[netip.Prefix]addrLifetime `json:"-"`
+}
+
+// addrLifetime is the valid and preferred lifetime of a leased address.
+type addrLifetime struct {
+	Valid, Preferred time.Duration
+}
+
+// id identifies the interface in messages: the bond name for bonds, the MAC address otherwise.
+func (i interfaceConfig) id() string {
+	if i.Bond != nil {
+		return i.Bond.Name
+	}
+	return i.MAC.String()
+}
+
+// ipv6Mode is how an interface gets its IPv6 configuration.
+type ipv6Mode string
+
+const (
+	// ipv6Static only uses the static addresses and routes; router advertisements are ignored.
+	ipv6Static ipv6Mode = "static"
+	// ipv6SLAAC autoconfigures addresses and the default route from router advertisements.
+	ipv6SLAAC ipv6Mode = "slaac"
+	// ipv6DHCPv6 accepts router advertisements and runs a DHCPv6 client on the interface.
+	ipv6DHCPv6 ipv6Mode = "dhcpv6"
+)
+
+// dynamic reports whether the interface gets IPv6 addresses without them being configured.
+func (m ipv6Mode) dynamic() bool {
+	return m == ipv6SLAAC || m == ipv6DHCPv6
+}
+
+// routeConfig is a route through a gateway. An empty To is the default route of the gateway's address family.
+type routeConfig struct {
+	To  netip.Prefix `json:"to,omitempty"`
+	Via netip.Addr   `json:"via"`
+}
+
+// hardwareAddr is a MAC address that unmarshals from colon or hyphen separated text.
+type hardwareAddr net.HardwareAddr
+
+func (h *hardwareAddr) UnmarshalText(text []byte) error {
+	mac, err := parseMAC(string(text))
+	if err != nil {
+		return err
+	}
+	*h = hardwareAddr(mac)
+	return nil
+}
+
+func (h hardwareAddr) String() string {
+	return net.HardwareAddr(h).String()
+}
+
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(strings.ReplaceAll(s, "-", ":"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q", s)
+	}
+	return mac, nil
+}
+
+// destination returns the destination of the route, the default route when To is not set.
+func (r routeConfig) destination() netip.Prefix {
+	if r.To.IsValid() {
+		return r.To
+	}
+	if r.Via.Is4() {
+		return netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	}
+	return netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+}
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validate returns all the problems with the configuration.
+func (c networkConfig) validate() error {
+	var errs []error
+	if len(c.Interfaces) == 0 {
+		errs = append(errs, errors.New("at least one interface is required"))
+	}
+	seen := map[string]bool{}
+	for _, i := range c.Interfaces {
+		key := fmt.Sprintf("%v.%d", i.id(), i.VLAN)
+		switch {
+		case len(i.MAC) == 0 && i.Bond == nil:
+			errs = append(errs, errors.New("interface: mac or bond is required"))
+		case len(i.MAC) != 0 && i.Bond != nil:
+			errs = append(errs, fmt.Errorf("interface %v: mac and bond are mutually exclusive", i.id()))
+		case seen[key]:
+			errs = append(errs, fmt.Errorf("interface %v: duplicate interface", i.id()))
+		}
+		seen[key] = true
+		if i.Bond != nil {
+			if err := i.Bond.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("interface %v: %w", i.id(), err))
+			}
+		}
+		if i.VLAN < 0 || i.VLAN > 4094 {
+			errs = append(errs, fmt.Errorf("interface %v: vlan %d must be between 1 and 4094", i.id(), i.VLAN))
+		}
+		if i.MTU != 0 && (i.MTU < 68 || i.MTU > 65535) {
+			errs = append(errs, fmt.Errorf("interface %v: mtu %d must be between 68 and 65535", i.id(), i.MTU))
+		}
+		switch i.IPv6 {
+		case "", ipv6Static, ipv6SLAAC, ipv6DHCPv6:
+		default:
+			errs = append(errs, fmt.Errorf("interface %v: ipv6 %q must be one of static, slaac or dhcpv6", i.id(), i.IPv6))
+		}
+		if len(i.Addresses) == 0 && !i.DHCP && !i.IPv6.dynamic() {
+			errs = append(errs, fmt.Errorf("interface %v: at least one address is required unless dhcp is set or ipv6 is slaac or dhcpv6", i.id()))
+		}
+		for _, a := range i.Addresses {
+			if !a.IsValid() || a.Addr().IsUnspecified() {
+				errs = append(errs, fmt.Errorf("interface %v: invalid address %v", i.id(), a))
+			}
+		}
+		for _, r := range i.Routes {
+			if !r.Via.IsValid() {
+				errs = append(errs, fmt.Errorf("interface %v: route to %v: via is required", i.id(), r.To))
+				continue
+			}
+			if r.To.IsValid() && r.To.Addr().Is4() != r.Via.Is4() {
+				errs = append(errs, fmt.Errorf("interface %v: route to %v via %v mixes address families", i.id(), r.To, r.Via))
+			}
+		}
+	}
+	if c.Hostname != "" {
+		for _, label := range strings.Split(c.Hostname, ".") {
+			if !hostnameLabel.MatchString(label) {
+				errs = append(errs, fmt.Errorf("invalid hostname %q", c.Hostname))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseCmdLine returns the static network configuration in the kernel command line.
+// hook_network= takes precedence over ipam=. It returns false when neither is set.
+func parseCmdLine(cmdLines []string) (networkConfig, bool, error) {
+	var ipam, structured string
+	for i := range cmdLines {
+		cmdLine := strings.SplitN(strings.TrimSpace(cmdLines[i]), "=", 2)
+		if len(cmdLine) != 2 {
+			continue
+		}
+		switch cmdLine[0] {
+		case "ipam":
+			ipam = strings.TrimSpace(cmdLine[1])
+		case "hook_network":
+			structured = strings.TrimSpace(cmdLine[1])
+		}
+	}
+
+	var cfg networkConfig
+	var err error
+	switch {
+	case structured != "":
+		cfg, err = parseStructured(structured)
+	case strings.Contains(ipam, "="):
+		cfg, err = parseIPAMValues(ipam)
+	case ipam != "":
+		cfg, err = parseIPAM(ipam)
+	default:
+		return networkConfig{}, false, nil
+	}
+	if err != nil {
+		return networkConfig{}, true, err
+	}
+	for _, i := range cfg.Interfaces {
+		if i.Bond != nil {
+			i.Bond.setDefaults()
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return networkConfig{}, true, fmt.Errorf("invalid network configuration: %w", err)
+	}
+	return cfg, true, nil
+}
+
+// parseStructured decodes the base64 encoded JSON of hook_network=.
+func parseStructured(value string) (networkConfig, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		if b, err = base64.RawURLEncoding.DecodeString(value); err != nil {
+			return networkConfig{}, errors.New("hook_network must be base64 encoded JSON")
+		}
+	}
+	var cfg networkConfig
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return networkConfig{}, fmt.Errorf("decoding hook_network failed: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseIPAM parses the legacy ipam= parameter. The MAC address is hyphen separated and
+// dns, search and ntp are comma separated lists. MAC, IP, netmask and DNS are required.
+func parseIPAM(value string) (networkConfig, error) {
+	fields := strings.SplitN(value, ":", 9)
+	fields = append(fields, make([]string, 9-len(fields))...)
+	mac, vlan, ip, netmask, gateway, hostname, dns, search, ntp := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6], fields[7], fields[8]
+	if mac == "" || ip == "" || netmask == "" || dns == "" {
+		return networkConfig{}, fmt.Errorf("ipam %q: MAC address, IP address, netmask and DNS are required", value)
+	}
+
+	hw, err := parseMAC(mac)
+	if err != nil {
+		return networkConfig{}, fmt.Errorf("ipam: %w", err)
+	}
+	iface := interfaceConfig{MAC: hardwareAddr(hw)}
+	if vlan != "" {
+		if iface.VLAN, err = strconv.Atoi(vlan); err != nil || iface.VLAN == 0 {
+			return networkConfig{}, fmt.Errorf("ipam: invalid VLAN ID %q", vlan)
+		}
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return networkConfig{}, fmt.Errorf("ipam: invalid IPv4 address %q", ip)
+	}
+	bits, err := parseNetmask(netmask)
+	if err != nil {
+		return networkConfig{}, fmt.Errorf("ipam: %w", err)
+	}
+	iface.Addresses = []netip.Prefix{netip.PrefixFrom(addr, bits)}
+	if gateway != "" {
+		gw, err := netip.ParseAddr(gateway)
+		if err != nil || !gw.Is4() {
+			return networkConfig{}, fmt.Errorf("ipam: invalid IPv4 gateway %q", gateway)
+		}
+		iface.Routes = []routeConfig{{Via: gw}}
+	}
+
+	cfg := networkConfig{Interfaces: []interfaceConfig{iface}, Hostname: hostname, Search: splitList(search), NTP: splitList(ntp)}
+	for _, s := range splitList(dns) {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return networkConfig{}, fmt.Errorf("ipam: invalid DNS server %q", s)
+		}
+		cfg.DNS = append(cfg.DNS, a)
+	}
+	return cfg, nil
+}
+
+// parseIPAMValues parses the URL-style key/values of ipam=.
+func parseIPAMValues(value string) (networkConfig, error) {
+	values, err := url.ParseQuery(value)
+	if err != nil {
+		return networkConfig{}, fmt.Errorf("ipam: %w", err)
+	}
+	list := func(key string) []string {
+		var l []string
+		for _, v := range values[key] {
+			l = append(l, splitList(v)...)
+		}
+		return l
+	}
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		switch key {
+		case "mac", "vlan", "mtu", "ip", "gw", "dns", "search", "ntp", "hostname", "ipv6", "dhcp",
+			"bond", "bond_name", "bond_mode", "bond_miimon", "bond_lacp_rate":
+		default:
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+		}
+	}
+
+	var iface interfaceConfig
+	if values.Has("mac") || !values.Has("bond") {
+		if err := iface.MAC.UnmarshalText([]byte(values.Get("mac"))); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if values.Has("bond") {
+		iface.Bond = &bondConfig{Name: values.Get("bond_name"), Mode: values.Get("bond_mode"), LACPRate: values.Get("bond_lacp_rate")}
+		for _, s := range list("bond") {
+			var mac hardwareAddr
+			if err := mac.UnmarshalText([]byte(s)); err != nil {
+				errs = append(errs, fmt.Errorf("bond: %w", err))
+				continue
+			}
+			iface.Bond.Interfaces = append(iface.Bond.Interfaces, mac)
+		}
+	}
+	atoi := func(key string) int {
+		s := values.Get(key)
+		if s == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q", key, s))
+		}
+		return n
+	}
+	iface.VLAN, iface.MTU = atoi("vlan"), atoi("mtu")
+	if iface.Bond != nil && values.Has("bond_miimon") {
+		miimon := atoi("bond_miimon")
+		iface.Bond.MIIMon = &miimon
+	}
+	if s := values.Get("dhcp"); s != "" {
+		if iface.DHCP, err = strconv.ParseBool(s); err != nil {
+			errs = append(errs, fmt.Errorf("invalid dhcp %q", s))
+		}
+	}
+	for _, s := range list("ip") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid ip %q, want an address with a prefix length such as 192.168.2.193/24", s))
+			continue
+		}
+		iface.Addresses = append(iface.Addresses, p)
+	}
+	for _, s := range list("gw") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid gw %q", s))
+			continue
+		}
+		iface.Routes = append(iface.Routes, routeConfig{Via: a})
+	}
+	iface.IPv6 = ipv6Mode(values.Get("ipv6"))
+
+	cfg := networkConfig{Interfaces: []interfaceConfig{iface}, Hostname: values.Get("hostname"), Search: list("search"), NTP: list("ntp")}
+	for _, s := range list("dns") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid dns %q", s))
+			continue
+		}
+		cfg.DNS = append(cfg.DNS, a)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return networkConfig{}, fmt.Errorf("ipam: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseNetmask returns the prefix length of a dotted IPv4 netmask, such as 255.255.255.0, or of a prefix length, such as 24.
+func parseNetmask(s string) (int, error) {
+	if bits, err := strconv.Atoi(s); err == nil && bits >= 0 && bits <= 32 {
+		return bits, nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil || !a.Is4() {
+		return 0, fmt.Errorf("invalid netmask %q", s)
+	}
+	b := a.As4()
+	bits, size := net.IPv4Mask(b[0], b[1], b[2], b[3]).Size()
+	if size == 0 {
+		return 0, fmt.Errorf("invalid netmask %q", s)
+	}
+	return bits, nil
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
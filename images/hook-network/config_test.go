@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func mustMAC(s string) hardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return hardwareAddr(mac)
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestParseCmdLine(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := map[string]struct {
+		cmdline string
+		want    networkConfig
+		wantOK  bool
+		wantErr bool
+	}{
+		"none": {cmdline: "console=ttyS0 worker_id=m1"},
+		"ipam": {
+			cmdline: "console=ttyS0 ipam=de-ad-be-ef-fe-ed::192.168.2.193:255.255.255.0:192.168.2.1:myserver:1.1.1.1,8.8.8.8::132.163.97.1,132.163.96.1",
+			wantOK:  true,
+			want: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24")},
+					Routes:    []routeConfig{{Via: netip.MustParseAddr("192.168.2.1")}},
+				}},
+				Hostname: "myserver",
+				DNS:      []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("8.8.8.8")},
+				NTP:      []string{"132.163.97.1", "132.163.96.1"},
+			},
+		},
+		"ipam with vlan and no gateway": {
+			cmdline: "ipam=de-ad-be-ef-fe-ed:30:10.0.0.5:16:::10.0.0.1:example.com,example.org",
+			wantOK:  true,
+			want: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					VLAN:      30,
+					Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.5/16")},
+				}},
+				DNS:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+				Search: []string{"example.com", "example.org"},
+			},
+		},
+		"structured dual stack": {
+			cmdline: "hook_network=" + b64(`{"interfaces":[{"mac":"de-ad-be-ef-fe-ed","vlan":100,"mtu":9000,
+				"addresses":["192.168.2.193/24","2001:db8::193/64"],
+				"routes":[{"via":"192.168.2.1"},{"to":"::/0","via":"2001:db8::1"},{"to":"10.10.0.0/16","via":"192.168.2.254"}]}],
+				"dns":["2606:4700:4700::1111"],"search":["example.com"]}`),
+			wantOK: true,
+			want: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					VLAN:      100,
+					MTU:       9000,
+					Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24"), netip.MustParsePrefix("2001:db8::193/64")},
+					Routes: []routeConfig{
+						{Via: netip.MustParseAddr("192.168.2.1")},
+						{To: netip.MustParsePrefix("::/0"), Via: netip.MustParseAddr("2001:db8::1")},
+						{To: netip.MustParsePrefix("10.10.0.0/16"), Via: netip.MustParseAddr("192.168.2.254")},
+					},
+				}},
+				DNS:    []netip.Addr{netip.MustParseAddr("2606:4700:4700::1111")},
+				Search: []string{"example.com"},
+			},
+		},
+		"structured wins over ipam": {
+			cmdline: "ipam=de-ad-be-ef-fe-ed::192.168.2.193:255.255.255.0:::1.1.1.1 hook_network=" + b64(`{"interfaces":[{"mac":"de:ad:be:ef:fe:ee","addresses":["10.0.0.2/8"]}]}`),
+			wantOK:  true,
+			want: networkConfig{Interfaces: []interfaceConfig{{
+				MAC:       mustMAC("de:ad:be:ef:fe:ee"),
+				Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/8")},
+			}}},
+		},
+		"ipam key/values dual stack": {
+			cmdline: "ipam=mac=de-ad-be-ef-fe-ed&vlan=100&mtu=9000&ip=192.168.2.193/24&ip=2001:db8::193/64&gw=192.168.2.1&gw=2001:db8::1&dns=1.1.1.1,2606:4700:4700::1111&search=example.com&ntp=time.example.com&hostname=myserver&ipv6=static",
+			wantOK:  true,
+			want: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					VLAN:      100,
+					MTU:       9000,
+					Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24"), netip.MustParsePrefix("2001:db8::193/64")},
+					Routes:    []routeConfig{{Via: netip.MustParseAddr("192.168.2.1")}, {Via: netip.MustParseAddr("2001:db8::1")}},
+					IPv6:      ipv6Static,
+				}},
+				Hostname: "myserver",
+				DNS:      []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2606:4700:4700::1111")},
+				Search:   []string{"example.com"},
+				NTP:      []string{"time.example.com"},
+			},
+		},
+		"ipam key/values slaac only": {
+			cmdline: "ipam=mac=de:ad:be:ef:fe:ed&ipv6=slaac&dns=2606:4700:4700::1111",
+			wantOK:  true,
+			want: networkConfig{
+				Interfaces: []interfaceConfig{{MAC: mustMAC("de:ad:be:ef:fe:ed"), IPv6: ipv6SLAAC}},
+				DNS:        []netip.Addr{netip.MustParseAddr("2606:4700:4700::1111")},
+			},
+		},
+		"ipam key/values bond": {
+			cmdline: "ipam=bond=de-ad-be-ef-00-01,de-ad-be-ef-00-02&bond_mode=802.3ad&bond_miimon=200&bond_lacp_rate=fast&vlan=100&dhcp=true",
+			wantOK:  true,
+			want: networkConfig{Interfaces: []interfaceConfig{{
+				Bond: &bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01"), mustMAC("de:ad:be:ef:00:02")}, Mode: "802.3ad", MIIMon: ptr(200), LACPRate: "fast"},
+				VLAN: 100,
+				DHCP: true,
+			}}},
+		},
+		"structured bond defaults": {
+			cmdline: "hook_network=" + b64(`{"interfaces":[{"bond":{"interfaces":["de:ad:be:ef:00:01"]},"addresses":["10.0.0.2/8"]}]}`),
+			wantOK:  true,
+			want: networkConfig{Interfaces: []interfaceConfig{{
+				Bond:      &bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01")}, Mode: "802.3ad", MIIMon: ptr(100)},
+				Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/8")},
+			}}},
+		},
+		"bond lacp rate without lacp":           {cmdline: "ipam=bond=de-ad-be-ef-00-01&bond_mode=active-backup&bond_lacp_rate=fast&dhcp=true", wantErr: true},
+		"bond unknown mode":                     {cmdline: "ipam=bond=de-ad-be-ef-00-01&bond_mode=lacp&dhcp=true", wantErr: true},
+		"bond and mac":                          {cmdline: "ipam=mac=de-ad-be-ef-00-01&bond=de-ad-be-ef-00-01&dhcp=true", wantErr: true},
+		"bond duplicate interface":              {cmdline: "ipam=bond=de-ad-be-ef-00-01,de:ad:be:ef:00:01&dhcp=true", wantErr: true},
+		"ipam key/values without prefix length": {cmdline: "ipam=mac=de-ad-be-ef-fe-ed&ip=2001:db8::193", wantErr: true},
+		"ipam key/values unknown key":           {cmdline: "ipam=mac=de-ad-be-ef-fe-ed&ip=10.0.0.2/8&gateway=10.0.0.1", wantErr: true},
+		"ipam key/values no address":            {cmdline: "ipam=mac=de-ad-be-ef-fe-ed&ipv6=static", wantErr: true},
+		"ipam key/values bad ipv6 mode":         {cmdline: "ipam=mac=de-ad-be-ef-fe-ed&ipv6=auto", wantErr: true},
+		"ipam missing dns":                      {cmdline: "ipam=de-ad-be-ef-fe-ed::192.168.2.193:255.255.255.0:192.168.2.1", wantErr: true},
+		"ipam bad mac":                          {cmdline: "ipam=de-ad-be:30:10.0.0.5:16:::10.0.0.1", wantErr: true},
+		"ipam bad netmask":                      {cmdline: "ipam=de-ad-be-ef-fe-ed::10.0.0.5:255.0.255.0:::10.0.0.1", wantErr: true},
+		"ipam bad vlan":                         {cmdline: "ipam=de-ad-be-ef-fe-ed:vlan:10.0.0.5:16:::10.0.0.1", wantErr: true},
+		"ipam ipv6":                             {cmdline: "ipam=de-ad-be-ef-fe-ed::2001:db8::1:64:::10.0.0.1", wantErr: true},
+		"structured not base64":                 {cmdline: "hook_network={}", wantErr: true},
+		"structured unknown key":                {cmdline: "hook_network=" + b64(`{"interfaces":[],"gateway":"10.0.0.1"}`), wantErr: true},
+		"structured no interface":               {cmdline: "hook_network=" + b64(`{"interfaces":[]}`), wantErr: true},
+		"structured mixed route":                {cmdline: "hook_network=" + b64(`{"interfaces":[{"mac":"de:ad:be:ef:fe:ed","addresses":["10.0.0.2/8"],"routes":[{"to":"::/0","via":"10.0.0.1"}]}]}`), wantErr: true},
+		"structured bad vlan":                   {cmdline: "hook_network=" + b64(`{"interfaces":[{"mac":"de:ad:be:ef:fe:ed","vlan":5000,"addresses":["10.0.0.2/8"]}]}`), wantErr: true},
+		"structured bad hostname":               {cmdline: "hook_network=" + b64(`{"interfaces":[{"mac":"de:ad:be:ef:fe:ed","addresses":["10.0.0.2/8"]}],"hostname":"my_server"}`), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok, err := parseCmdLine(strings.Fields(tt.cmdline))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b }), cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// interfacesFile records the static configuration. dhcp.sh does not run the DHCP client when it exists.
+	interfacesFile = "/run/network/interfaces"
+	// resolvConfFile is where /etc/resolv.conf of the host points to.
+	resolvConfFile = "/run/resolvconf/resolv.conf"
+	// ntpServersFile lists the NTP servers to sync the time with, one per line.
+	ntpServersFile = "/run/network/ntp-servers"
+	// dhcpInterfacesFile lists the interfaces dhcp.sh runs the DHCP client on, one per line.
+	dhcpInterfacesFile = "/run/network/dhcp-interfaces"
+	// dhcp6InterfacesFile lists the interfaces dhcp.sh runs a DHCPv6 client on, one per line.
+	dhcp6InterfacesFile = "/run/network/dhcp6-interfaces"
+	// dhcpRenewInterfacesFile lists the interfaces leased by the built-in DHCP client, one per line.
+	// The dhcpcd-daemon service runs dhcp.sh, which renews their leases.
+	dhcpRenewInterfacesFile = "/run/network/dhcp-renew-interfaces"
+)
+
+// configurator applies a networkConfig to the host, or selects the provisioning interface.
+type configurator struct {
+	nl netlinker
+	// root is prepended to the paths of the files the configurator reads and writes.
+	root        string
+	sethostname func(name string) error
+	listenLLDP  func(ctx context.Context, links []netlink.Link) <-chan lldpFrame
+	// requestDHCPv4 and requestDHCPv6 are the built-in DHCP client.
+	requestDHCPv4 func(ctx context.Context, iface string) (*dhcpv4.DHCPv4, error)
+	requestDHCPv6 func(ctx context.Context, iface string) (*dhcpv6.Message, error)
+	// queryNTP, setClock and writeRTC sync the time, see syncTime.
+	queryNTP   func(server string) (*ntp.Response, error)
+	setClock   func(t time.Time) error
+	writeRTC   func(t time.Time) error
+	clockFloor time.Time
+
+	carrierTimeout   time.Duration
+	lldpTimeout      time.Duration
+	dhcpTimeout      time.Duration
+	dhcp6Timeout     time.Duration
+	pollInterval     time.Duration
+	timeSyncInterval time.Duration
+}
+
+func newConfigurator() *configurator {
+	// hook-network is built along with HookOS, so the time it was built at is a lower bound of the
+	// current time.
+	var clockFloor time.Time
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			clockFloor = fi.ModTime()
+		}
+	}
+	return &configurator{
+		nl:               &netlink.Handle{},
+		sethostname:      func(name string) error { return unix.Sethostname([]byte(name)) },
+		listenLLDP:       listenLLDP,
+		requestDHCPv4:    requestDHCPv4,
+		requestDHCPv6:    requestDHCPv6,
+		queryNTP:         queryNTP,
+		setClock:         setClock,
+		writeRTC:         writeRTC,
+		clockFloor:       clockFloor,
+		carrierTimeout:   carrierTimeout,
+		lldpTimeout:      lldpTimeout,
+		dhcpTimeout:      dhcpTimeout,
+		dhcp6Timeout:     dhcp6Timeout,
+		pollInterval:     500 * time.Millisecond,
+		timeSyncInterval: 2 * time.Second,
+	}
+}
+
+// configuredInterface is an interface that was configured, for the interfaces file.
+type configuredInterface struct {
+	name   string
+	parent string
+	cfg    interfaceConfig
+}
+
+// apply configures the interfaces, then writes the interfaces file, the DNS configuration and the NTP servers.
+func (c *configurator) apply(cfg networkConfig) error {
+	links, err := c.nl.LinkList()
+	if err != nil {
+		return fmt.Errorf("listing links failed: %w", err)
+	}
+	var configured []configuredInterface
+	var dhcp, dhcp6 []string
+	for _, i := range cfg.Interfaces {
+		ci, err := c.configureInterface(links, i)
+		if err != nil {
+			return fmt.Errorf("interface %v: %w", i.id(), err)
+		}
+		configured = append(configured, ci)
+		if i.DHCP {
+			dhcp = append(dhcp, ci.name)
+		}
+		if i.IPv6 == ipv6DHCPv6 {
+			dhcp6 = append(dhcp6, ci.name)
+		}
+	}
+
+	if cfg.Hostname != "" {
+		if err := c.sethostname(cfg.Hostname); err != nil {
+			return fmt.Errorf("setting hostname %q failed: %w", cfg.Hostname, err)
+		}
+	}
+	if err := c.writeFile(interfacesFile, interfaces(configured, cfg)); err != nil {
+		return err
+	}
+	if len(cfg.DNS) > 0 || len(cfg.Search) > 0 {
+		if err := c.writeFile(resolvConfFile, resolvConf(cfg)); err != nil {
+			return err
+		}
+	}
+	if len(dhcp) > 0 {
+		if err := c.writeFile(dhcpInterfacesFile, []byte(strings.Join(dhcp, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if len(dhcp6) > 0 {
+		if err := c.writeFile(dhcp6InterfacesFile, []byte(strings.Join(dhcp6, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if len(cfg.NTP) > 0 {
+		if err := c.writeFile(ntpServersFile, []byte(strings.Join(cfg.NTP, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureInterface brings up the interface with the MAC address of i, or the bond of i, and the VLAN
+// interface on top of it when i has a VLAN, then adds the addresses and routes.
+func (c *configurator) configureInterface(links []netlink.Link, i interfaceConfig) (configuredInterface, error) {
+	var link netlink.Link
+	if i.Bond != nil {
+		var err error
+		if link, err = c.ensureBond(links, *i.Bond); err != nil {
+			return configuredInterface{}, err
+		}
+	} else if link = findLink(links, net.HardwareAddr(i.MAC)); link == nil {
+		return configuredInterface{}, errors.New("no interface with this MAC address")
+	}
+	if i.MTU != 0 {
+		if err := c.nl.LinkSetMTU(link, i.MTU); err != nil {
+			return configuredInterface{}, fmt.Errorf("setting MTU of %s failed: %w", link.Attrs().Name, err)
+		}
+	}
+	ci := configuredInterface{name: link.Attrs().Name, cfg: i}
+
+	if i.VLAN != 0 {
+		if err := c.nl.LinkSetUp(link); err != nil {
+			return configuredInterface{}, fmt.Errorf("bringing up %s failed: %w", link.Attrs().Name, err)
+		}
+		vlan, err := c.ensureVLAN(link, i.VLAN)
+		if err != nil {
+			return configuredInterface{}, err
+		}
+		if i.MTU != 0 {
+			if err := c.nl.LinkSetMTU(vlan, i.MTU); err != nil {
+				return configuredInterface{}, fmt.Errorf("setting MTU of %s failed: %w", vlan.Attrs().Name, err)
+			}
+		}
+		ci.parent, ci.name, link = ci.name, vlan.Attrs().Name, vlan
+	}
+	if err := c.setIPv6Mode(ci.name, i.IPv6); err != nil {
+		return configuredInterface{}, err
+	}
+	if err := c.nl.LinkSetUp(link); err != nil {
+		return configuredInterface{}, fmt.Errorf("bringing up %s failed: %w", ci.name, err)
+	}
+
+	for _, a := range i.Addresses {
+		addr := &netlink.Addr{IPNet: ipNet(a)}
+		if a.Addr().Is6() {
+			// The address is assigned statically, so skip duplicate address detection and use it right away.
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		// A leased address is removed by the kernel when the lease expires without being renewed.
+		if lt, ok := i.Lifetimes[a]; ok {
+			addr.ValidLft, addr.PreferedLft = int(lt.Valid.Seconds()), int(lt.Preferred.Seconds())
+		}
+		if err := c.nl.AddrReplace(link, addr); err != nil {
+			return configuredInterface{}, fmt.Errorf("adding address %v to %s failed: %w", a, ci.name, err)
+		}
+	}
+	for _, r := range i.Routes {
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.IP(r.Via.AsSlice())}
+		if dst := r.destination(); dst.Bits() != 0 {
+			route.Dst = ipNet(dst)
+		}
+		if err := c.nl.RouteReplace(route); err != nil {
+			return configuredInterface{}, fmt.Errorf("adding route to %v via %v on %s failed: %w", r.destination(), r.Via, ci.name, err)
+		}
+	}
+	return ci, nil
+}
+
+// ipv6Sysctls are the accept_ra and autoconf settings of the IPv6 modes. accept_ra is 2 so that
+// router advertisements are accepted even when forwarding is enabled, for example by Docker.
+var ipv6Sysctls = map[ipv6Mode]struct{ acceptRA, autoconf string }{
+	ipv6Static: {acceptRA: "0", autoconf: "0"},
+	ipv6SLAAC:  {acceptRA: "2", autoconf: "1"},
+	ipv6DHCPv6: {acceptRA: "2", autoconf: "1"},
+}
+
+// setIPv6Mode sets the IPv6 sysctls of the interface for mode. The kernel defaults are kept when mode is empty.
+func (c *configurator) setIPv6Mode(name string, mode ipv6Mode) error {
+	s, ok := ipv6Sysctls[mode]
+	if !ok {
+		return nil
+	}
+	dir := filepath.Join(c.root, "/proc/sys/net/ipv6/conf", name)
+	for key, value := range map[string]string{"accept_ra": s.acceptRA, "autoconf": s.autoconf} {
+		if err := os.WriteFile(filepath.Join(dir, key), []byte(value), 0o644); err != nil {
+			return fmt.Errorf("setting IPv6 mode %s of %s failed: %w", mode, name, err)
+		}
+	}
+	return nil
+}
+
+// ensureVLAN returns the VLAN interface with the given ID on top of parent, creating it when it does not exist.
+func (c *configurator) ensureVLAN(parent netlink.Link, id int) (netlink.Link, error) {
+	name := fmt.Sprintf("%s.%d", parent.Attrs().Name, id)
+	if len(name) >= unix.IFNAMSIZ {
+		name = fmt.Sprintf("vlan%d", id)
+	}
+	if link, err := c.nl.LinkByName(name); err == nil {
+		if v, ok := link.(*netlink.Vlan); ok && v.VlanId == id && v.ParentIndex == parent.Attrs().Index {
+			return link, nil
+		}
+		return nil, fmt.Errorf("interface %s exists but is not VLAN %d of %s", name, id, parent.Attrs().Name)
+	}
+
+	vlan := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index}, VlanId: id}
+	if err := c.nl.LinkAdd(vlan); err != nil {
+		return nil, fmt.Errorf("creating VLAN interface %s failed: %w", name, err)
+	}
+	link, err := c.nl.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up VLAN interface %s failed: %w", name, err)
+	}
+	return link, nil
+}
+
+// findLink returns the link with the MAC address mac. VLAN interfaces and bonds share the MAC address
+// of an interface, so they are never returned. The permanent address is used when there is one, since
+// enslaving an interface to a bond changes its address to the bond's.
+func findLink(links []netlink.Link, mac net.HardwareAddr) netlink.Link {
+	for _, l := range links {
+		if l.Type() == "vlan" || l.Type() == "bond" {
+			continue
+		}
+		addr := l.Attrs().PermHWAddr
+		if len(addr) == 0 {
+			addr = l.Attrs().HardwareAddr
+		}
+		if bytes.Equal(addr, mac) {
+			return l
+		}
+	}
+	return nil
+}
+
+func ipNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{IP: net.IP(p.Addr().AsSlice()), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())}
+}
+
+func (c *configurator) writeFile(name string, content []byte) error {
+	name = filepath.Join(c.root, name)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	// The file is replaced atomically, as it can be read while it is written.
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("writing %s failed: %w", name, err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("writing %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// interfaces returns the configuration in the ifupdown interfaces format, for troubleshooting.
+func interfaces(configured []configuredInterface, cfg networkConfig) []byte {
+	var b strings.Builder
+	b.WriteString("# Static network configuration written by hook-network\n")
+	for _, ci := range configured {
+		if ci.parent != "" {
+			fmt.Fprintf(&b, "\nauto %s\niface %s inet manual\n", ci.parent, ci.parent)
+		}
+		for _, family := range []string{"inet", "inet6"} {
+			var lines []string
+			for _, a := range ci.cfg.Addresses {
+				if a.Addr().Is4() == (family == "inet") {
+					lines = append(lines, "address "+a.String())
+				}
+			}
+			if len(lines) == 0 {
+				continue
+			}
+			for _, r := range ci.cfg.Routes {
+				if r.Via.Is4() != (family == "inet") {
+					continue
+				}
+				if r.destination().Bits() == 0 {
+					lines = append(lines, "gateway "+r.Via.String())
+				} else {
+					lines = append(lines, fmt.Sprintf("up ip route replace %v via %v dev %s", r.destination(), r.Via, ci.name))
+				}
+			}
+			if ci.cfg.MTU != 0 {
+				lines = append(lines, fmt.Sprintf("mtu %d", ci.cfg.MTU))
+			}
+			fmt.Fprintf(&b, "\nauto %s\niface %s %s static\n", ci.name, ci.name, family)
+			for _, l := range lines {
+				fmt.Fprintf(&b, "    %s\n", l)
+			}
+		}
+		if ci.cfg.DHCP {
+			fmt.Fprintf(&b, "\nauto %s\niface %s inet dhcp\n", ci.name, ci.name)
+		}
+		switch ci.cfg.IPv6 {
+		case ipv6SLAAC:
+			fmt.Fprintf(&b, "\nauto %s\niface %s inet6 auto\n", ci.name, ci.name)
+		case ipv6DHCPv6:
+			fmt.Fprintf(&b, "\nauto %s\niface %s inet6 dhcp\n", ci.name, ci.name)
+		}
+	}
+	if cfg.Hostname != "" {
+		fmt.Fprintf(&b, "\n# hostname %s\n", cfg.Hostname)
+	}
+	return []byte(b.String())
+}
+
+// resolvConf returns the resolv.conf for the DNS servers and search domains of cfg.
+func resolvConf(cfg networkConfig) []byte {
+	var b strings.Builder
+	if len(cfg.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(cfg.Search, " "))
+	}
+	for _, ns := range cfg.DNS {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlink is an in-memory netlinker that records the changes made to the links.
+type fakeNetlink struct {
+	links []netlink.Link
+	up    map[string]bool
+	mtu   map[string]int
+	addrs map[string][]string
+	// lifetimes are the valid and preferred lifetimes of the addresses that have them.
+	lifetimes map[string]string
+	routes    []string
+}
+
+func newFakeNetlink(links ...netlink.Link) *fakeNetlink {
+	return &fakeNetlink{links: links, up: map[string]bool{}, mtu: map[string]int{}, addrs: map[string][]string{}, lifetimes: map[string]string{}}
+}
+
+func device(index int, name, mac string) netlink.Link {
+	hw, _ := net.ParseMAC(mac)
+	return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: index, Name: name, HardwareAddr: hw}}
+}
+
+func (f *fakeNetlink) LinkList() ([]netlink.Link, error) { return f.links, nil }
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return l, nil
+		}
+	}
+	return nil, netlink.LinkNotFoundError{}
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	if _, err := f.LinkByName(link.Attrs().Name); err == nil {
+		return errors.New("file exists")
+	}
+	link.Attrs().Index = len(f.links) + 100
+	f.links = append(f.links, link)
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	f.up[link.Attrs().Name] = true
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetDown(link netlink.Link) error {
+	f.up[link.Attrs().Name] = false
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	if f.up[link.Attrs().Name] {
+		return errors.New("operation not permitted: interface is up")
+	}
+	link.Attrs().MasterIndex = masterIndex
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	f.mtu[link.Attrs().Name] = mtu
+	return nil
+}
+
+func (f *fakeNetlink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	f.addrs[link.Attrs().Name] = append(f.addrs[link.Attrs().Name], addr.IPNet.String())
+	if addr.ValidLft != 0 || addr.PreferedLft != 0 {
+		f.lifetimes[addr.IPNet.String()] = fmt.Sprintf("%d/%d", addr.ValidLft, addr.PreferedLft)
+	}
+	return nil
+}
+
+func (f *fakeNetlink) RouteReplace(route *netlink.Route) error {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	f.routes = append(f.routes, fmt.Sprintf("%s via %s dev %d", dst, route.Gw, route.LinkIndex))
+	return nil
+}
+
+func TestConfiguratorApply(t *testing.T) {
+	tests := map[string]struct {
+		links       []netlink.Link
+		cfg         networkConfig
+		wantUp      []string
+		wantAddrs   map[string][]string
+		wantRoutes  []string
+		wantFiles   map[string]string
+		wantSysctls map[string]string
+		wantErr     bool
+	}{
+		"ipv4": {
+			links: []netlink.Link{device(1, "lo", "00:00:00:00:00:00"), device(2, "eth0", "de:ad:be:ef:fe:ed")},
+			cfg: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24")},
+					Routes:    []routeConfig{{Via: netip.MustParseAddr("192.168.2.1")}},
+				}},
+				Hostname: "myserver",
+				DNS:      []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("8.8.8.8")},
+				Search:   []string{"example.com"},
+				NTP:      []string{"132.163.97.1", "time.example.com"},
+			},
+			wantUp:     []string{"eth0"},
+			wantAddrs:  map[string][]string{"eth0": {"192.168.2.193/24"}},
+			wantRoutes: []string{"default via 192.168.2.1 dev 2"},
+			wantFiles: map[string]string{
+				interfacesFile: "# Static network configuration written by hook-network\n\nauto eth0\niface eth0 inet static\n    address 192.168.2.193/24\n    gateway 192.168.2.1\n\n# hostname myserver\n",
+				resolvConfFile: "search example.com\nnameserver 1.1.1.1\nnameserver 8.8.8.8\n",
+				ntpServersFile: "132.163.97.1\ntime.example.com\n",
+			},
+		},
+		"dual stack on a vlan": {
+			// The existing VLAN interface of another parent with the same MAC address must not be selected.
+			links: []netlink.Link{
+				device(2, "eth0", "de:ad:be:ef:fe:ed"),
+				&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Index: 3, Name: "eth1.5", HardwareAddr: net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0xfe, 0xed}}, VlanId: 5},
+			},
+			cfg: networkConfig{
+				Interfaces: []interfaceConfig{{
+					MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+					VLAN:      100,
+					Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24"), netip.MustParsePrefix("2001:db8::193/64")},
+					Routes: []routeConfig{
+						{Via: netip.MustParseAddr("192.168.2.1")},
+						{Via: netip.MustParseAddr("2001:db8::1")},
+						{To: netip.MustParsePrefix("10.10.0.0/16"), Via: netip.MustParseAddr("192.168.2.254")},
+					},
+				}},
+				DNS: []netip.Addr{netip.MustParseAddr("2606:4700:4700::1111")},
+			},
+			wantUp:     []string{"eth0", "eth0.100"},
+			wantAddrs:  map[string][]string{"eth0.100": {"192.168.2.193/24", "2001:db8::193/64"}},
+			wantRoutes: []string{"default via 192.168.2.1 dev 102", "default via 2001:db8::1 dev 102", "10.10.0.0/16 via 192.168.2.254 dev 102"},
+			wantFiles: map[string]string{
+				interfacesFile: "# Static network configuration written by hook-network\n\nauto eth0\niface eth0 inet manual\n" +
+					"\nauto eth0.100\niface eth0.100 inet static\n    address 192.168.2.193/24\n    gateway 192.168.2.1\n    up ip route replace 10.10.0.0/16 via 192.168.2.254 dev eth0.100\n" +
+					"\nauto eth0.100\niface eth0.100 inet6 static\n    address 2001:db8::193/64\n    gateway 2001:db8::1\n",
+				resolvConfFile: "nameserver 2606:4700:4700::1111\n",
+			},
+		},
+		"slaac and dhcpv6": {
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:fe:ed"), device(3, "eth1", "de:ad:be:ef:fe:ee")},
+			cfg: networkConfig{
+				Interfaces: []interfaceConfig{
+					{MAC: mustMAC("de:ad:be:ef:fe:ed"), Addresses: []netip.Prefix{netip.MustParsePrefix("192.168.2.193/24")}, IPv6: ipv6SLAAC},
+					{MAC: mustMAC("de:ad:be:ef:fe:ee"), VLAN: 100, IPv6: ipv6DHCPv6},
+				},
+			},
+			wantUp:    []string{"eth0", "eth1", "eth1.100"},
+			wantAddrs: map[string][]string{"eth0": {"192.168.2.193/24"}},
+			wantFiles: map[string]string{
+				interfacesFile: "# Static network configuration written by hook-network\n\nauto eth0\niface eth0 inet static\n    address 192.168.2.193/24\n\nauto eth0\niface eth0 inet6 auto\n" +
+					"\nauto eth1\niface eth1 inet manual\n\nauto eth1.100\niface eth1.100 inet6 dhcp\n",
+				dhcp6InterfacesFile: "eth1.100\n",
+			},
+			wantSysctls: map[string]string{"eth0/accept_ra": "2", "eth0/autoconf": "1", "eth1.100/accept_ra": "2", "eth1.100/autoconf": "1"},
+		},
+		"static ipv6 ignores router advertisements": {
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:fe:ed")},
+			cfg: networkConfig{Interfaces: []interfaceConfig{{
+				MAC:       mustMAC("de:ad:be:ef:fe:ed"),
+				Addresses: []netip.Prefix{netip.MustParsePrefix("2001:db8::193/64")},
+				Routes:    []routeConfig{{Via: netip.MustParseAddr("fe80::1")}},
+				IPv6:      ipv6Static,
+			}}},
+			wantUp:     []string{"eth0"},
+			wantAddrs:  map[string][]string{"eth0": {"2001:db8::193/64"}},
+			wantRoutes: []string{"default via fe80::1 dev 2"},
+			wantFiles: map[string]string{
+				interfacesFile: "# Static network configuration written by hook-network\n\nauto eth0\niface eth0 inet6 static\n    address 2001:db8::193/64\n    gateway fe80::1\n",
+			},
+			wantSysctls: map[string]string{"eth0/accept_ra": "0", "eth0/autoconf": "0"},
+		},
+		"dhcp on a vlan over an lacp bond": {
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02"), device(4, "eth2", "de:ad:be:ef:00:03")},
+			cfg: networkConfig{Interfaces: []interfaceConfig{{
+				Bond: &bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01"), mustMAC("de:ad:be:ef:00:02")}, Mode: "802.3ad", LACPRate: "fast"},
+				VLAN: 100,
+				DHCP: true,
+			}}},
+			wantUp: []string{"bond0", "bond0.100"},
+			wantFiles: map[string]string{
+				interfacesFile:     "# Static network configuration written by hook-network\n\nauto bond0\niface bond0 inet manual\n\nauto bond0.100\niface bond0.100 inet dhcp\n",
+				dhcpInterfacesFile: "bond0.100\n",
+			},
+		},
+		"no such mac": {
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:fe:ed")},
+			cfg:     networkConfig{Interfaces: []interfaceConfig{{MAC: mustMAC("de:ad:be:ef:fe:ee"), Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/8")}}}},
+			wantErr: true,
+		},
+		"bond over a missing interface": {
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			cfg:     networkConfig{Interfaces: []interfaceConfig{{Bond: &bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01"), mustMAC("de:ad:be:ef:00:02")}, Mode: "802.3ad"}, DHCP: true}}},
+			wantErr: true,
+		},
+		"vlan name taken": {
+			links: []netlink.Link{
+				device(2, "eth0", "de:ad:be:ef:fe:ed"),
+				&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Index: 3, Name: "eth0.100", ParentIndex: 2}, VlanId: 200},
+			},
+			cfg:     networkConfig{Interfaces: []interfaceConfig{{MAC: mustMAC("de:ad:be:ef:fe:ed"), VLAN: 100, Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/8")}}}},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			nl := newFakeNetlink(tt.links...)
+			var hostname string
+			c := &configurator{nl: nl, root: t.TempDir(), sethostname: func(name string) error { hostname = name; return nil }}
+			for _, name := range []string{"eth0", "eth1.100"} {
+				if err := os.MkdirAll(filepath.Join(c.root, "/proc/sys/net/ipv6/conf", name), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := c.apply(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var up []string
+			for _, l := range nl.links {
+				if nl.up[l.Attrs().Name] {
+					up = append(up, l.Attrs().Name)
+				}
+			}
+			if diff := cmp.Diff(tt.wantUp, up); diff != "" {
+				t.Errorf("links up: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantAddrs, nl.addrs, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("addresses: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantRoutes, nl.routes); diff != "" {
+				t.Errorf("routes: %s", diff)
+			}
+			if hostname != tt.cfg.Hostname {
+				t.Errorf("got hostname %q, want %q", hostname, tt.cfg.Hostname)
+			}
+			for name, want := range tt.wantSysctls {
+				got, err := os.ReadFile(filepath.Join(c.root, "/proc/sys/net/ipv6/conf", name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+			for _, f := range []string{interfacesFile, resolvConfFile, ntpServersFile, dhcpInterfacesFile, dhcp6InterfacesFile} {
+				got, err := os.ReadFile(filepath.Join(c.root, f))
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.wantFiles[f], string(got)); diff != "" {
+					t.Errorf("%s: %s", f, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureVLANReusesExisting(t *testing.T) {
+	parent := device(2, "eth0", "de:ad:be:ef:fe:ed")
+	existing := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Index: 3, Name: "eth0.100", ParentIndex: 2}, VlanId: 100}
+	nl := newFakeNetlink(parent, existing)
+	c := &configurator{nl: nl}
+	got, err := c.ensureVLAN(parent, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != existing || len(nl.links) != 2 {
+		t.Errorf("want the existing VLAN interface to be reused, got %v and links %v", got, nl.links)
+	}
+}
+
+func TestEnsureBond(t *testing.T) {
+	eth0, eth1 := device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")
+	nl := newFakeNetlink(eth0, eth1)
+	c := &configurator{nl: nl}
+	b := bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01"), mustMAC("de:ad:be:ef:00:02")}, Mode: "active-backup"}
+	b.setDefaults()
+	bond, err := c.ensureBond(nl.links, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := bond.(*netlink.Bond)
+	if !ok {
+		t.Fatalf("got %T, want a bond", bond)
+	}
+	if got.Mode != netlink.BOND_MODE_ACTIVE_BACKUP || got.Miimon != defaultBondMIIMon {
+		t.Errorf("got mode %v and miimon %d", got.Mode, got.Miimon)
+	}
+	for _, l := range []netlink.Link{eth0, eth1} {
+		if l.Attrs().MasterIndex != bond.Attrs().Index {
+			t.Errorf("%s is not enslaved to the bond", l.Attrs().Name)
+		}
+	}
+
+	// Applying the configuration again reuses the bond.
+	if _, err := c.ensureBond(nl.links, b); err != nil {
+		t.Fatal(err)
+	}
+	if len(nl.links) != 3 {
+		t.Errorf("want 3 links, got %d", len(nl.links))
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/vishvananda/netlink"
+)
+
+// leaseFile records the leases of the built-in DHCP client, for BootKit and troubleshooting.
+const leaseFile = "/run/network/dhcp-lease.json"
+
+const (
+	// dhcpTimeout is how long the built-in DHCP client tries to get a DHCPv4 lease.
+	dhcpTimeout = 30 * time.Second
+	// dhcp6Timeout is how long the built-in DHCP client tries to get a DHCPv6 lease, once it got a
+	// DHCPv4 lease. Most provisioning networks have no DHCPv6 server.
+	dhcp6Timeout = 10 * time.Second
+)
+
+// dhcpRequestedOptions are the options requested from the DHCPv4 server, on top of the default ones.
+// The site-specific options 224 to 254 can carry BootKit settings.
+var dhcpRequestedOptions = func() []dhcpv4.OptionCode {
+	codes := []dhcpv4.OptionCode{
+		dhcpv4.OptionHostName,
+		dhcpv4.OptionDomainName,
+		dhcpv4.OptionInterfaceMTU,
+		dhcpv4.OptionNTPServers,
+		dhcpv4.OptionVendorSpecificInformation,
+		dhcpv4.OptionDNSDomainSearchList,
+		dhcpv4.OptionClasslessStaticRoute,
+		dhcpv4.OptionVendorIdentifyingVendorSpecific,
+	}
+	for code := 224; code <= 254; code++ {
+		codes = append(codes, dhcpv4.GenericOptionCode(code))
+	}
+	return codes
+}()
+
+// dhcpLease is a lease of the built-in DHCP client.
+type dhcpLease struct {
+	Interface string `json:"interface"`
+	// MAC is the MAC address of the interface, or of its parent when VLAN is set.
+	MAC        string        `json:"mac"`
+	VLAN       int           `json:"vlan,omitempty"`
+	Address    netip.Prefix  `json:"address"`
+	Routes     []routeConfig `json:"routes,omitempty"`
+	DNS        []netip.Addr  `json:"dns,omitempty"`
+	DomainName string        `json:"domainName,omitempty"`
+	Search     []string      `json:"search,omitempty"`
+	Hostname   string        `json:"hostname,omitempty"`
+	NTP        []netip.Addr  `json:"ntp,omitempty"`
+	MTU        int           `json:"mtu,omitempty"`
+	ServerID   string        `json:"serverID,omitempty"`
+	NextServer string        `json:"nextServer,omitempty"`
+	BootFile   string        `json:"bootFile,omitempty"`
+	// LeaseTime is the lease time in seconds.
+	LeaseTime  int       `json:"leaseTime,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	// Options are all the options of the DHCPACK, hex encoded, by option code.
+	Options map[string]string `json:"options"`
+	// VendorOptions are the sub-options of the vendor-specific information option (43), by sub-option code.
+	VendorOptions map[string]string `json:"vendorOptions,omitempty"`
+	// VIVendorOptions are the sub-options of the vendor-identifying vendor-specific information
+	// option (125), by enterprise number and sub-option code.
+	VIVendorOptions map[string]map[string]string `json:"viVendorOptions,omitempty"`
+	IPv6            *dhcp6Lease                  `json:"ipv6,omitempty"`
+}
+
+// dhcp6Lease is the DHCPv6 part of a lease.
+type dhcp6Lease struct {
+	Addresses []netip.Addr `json:"addresses,omitempty"`
+	// ValidLifetime and PreferredLifetime are the shortest lifetimes of the addresses, in seconds.
+	ValidLifetime     int          `json:"validLifetime,omitempty"`
+	PreferredLifetime int          `json:"preferredLifetime,omitempty"`
+	DNS               []netip.Addr `json:"dns,omitempty"`
+	Search            []string     `json:"search,omitempty"`
+	// Options are all the options of the reply, hex encoded, by option code.
+	Options map[string]string `json:"options"`
+}
+
+// dhcpClientEnabled returns whether hook_dhcp_client=go is in the kernel command line, to use the built-in
+// DHCP client instead of dhcpcd.
+func dhcpClientEnabled(cmdLines []string) bool {
+	for _, l := range cmdLines {
+		if strings.TrimSpace(l) == "hook_dhcp_client=go" {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseFromACK returns the lease in a DHCPACK.
+func leaseFromACK(ack *dhcpv4.DHCPv4) (dhcpLease, error) {
+	addr, ok := netip.AddrFromSlice(ack.YourIPAddr.To4())
+	if !ok || addr.IsUnspecified() {
+		return dhcpLease{}, errors.New("the DHCPACK has no address")
+	}
+	mask := ack.SubnetMask()
+	if mask == nil {
+		mask = net.IP(addr.AsSlice()).DefaultMask()
+	}
+	bits, _ := mask.Size()
+	l := dhcpLease{
+		Address:    netip.PrefixFrom(addr, bits),
+		DNS:        addrs(ack.DNS()),
+		DomainName: ack.DomainName(),
+		Hostname:   ack.HostName(),
+		NTP:        addrs(ack.NTPServers()),
+		BootFile:   ack.BootFileName,
+		LeaseTime:  int(ack.IPAddressLeaseTime(0).Seconds()),
+		AcquiredAt: time.Now().UTC(),
+		Options:    map[string]string{},
+	}
+	if id := ack.ServerIdentifier(); id != nil {
+		l.ServerID = id.String()
+	}
+	if ack.ServerIPAddr != nil && !ack.ServerIPAddr.IsUnspecified() {
+		l.NextServer = ack.ServerIPAddr.String()
+	}
+	if search := ack.DomainSearch(); search != nil {
+		l.Search = search.Labels
+	}
+	if mtu := ack.Options.Get(dhcpv4.OptionInterfaceMTU); len(mtu) == 2 {
+		l.MTU = int(binary.BigEndian.Uint16(mtu))
+	}
+
+	// Classless static routes replace the routers option when there are any, see RFC 3442.
+	if routes := ack.ClasslessStaticRoute(); len(routes) > 0 {
+		for _, r := range routes {
+			via, _ := netip.AddrFromSlice(r.Router.To4())
+			ones, _ := r.Dest.Mask.Size()
+			to, _ := netip.AddrFromSlice(r.Dest.IP.To4())
+			l.Routes = append(l.Routes, routeConfig{To: netip.PrefixFrom(to, ones), Via: via})
+		}
+	} else if routers := addrs(ack.Router()); len(routers) > 0 {
+		l.Routes = []routeConfig{{Via: routers[0]}}
+	}
+
+	for code, value := range ack.Options {
+		l.Options[strconv.Itoa(int(code))] = hex.EncodeToString(value)
+	}
+	if v := ack.Options.Get(dhcpv4.OptionVendorSpecificInformation); v != nil {
+		l.VendorOptions, _ = subOptions(v)
+	}
+	if v := ack.Options.Get(dhcpv4.OptionVendorIdentifyingVendorSpecific); v != nil {
+		l.VIVendorOptions = viVendorOptions(v)
+	}
+	return l, nil
+}
+
+// addIPv6 adds the addresses, DNS servers and search domains of a DHCPv6 reply to the lease.
+func (l *dhcpLease) addIPv6(reply *dhcpv6.Message) {
+	l6 := &dhcp6Lease{DNS: addrs(reply.Options.DNS()), Options: map[string]string{}}
+	if iana := reply.Options.OneIANA(); iana != nil {
+		for _, a := range iana.Options.Addresses() {
+			if addr, ok := netip.AddrFromSlice(a.IPv6Addr); ok {
+				l6.Addresses = append(l6.Addresses, addr)
+				l6.ValidLifetime = shortest(l6.ValidLifetime, int(a.ValidLifetime.Seconds()))
+				l6.PreferredLifetime = shortest(l6.PreferredLifetime, int(a.PreferredLifetime.Seconds()))
+			}
+		}
+	}
+	if search := reply.Options.DomainSearchList(); search != nil {
+		l6.Search = search.Labels
+	}
+	for _, o := range reply.Options.Options {
+		l6.Options[strconv.Itoa(int(o.Code()))] = hex.EncodeToString(o.ToBytes())
+	}
+	l.IPv6 = l6
+}
+
+// shortest returns the shortest of the lifetimes a and b, in seconds, where 0 is unset.
+func shortest(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// subOptions decodes the code, length and value encoded sub-options of an option.
+// Values are decoded as text.
+func subOptions(b []byte) (map[string]string, error) {
+	sub := map[string]string{}
+	for len(b) > 0 {
+		code := b[0]
+		if code == 0 || code == 255 {
+			// Pad and end.
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || int(b[1]) > len(b)-2 {
+			return nil, fmt.Errorf("sub-option %d exceeds the option", code)
+		}
+		sub[strconv.Itoa(int(code))] = string(b[2 : 2+int(b[1])])
+		b = b[2+int(b[1]):]
+	}
+	return sub, nil
+}
+
+// viVendorOptions decodes the vendor-identifying vendor-specific information option (125), which has
+// an enterprise number, a length and sub-options for each vendor. Vendors that do not decode are skipped.
+func viVendorOptions(b []byte) map[string]map[string]string {
+	vendors := map[string]map[string]string{}
+	for len(b) >= 5 {
+		enterprise, length := binary.BigEndian.Uint32(b), int(b[4])
+		b = b[5:]
+		if length > len(b) {
+			break
+		}
+		if sub, err := subOptions(b[:length]); err == nil {
+			vendors[strconv.FormatUint(uint64(enterprise), 10)] = sub
+		}
+		b = b[length:]
+	}
+	return vendors
+}
+
+func addrs(ips []net.IP) []netip.Addr {
+	var a []netip.Addr
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			a = append(a, addr.Unmap())
+		}
+	}
+	return a
+}
+
+// leaseConfig returns the network configuration of the leases. Only the first lease, by interface,
+// sets the default route and the hostname, so that there is a single default route.
+func leaseConfig(leases []dhcpLease) (networkConfig, error) {
+	var cfg networkConfig
+	for i, l := range leases {
+		mac, err := parseMAC(l.MAC)
+		if err != nil {
+			return networkConfig{}, fmt.Errorf("lease of %s: %w", l.Interface, err)
+		}
+		ic := interfaceConfig{MAC: hardwareAddr(mac), VLAN: l.VLAN, MTU: l.MTU, Addresses: []netip.Prefix{l.Address}, Lifetimes: map[netip.Prefix]addrLifetime{}}
+		if l.LeaseTime > 0 {
+			lease := time.Duration(l.LeaseTime) * time.Second
+			ic.Lifetimes[l.Address] = addrLifetime{Valid: lease, Preferred: lease}
+		}
+		for _, r := range l.Routes {
+			if i == 0 || r.destination().Bits() != 0 {
+				ic.Routes = append(ic.Routes, r)
+			}
+		}
+		cfg.DNS = appendNew(cfg.DNS, l.DNS...)
+		cfg.Search = appendNew(cfg.Search, l.Search...)
+		if len(l.Search) == 0 && l.DomainName != "" {
+			cfg.Search = appendNew(cfg.Search, l.DomainName)
+		}
+		if l.IPv6 != nil {
+			for _, a := range l.IPv6.Addresses {
+				p := netip.PrefixFrom(a, 128)
+				ic.Addresses = append(ic.Addresses, p)
+				if l.IPv6.ValidLifetime > 0 {
+					ic.Lifetimes[p] = addrLifetime{Valid: time.Duration(l.IPv6.ValidLifetime) * time.Second, Preferred: time.Duration(l.IPv6.PreferredLifetime) * time.Second}
+				}
+			}
+			cfg.DNS = appendNew(cfg.DNS, l.IPv6.DNS...)
+			cfg.Search = appendNew(cfg.Search, l.IPv6.Search...)
+		}
+		cfg.Interfaces = append(cfg.Interfaces, ic)
+		for _, ntp := range l.NTP {
+			cfg.NTP = appendNew(cfg.NTP, ntp.String())
+		}
+		if i == 0 {
+			cfg.Hostname = l.Hostname
+		}
+	}
+	return cfg, nil
+}
+
+// appendNew appends the values that are not in s yet.
+func appendNew[T comparable](s []T, values ...T) []T {
+	for _, v := range values {
+		if !slices.Contains(s, v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// runDHCP gets a lease on each of the links, configures the network with the leases and writes
+// them to the lease file. It fails when no link got a lease. The leased interfaces are written to
+// dhcpRenewInterfacesFile, for dhcpcd-daemon to renew the leases.
+func (c *configurator) runDHCP(ctx context.Context, links []netlink.Link) ([]dhcpLease, error) {
+	all, err := c.nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links failed: %w", err)
+	}
+	results := make([]*dhcpLease, len(links))
+	errs := make([]error, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := c.lease(ctx, all, link)
+			results[i], errs[i] = l, err
+		}()
+	}
+	wg.Wait()
+
+	var leases []dhcpLease
+	for _, l := range results {
+		if l != nil {
+			leases = append(leases, *l)
+		}
+	}
+	if len(leases) == 0 {
+		return nil, fmt.Errorf("no lease: %w", errors.Join(errs...))
+	}
+	cfg, err := leaseConfig(leases)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.apply(cfg); err != nil {
+		return nil, err
+	}
+	// The addresses expire with the leases, dhcpcd-daemon renews them.
+	var renew []string
+	for _, l := range leases {
+		renew = append(renew, l.Interface)
+	}
+	if err := c.writeFile(dhcpRenewInterfacesFile, []byte(strings.Join(renew, "\n")+"\n")); err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return leases, c.writeFile(leaseFile, append(b, '\n'))
+}
+
+// lease gets a DHCPv4 lease on the link, and a DHCPv6 lease when there is a DHCPv6 server.
+func (c *configurator) lease(ctx context.Context, all []netlink.Link, link netlink.Link) (*dhcpLease, error) {
+	name := link.Attrs().Name
+	if err := c.nl.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("bringing up %s failed: %w", name, err)
+	}
+	ctx4, cancel := context.WithTimeout(ctx, c.dhcpTimeout)
+	defer cancel()
+	ack, err := c.requestDHCPv4(ctx4, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	l, err := leaseFromACK(ack)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	l.Interface = name
+
+	// VLAN interfaces are configured by the MAC address of their parent and their VLAN ID.
+	base := link
+	if v, ok := link.(*netlink.Vlan); ok {
+		l.VLAN = v.VlanId
+		for _, p := range all {
+			if p.Attrs().Index == v.ParentIndex {
+				base = p
+			}
+		}
+	}
+	mac := base.Attrs().PermHWAddr
+	if len(mac) == 0 {
+		mac = base.Attrs().HardwareAddr
+	}
+	l.MAC = mac.String()
+
+	ctx6, cancel6 := context.WithTimeout(ctx, c.dhcp6Timeout)
+	defer cancel6()
+	if reply, err := c.requestDHCPv6(ctx6, name); err == nil {
+		l.addIPv6(reply)
+	} else {
+		fmt.Printf("no DHCPv6 lease on %s: %v\n", name, err)
+	}
+	return &l, nil
+}
+
+// requestDHCPv4 gets a DHCPv4 lease on the interface, retrying until ctx is done.
+func requestDHCPv4(ctx context.Context, iface string) (*dhcpv4.DHCPv4, error) {
+	client, err := nclient4.New(iface)
+	if err != nil {
+		return nil, fmt.Errorf("creating the DHCPv4 client failed: %w", err)
+	}
+	defer client.Close()
+	for {
+		lease, err := client.Request(ctx, dhcpv4.WithRequestedOptions(dhcpRequestedOptions...))
+		if err == nil {
+			return lease.ACK, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no DHCPv4 lease: %w", err)
+		}
+	}
+}
+
+// requestDHCPv6 gets a DHCPv6 lease on the interface. The link-local address of the interface can still
+// be tentative, so creating the client is retried until ctx is done.
+func requestDHCPv6(ctx context.Context, iface string) (*dhcpv6.Message, error) {
+	for {
+		client, err := nclient6.New(iface)
+		if err == nil {
+			defer client.Close()
+			return client.RapidSolicit(ctx, dhcpv6.WithRequestedOptions(dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionDomainSearchList))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("creating the DHCPv6 client failed: %w", err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// dhcp runs the built-in DHCP client on the provisioning interface, or on all the interfaces.
+func (c *configurator) dhcp(ctx context.Context, sel interfaceSelection, selected bool) ([]dhcpLease, error) {
+	links, err := c.dhcpLinks(ctx, sel, selected)
+	if err != nil {
+		return nil, err
+	}
+	return c.runDHCP(ctx, links)
+}
+
+// dhcpLinks returns the links to run the built-in DHCP client on: the provisioning interface when
+// there is an interface selection, otherwise all the interfaces backed by a device.
+func (c *configurator) dhcpLinks(ctx context.Context, sel interfaceSelection, selected bool) ([]netlink.Link, error) {
+	if selected {
+		link, err := c.selectLink(ctx, sel)
+		if err != nil {
+			return nil, err
+		}
+		return []netlink.Link{link}, nil
+	}
+	links, err := c.nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links failed: %w", err)
+	}
+	physical := c.physicalLinks(links)
+	if len(physical) == 0 {
+		return nil, errors.New("no interface to run the DHCP client on")
+	}
+	return physical, nil
+}
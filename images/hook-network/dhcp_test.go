@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+	"github.com/vishvananda/netlink"
+)
+
+// ack returns a DHCPACK for 10.0.0.2/24 with the options.
+func ack(t *testing.T, options ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+	t.Helper()
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(net.IPv4(10, 0, 0, 2)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptSubnetMask(net.CIDRMask(24, 32))),
+	}
+	for _, o := range options {
+		mods = append(mods, dhcpv4.WithOption(o))
+	}
+	m, err := dhcpv4.New(mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLeaseFromACK(t *testing.T) {
+	tests := map[string]struct {
+		options []dhcpv4.Option
+		want    dhcpLease
+		wantErr bool
+	}{
+		"network options": {
+			options: []dhcpv4.Option{
+				dhcpv4.OptRouter(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 254)),
+				dhcpv4.OptDNS(net.IPv4(10, 0, 0, 53)),
+				dhcpv4.OptDomainName("example.com"),
+				dhcpv4.OptHostName("worker-01"),
+				dhcpv4.OptNTPServers(net.IPv4(10, 0, 0, 123)),
+				dhcpv4.OptIPAddressLeaseTime(time.Hour),
+				dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, []byte{0x23, 0x28}),
+				dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: []string{"example.com", "example.net"}}),
+			},
+			want: dhcpLease{
+				Address:    netip.MustParsePrefix("10.0.0.2/24"),
+				Routes:     []routeConfig{{Via: netip.MustParseAddr("10.0.0.1")}},
+				DNS:        []netip.Addr{netip.MustParseAddr("10.0.0.53")},
+				DomainName: "example.com",
+				Search:     []string{"example.com", "example.net"},
+				Hostname:   "worker-01",
+				NTP:        []netip.Addr{netip.MustParseAddr("10.0.0.123")},
+				MTU:        9000,
+				ServerID:   "10.0.0.1",
+				LeaseTime:  3600,
+			},
+		},
+		"classless static routes replace the routers": {
+			options: []dhcpv4.Option{
+				dhcpv4.OptRouter(net.IPv4(10, 0, 0, 1)),
+				dhcpv4.OptClasslessStaticRoute(
+					&dhcpv4.Route{Dest: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Router: net.IPv4(10, 0, 0, 254)},
+					&dhcpv4.Route{Dest: &net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}, Router: net.IPv4(10, 0, 0, 253)},
+				),
+			},
+			want: dhcpLease{
+				Address: netip.MustParsePrefix("10.0.0.2/24"),
+				Routes: []routeConfig{
+					{To: netip.MustParsePrefix("0.0.0.0/0"), Via: netip.MustParseAddr("10.0.0.254")},
+					{To: netip.MustParsePrefix("192.168.0.0/16"), Via: netip.MustParseAddr("10.0.0.253")},
+				},
+				ServerID: "10.0.0.1",
+			},
+		},
+		"vendor options": {
+			options: []dhcpv4.Option{
+				dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, append([]byte{1, 16}, "registry=quay.io"...)),
+				dhcpv4.OptGeneric(dhcpv4.OptionVendorIdentifyingVendorSpecific, append([]byte{0, 0, 0xe8, 0x39, 10, 2, 8}, "registry"...)),
+				dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(224), []byte("docker_registry=registry.example")),
+			},
+			want: dhcpLease{
+				Address:         netip.MustParsePrefix("10.0.0.2/24"),
+				ServerID:        "10.0.0.1",
+				VendorOptions:   map[string]string{"1": "registry=quay.io"},
+				VIVendorOptions: map[string]map[string]string{"59449": {"2": "registry"}},
+			},
+		},
+		"malformed vendor options": {
+			options: []dhcpv4.Option{dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, []byte{1, 10, 'a'})},
+			want:    dhcpLease{Address: netip.MustParsePrefix("10.0.0.2/24"), ServerID: "10.0.0.1"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := ack(t, tt.options...)
+			got, err := leaseFromACK(m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got.Options) != len(m.Options) {
+				t.Errorf("got %d options, want %d", len(got.Options), len(m.Options))
+			}
+			opts := cmp.Options{
+				cmpopts.IgnoreFields(dhcpLease{}, "AcquiredAt", "Options"),
+				cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{}),
+			}
+			if diff := cmp.Diff(tt.want, got, opts); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	if _, err := leaseFromACK(&dhcpv4.DHCPv4{YourIPAddr: net.IPv4zero, Options: dhcpv4.Options{}}); err == nil {
+		t.Error("got no error for a DHCPACK without an address")
+	}
+}
+
+func TestRunDHCP(t *testing.T) {
+	reply, err := dhcpv6.NewMessage(dhcpv6.WithIANA(dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("2001:db8::2"), PreferredLifetime: time.Hour, ValidLifetime: 2 * time.Hour}), dhcpv6.WithDNS(net.ParseIP("2001:db8::53")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		links         []netlink.Link
+		acks          map[string]*dhcpv4.DHCPv4
+		replies       map[string]*dhcpv6.Message
+		wantAddrs     map[string][]string
+		wantLifetimes map[string]string
+		wantRoutes    []string
+		wantDNS       string
+		wantRenew     string
+		wantErr       bool
+	}{
+		"dual stack": {
+			links:         []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			acks:          map[string]*dhcpv4.DHCPv4{"eth0": ack(t, dhcpv4.OptRouter(net.IPv4(10, 0, 0, 1)), dhcpv4.OptDNS(net.IPv4(10, 0, 0, 53)), dhcpv4.OptIPAddressLeaseTime(time.Hour))},
+			replies:       map[string]*dhcpv6.Message{"eth0": reply},
+			wantAddrs:     map[string][]string{"eth0": {"10.0.0.2/24", "2001:db8::2/128"}},
+			wantLifetimes: map[string]string{"10.0.0.2/24": "3600/3600", "2001:db8::2/128": "7200/3600"},
+			wantRenew:     "eth0\n",
+			wantRoutes:    []string{"default via 10.0.0.1 dev 2"},
+			wantDNS:       "nameserver 10.0.0.53\nnameserver 2001:db8::53\n",
+		},
+		"only the first lease sets the default route": {
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02"), device(4, "eth2", "de:ad:be:ef:00:03")},
+			acks: map[string]*dhcpv4.DHCPv4{
+				"eth0": ack(t, dhcpv4.OptRouter(net.IPv4(10, 0, 0, 1))),
+				"eth2": ack(t, dhcpv4.OptRouter(net.IPv4(10, 0, 0, 254))),
+			},
+			wantAddrs:  map[string][]string{"eth0": {"10.0.0.2/24"}, "eth2": {"10.0.0.2/24"}},
+			wantRoutes: []string{"default via 10.0.0.1 dev 2"},
+			wantRenew:  "eth0\neth2\n",
+		},
+		"no lease": {
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			nl := newFakeNetlink(tt.links...)
+			c := &configurator{
+				nl:          nl,
+				root:        t.TempDir(),
+				sethostname: func(string) error { return nil },
+				requestDHCPv4: func(_ context.Context, iface string) (*dhcpv4.DHCPv4, error) {
+					if m, ok := tt.acks[iface]; ok {
+						return m, nil
+					}
+					return nil, errors.New("timeout")
+				},
+				requestDHCPv6: func(_ context.Context, iface string) (*dhcpv6.Message, error) {
+					if m, ok := tt.replies[iface]; ok {
+						return m, nil
+					}
+					return nil, errors.New("timeout")
+				},
+				dhcpTimeout:  time.Second,
+				dhcp6Timeout: time.Second,
+			}
+			leases, err := c.runDHCP(context.Background(), tt.links)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.wantAddrs, nl.addrs); diff != "" {
+				t.Errorf("addresses: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantLifetimes, nl.lifetimes, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("address lifetimes: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantRoutes, nl.routes); diff != "" {
+				t.Errorf("routes: %s", diff)
+			}
+			if tt.wantRenew != "" {
+				b, err := os.ReadFile(filepath.Join(c.root, dhcpRenewInterfacesFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.wantRenew, string(b)); diff != "" {
+					t.Errorf("renewed interfaces: %s", diff)
+				}
+			}
+			if tt.wantDNS != "" {
+				b, err := os.ReadFile(filepath.Join(c.root, resolvConfFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.wantDNS, string(b)); diff != "" {
+					t.Errorf("resolv.conf: %s", diff)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(c.root, interfacesFile)); err != nil {
+				t.Errorf("the interfaces file, which makes dhcp.sh skip dhcpcd, was not written: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(c.root, dhcpInterfacesFile)); err == nil {
+				t.Error("the DHCP interfaces file, which makes dhcp.sh run dhcpcd, was written")
+			}
+
+			b, err := os.ReadFile(filepath.Join(c.root, leaseFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written []dhcpLease
+			if err := json.Unmarshal(b, &written); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(leases, written, cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{})); diff != "" {
+				t.Errorf("lease file: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// lldpNeighbor is the switch port an interface is cabled to, as advertised in LLDP frames.
+type lldpNeighbor struct {
+	ChassisID  string `json:"chassisID"`
+	PortID     string `json:"portID"`
+	SystemName string `json:"systemName,omitempty"`
+	// PortVLAN is the untagged VLAN of the switch port, 0 when it is not advertised.
+	PortVLAN int        `json:"portVLAN,omitempty"`
+	VLANs    []lldpVLAN `json:"vlans,omitempty"`
+}
+
+// lldpVLAN is a VLAN the switch port is a member of.
+type lldpVLAN struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// lldpFrame is a neighbor received on an interface.
+type lldpFrame struct {
+	iface    string
+	neighbor lldpNeighbor
+}
+
+const (
+	lldpTLVEnd        = 0
+	lldpTLVChassisID  = 1
+	lldpTLVPortID     = 2
+	lldpTLVSystemName = 5
+	lldpTLVOrg        = 127
+
+	lldpChassisIDMAC = 4
+	lldpPortIDMAC    = 3
+
+	// The IEEE 802.1 organizationally specific TLVs advertise the VLANs of the switch port.
+	lldpOrg8021PortVLAN = 1
+	lldpOrg8021VLANName = 3
+)
+
+// lldpOUI8021 is the OUI of the IEEE 802.1 organizationally specific TLVs.
+var lldpOUI8021 = []byte{0x00, 0x80, 0xc2}
+
+// lldpMulticast is the nearest bridge group address LLDP frames are sent to.
+var lldpMulticast = [8]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// parseLLDP decodes the TLVs of an LLDP frame, without its Ethernet header.
+func parseLLDP(b []byte) (lldpNeighbor, error) {
+	var n lldpNeighbor
+	for len(b) >= 2 {
+		typ, length := b[0]>>1, int(binary.BigEndian.Uint16(b[:2])&0x1ff)
+		b = b[2:]
+		if typ == lldpTLVEnd {
+			break
+		}
+		if length > len(b) {
+			return lldpNeighbor{}, fmt.Errorf("TLV %d of length %d exceeds the frame", typ, length)
+		}
+		value := b[:length]
+		b = b[length:]
+		switch typ {
+		case lldpTLVChassisID:
+			if length < 2 {
+				return lldpNeighbor{}, errors.New("chassis ID TLV is too short")
+			}
+			n.ChassisID = lldpID(value[0], lldpChassisIDMAC, value[1:])
+		case lldpTLVPortID:
+			if length < 2 {
+				return lldpNeighbor{}, errors.New("port ID TLV is too short")
+			}
+			n.PortID = lldpID(value[0], lldpPortIDMAC, value[1:])
+		case lldpTLVSystemName:
+			n.SystemName = string(value)
+		case lldpTLVOrg:
+			if err := n.parseOrg(value); err != nil {
+				return lldpNeighbor{}, err
+			}
+		}
+	}
+	if n.ChassisID == "" || n.PortID == "" {
+		return lldpNeighbor{}, errors.New("chassis ID or port ID TLV is missing")
+	}
+	return n, nil
+}
+
+// parseOrg decodes the IEEE 802.1 VLAN TLVs. Other organizationally specific TLVs are ignored.
+func (n *lldpNeighbor) parseOrg(value []byte) error {
+	if len(value) < 4 || !bytes.Equal(value[:3], lldpOUI8021) {
+		return nil
+	}
+	subtype, value := value[3], value[4:]
+	switch subtype {
+	case lldpOrg8021PortVLAN:
+		if len(value) < 2 {
+			return errors.New("port VLAN ID TLV is too short")
+		}
+		n.PortVLAN = int(binary.BigEndian.Uint16(value))
+	case lldpOrg8021VLANName:
+		if len(value) < 3 || int(value[2]) > len(value)-3 {
+			return errors.New("VLAN name TLV is too short")
+		}
+		n.VLANs = append(n.VLANs, lldpVLAN{ID: int(binary.BigEndian.Uint16(value)), Name: string(value[3 : 3+int(value[2])])})
+	}
+	return nil
+}
+
+// lldpID formats a chassis or port ID: MAC addresses in the usual notation, other subtypes as text.
+func lldpID(subtype, macSubtype byte, id []byte) string {
+	if subtype == macSubtype && len(id) == 6 {
+		return net.HardwareAddr(id).String()
+	}
+	return string(id)
+}
+
+// listenLLDP returns the LLDP neighbors received on the interfaces until ctx is done, when the channel is closed.
+// Interfaces that cannot be listened on are skipped.
+func listenLLDP(ctx context.Context, links []netlink.Link) <-chan lldpFrame {
+	out := make(chan lldpFrame)
+	var wg sync.WaitGroup
+	for _, l := range links {
+		fd, err := lldpSocket(l.Attrs().Index)
+		if err != nil {
+			fmt.Printf("not listening for LLDP on %s: %v\n", l.Attrs().Name, err)
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer unix.Close(fd)
+			buf := make([]byte, 1518)
+			for ctx.Err() == nil {
+				n, _, err := unix.Recvfrom(fd, buf, 0)
+				// Frames shorter than an Ethernet header and receive timeouts are ignored.
+				if err != nil || n < 14 {
+					continue
+				}
+				neighbor, err := parseLLDP(buf[14:n])
+				if err != nil {
+					continue
+				}
+				select {
+				case out <- lldpFrame{iface: name, neighbor: neighbor}:
+				case <-ctx.Done():
+				}
+			}
+		}(l.Attrs().Name)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// lldpSocket returns a raw socket receiving the LLDP frames of the interface with index ifindex.
+// It times out every second, so that listeners notice when they have to stop.
+func lldpSocket(ifindex int) (int, error) {
+	proto := int(htons(unix.ETH_P_LLDP))
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_LLDP), Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("binding the LLDP socket failed: %w", err)
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_MULTICAST, Alen: 6, Address: lldpMulticast}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("joining the LLDP multicast group failed: %w", err)
+	}
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("setting the LLDP socket timeout failed: %w", err)
+	}
+	return fd, nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// lldpFile is where the neighbors discovered at boot are written, for tink-worker actions and
+// the BootKit status endpoint.
+const lldpFile = "/worker/lldp.json"
+
+// lldpInterface is an interface and the switch port it is cabled to.
+type lldpInterface struct {
+	Interface string `json:"interface"`
+	MAC       string `json:"mac"`
+	lldpNeighbor
+}
+
+// discoverLLDP listens for LLDP frames on the up interfaces for at most lldpTimeout, or until every
+// one of them received a frame, and writes the neighbors to the LLDP file. Interfaces without a
+// neighbor are left out.
+func (c *configurator) discoverLLDP(ctx context.Context) ([]lldpInterface, error) {
+	links, err := c.nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links failed: %w", err)
+	}
+	var up []netlink.Link
+	for _, l := range c.physicalLinks(links) {
+		if l.Attrs().Flags&net.FlagUp != 0 {
+			up = append(up, l)
+		}
+	}
+
+	neighbors := map[string]lldpNeighbor{}
+	if len(up) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, c.lldpTimeout)
+		defer cancel()
+		for f := range c.listenLLDP(ctx, up) {
+			neighbors[f.iface] = f.neighbor
+			if len(neighbors) == len(up) {
+				cancel()
+			}
+		}
+	}
+
+	found := []lldpInterface{}
+	for _, l := range up {
+		n, ok := neighbors[l.Attrs().Name]
+		if !ok {
+			continue
+		}
+		mac := l.Attrs().PermHWAddr
+		if len(mac) == 0 {
+			mac = l.Attrs().HardwareAddr
+		}
+		found = append(found, lldpInterface{Interface: l.Attrs().Name, MAC: mac.String(), lldpNeighbor: n})
+	}
+	b, err := json.MarshalIndent(found, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return found, c.writeFile(lldpFile, append(b, '\n'))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+// tlv encodes an LLDP TLV.
+func tlv(typ byte, value ...byte) []byte {
+	return append([]byte{typ<<1 | byte(len(value)>>8), byte(len(value))}, value...)
+}
+
+func TestParseLLDP(t *testing.T) {
+	frame := func(tlvs ...[]byte) []byte {
+		var b []byte
+		for _, t := range tlvs {
+			b = append(b, t...)
+		}
+		return b
+	}
+	chassisMAC := tlv(lldpTLVChassisID, append([]byte{lldpChassisIDMAC}, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55)...)
+	portName := tlv(lldpTLVPortID, append([]byte{5}, "Ethernet12"...)...)
+	ttl := tlv(3, 0x00, 0x78)
+	end := tlv(lldpTLVEnd)
+
+	tests := map[string]struct {
+		frame   []byte
+		want    lldpNeighbor
+		wantErr bool
+	}{
+		"mac chassis and named port": {
+			frame: frame(chassisMAC, portName, ttl, tlv(lldpTLVSystemName, []byte("tor-01")...), end),
+			want:  lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet12", SystemName: "tor-01"},
+		},
+		"local chassis and mac port": {
+			frame: frame(tlv(lldpTLVChassisID, append([]byte{7}, "sw1"...)...), tlv(lldpTLVPortID, append([]byte{lldpPortIDMAC}, 0x00, 0x11, 0x22, 0x33, 0x44, 0x56)...), ttl, end),
+			want:  lldpNeighbor{ChassisID: "sw1", PortID: "00:11:22:33:44:56"},
+		},
+		"no end tlv": {
+			frame: frame(chassisMAC, portName, ttl),
+			want:  lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet12"},
+		},
+		"vlans": {
+			frame: frame(chassisMAC, portName, ttl,
+				tlv(lldpTLVOrg, 0x00, 0x80, 0xc2, lldpOrg8021PortVLAN, 0x00, 0x1e),
+				tlv(lldpTLVOrg, append([]byte{0x00, 0x80, 0xc2, lldpOrg8021VLANName, 0x00, 0x1e, 4}, "prov"...)...),
+				tlv(lldpTLVOrg, 0x00, 0x80, 0xc2, lldpOrg8021VLANName, 0x00, 0x28, 0),
+				tlv(lldpTLVOrg, 0x00, 0x12, 0x0f, 1, 0x03, 0x6c, 0x00, 0x00, 0x10), // 802.3 MAC/PHY, ignored
+				end),
+			want: lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet12", PortVLAN: 30, VLANs: []lldpVLAN{{ID: 30, Name: "prov"}, {ID: 40}}},
+		},
+		"truncated vlan name": {frame: frame(chassisMAC, portName, tlv(lldpTLVOrg, 0x00, 0x80, 0xc2, lldpOrg8021VLANName, 0x00, 0x1e, 4, 'p')), wantErr: true},
+		"missing port id":     {frame: frame(chassisMAC, ttl, end), wantErr: true},
+		"truncated":           {frame: frame(chassisMAC, portName[:5]), wantErr: true},
+		"empty chassis":       {frame: frame(tlv(lldpTLVChassisID), portName, end), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseLLDP(tt.frame)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDiscoverLLDP(t *testing.T) {
+	up := func(l netlink.Link) netlink.Link {
+		l.Attrs().Flags |= net.FlagUp
+		return l
+	}
+	tor := lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet12", SystemName: "tor-01", PortVLAN: 30}
+	tests := map[string]struct {
+		links  []netlink.Link
+		frames []lldpFrame
+		want   string
+	}{
+		"neighbors of up interfaces": {
+			links: []netlink.Link{up(device(2, "eth0", "de:ad:be:ef:00:01")), up(device(3, "eth1", "de:ad:be:ef:00:02")), device(4, "eth2", "de:ad:be:ef:00:03")},
+			frames: []lldpFrame{
+				{iface: "eth1", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:66", PortID: "Ethernet12", SystemName: "tor-02"}},
+				// Only the latest frame of an interface is kept.
+				{iface: "eth1", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:66", PortID: "Ethernet13", SystemName: "tor-02"}},
+				{iface: "eth0", neighbor: tor},
+			},
+			want: `[
+  {
+    "interface": "eth0",
+    "mac": "de:ad:be:ef:00:01",
+    "chassisID": "00:11:22:33:44:55",
+    "portID": "Ethernet12",
+    "systemName": "tor-01",
+    "portVLAN": 30
+  },
+  {
+    "interface": "eth1",
+    "mac": "de:ad:be:ef:00:02",
+    "chassisID": "00:11:22:33:44:66",
+    "portID": "Ethernet13",
+    "systemName": "tor-02"
+  }
+]
+`,
+		},
+		"no neighbors": {
+			links: []netlink.Link{up(device(2, "eth0", "de:ad:be:ef:00:01"))},
+			want:  "[]\n",
+		},
+		"no up interfaces": {
+			links:  []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			frames: []lldpFrame{{iface: "eth0", neighbor: tor}},
+			want:   "[]\n",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, l := range tt.links {
+				dir := filepath.Join(root, "/sys/class/net", l.Attrs().Name)
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink("../../../0000:3b:00.0", filepath.Join(dir, "device")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := &configurator{
+				nl:          newFakeNetlink(tt.links...),
+				root:        root,
+				listenLLDP:  fakeListenLLDP(tt.frames),
+				lldpTimeout: 50 * time.Millisecond,
+			}
+			if _, err := c.discoverLLDP(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(filepath.Join(root, lldpFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, string(b)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// hook-network statically configures the network from the kernel command line. It runs once at boot,
+// before the DHCP client, which is skipped when a static configuration was applied.
+// Without a static configuration, it selects the interface the DHCP client runs on, or with
+// hook_dhcp_client=go, runs its built-in DHCP client instead of dhcpcd.
+//
+// Run as "hook-network lldp", it instead reports the LLDP neighbors of the up interfaces, and as
+// "hook-network time", it syncs the time with SNTP.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lldp" {
+		found, err := newConfigurator().discoverLLDP(context.Background())
+		if err != nil {
+			fmt.Println("error discovering LLDP neighbors:", err)
+			os.Exit(1)
+		}
+		for _, i := range found {
+			fmt.Printf("interface %s is cabled to %s (%s) port %s\n", i.Interface, i.SystemName, i.ChassisID, i.PortID)
+		}
+		fmt.Printf("wrote %d LLDP neighbors to %s\n", len(found), lldpFile)
+		return
+	}
+
+	content, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		fmt.Println("error reading /proc/cmdline", err)
+		os.Exit(1)
+	}
+	cmdLines := strings.Fields(string(content))
+
+	if len(os.Args) > 1 && os.Args[1] == "time" {
+		c := newConfigurator()
+		result, err := c.syncTime(c.ntpServers(cmdLines))
+		if err != nil {
+			fmt.Println("error syncing the time:", err)
+			os.Exit(1)
+		}
+		skew := time.Duration(result.SkewSeconds * float64(time.Second))
+		fmt.Printf("set the clock from %s, it was off by %v\n", result.Server, skew)
+		if skew.Abs() > clockSkewWarning {
+			fmt.Printf("WARNING: the clock was off by more than %v, which breaks TLS to tink-server and registries\n", clockSkewWarning)
+		}
+		return
+	}
+	cfg, ok, err := parseCmdLine(cmdLines)
+	if err != nil {
+		fmt.Println("error parsing the static network configuration:", err)
+		os.Exit(1)
+	}
+	if ok {
+		if err := newConfigurator().apply(cfg); err != nil {
+			fmt.Println("error configuring the network:", err)
+			os.Exit(1)
+		}
+		for _, i := range cfg.Interfaces {
+			fmt.Printf("configured interface %v: vlan %d, addresses %v, routes %v\n", i.id(), i.VLAN, i.Addresses, i.Routes)
+		}
+		return
+	}
+
+	sel, ok, err := parseSelection(cmdLines)
+	if err != nil {
+		fmt.Println("error parsing the interface selection:", err)
+		os.Exit(1)
+	}
+	c := newConfigurator()
+	if dhcpClientEnabled(cmdLines) {
+		leases, err := c.dhcp(context.Background(), sel, ok)
+		if err == nil {
+			for _, l := range leases {
+				fmt.Printf("got lease %v on %s from %s, wrote it to %s\n", l.Address, l.Interface, l.ServerID, leaseFile)
+			}
+			return
+		}
+		// Without the interfaces file, dhcp.sh runs dhcpcd instead.
+		fmt.Println("error running the built-in DHCP client, falling back to dhcpcd:", err)
+	}
+	if !ok {
+		fmt.Println("no interface selection configured with hook_interface=, hw_addr= or worker_id=, dhcpcd will run on the interface of interface= or on all the e* interfaces")
+		return
+	}
+	name, err := c.selectInterface(context.Background(), sel)
+	if err != nil {
+		// dhcp.sh falls back to running the DHCP client on all the interfaces.
+		fmt.Println("error selecting the provisioning interface:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("selected provisioning interface %s by %s\n", name, sel.kind)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "github.com/vishvananda/netlink"
+
+// netlinker is the subset of the netlink API used to configure interfaces.
+// *netlink.Handle implements it; tests use a fake.
+type netlinker interface {
+	LinkList() ([]netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	RouteReplace(route *netlink.Route) error
+}
+
+var _ netlinker = (*netlink.Handle)(nil)
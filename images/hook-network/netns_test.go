@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// TestApplyInNetworkNamespace applies configurations with the real netlink API, in a new network namespace
+// with dummy interfaces. It needs root, and is skipped when the kernel lacks the bonding or 8021q module.
+func TestApplyInNetworkNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace requires root")
+	}
+	tests := map[string]struct {
+		cfg         interfaceConfig
+		wantLink    string
+		wantSlaves  []string
+		wantAddress string
+	}{
+		"interface": {
+			cfg:         interfaceConfig{MAC: mustMAC("de:ad:be:ef:00:01"), Addresses: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/24")}, Routes: []routeConfig{{Via: netip.MustParseAddr("192.0.2.1")}}},
+			wantLink:    "eth0",
+			wantAddress: "192.0.2.10/24",
+		},
+		"vlan over a bond": {
+			cfg: interfaceConfig{
+				Bond:      &bondConfig{Name: "bond0", Interfaces: []hardwareAddr{mustMAC("de:ad:be:ef:00:01"), mustMAC("de:ad:be:ef:00:02")}, Mode: "802.3ad", LACPRate: "fast"},
+				VLAN:      100,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/24")},
+				Routes:    []routeConfig{{Via: netip.MustParseAddr("192.0.2.1")}},
+			},
+			wantLink:    "bond0.100",
+			wantSlaves:  []string{"eth0", "eth1"},
+			wantAddress: "192.0.2.10/24",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newTestNamespace(t)
+			for i, mac := range []string{"de:ad:be:ef:00:01", "de:ad:be:ef:00:02"} {
+				hw, _ := net.ParseMAC(mac)
+				attrs := netlink.NewLinkAttrs()
+				attrs.Name, attrs.HardwareAddr = "eth"+string(rune('0'+i)), hw
+				if err := h.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+					t.Skipf("creating a dummy interface failed: %v", err)
+				}
+			}
+			if tt.cfg.Bond != nil {
+				tt.cfg.Bond.setDefaults()
+			}
+
+			c := &configurator{nl: h, root: t.TempDir(), sethostname: func(string) error { return nil }}
+			if err := c.apply(networkConfig{Interfaces: []interfaceConfig{tt.cfg}}); err != nil {
+				if errors.Is(err, unix.EOPNOTSUPP) {
+					t.Skipf("the kernel does not support the interface type: %v", err)
+				}
+				t.Fatal(err)
+			}
+
+			link, err := h.LinkByName(tt.wantLink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Attrs().Flags&net.FlagUp == 0 {
+				t.Errorf("%s is not up", tt.wantLink)
+			}
+			addrs, err := h.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0].IPNet.String() != tt.wantAddress {
+				t.Errorf("got addresses %v, want %s", addrs, tt.wantAddress)
+			}
+			routes, err := h.RouteList(link, netlink.FAMILY_V4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gw bool
+			for _, r := range routes {
+				gw = gw || r.Gw.Equal(net.ParseIP("192.0.2.1"))
+			}
+			if !gw {
+				t.Errorf("no default route via 192.0.2.1 in %v", routes)
+			}
+			if tt.cfg.Bond == nil {
+				return
+			}
+			bond, err := h.LinkByName(tt.cfg.Bond.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.wantSlaves {
+				slave, err := h.LinkByName(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if slave.Attrs().MasterIndex != bond.Attrs().Index {
+					t.Errorf("%s is not enslaved to %s", name, tt.cfg.Bond.Name)
+				}
+			}
+		})
+	}
+}
+
+// newTestNamespace returns a netlink handle for a new network namespace, which is deleted when the test ends.
+func newTestNamespace(t *testing.T) *netlink.Handle {
+	t.Helper()
+	runtime.LockOSThread()
+	t.Cleanup(runtime.UnlockOSThread)
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		orig.Close()
+		t.Skipf("creating a network namespace failed: %v", err)
+	}
+	// netns.New switched the thread to the new namespace; switch back so the namespace is only used through the handle.
+	if err := netns.Set(orig); err != nil {
+		t.Fatal(err)
+	}
+	orig.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.Close()
+		ns.Close()
+	})
+	return h
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// selectorKind is how the provisioning interface, the one the DHCP client runs on, is selected.
+type selectorKind string
+
+const (
+	// selectByMAC selects the interface with a MAC address.
+	selectByMAC selectorKind = "mac"
+	// selectByPCI selects the interface of a PCI device, such as 0000:3b:00.0 or pci-0000:3b:00.0.
+	selectByPCI selectorKind = "pci"
+	// selectByCarrier selects the first interface, by name, that has a carrier.
+	selectByCarrier selectorKind = "carrier"
+	// selectByLLDP selects the interface cabled to a switch, by the switch's system name or
+	// chassis ID, and optionally the port ID.
+	selectByLLDP selectorKind = "lldp"
+)
+
+// interfaceSelection is how to select the provisioning interface, from hook_interface=:
+//
+//	hook_interface=mac:de:ad:be:ef:fe:ed
+//	hook_interface=pci:0000:3b:00.0
+//	hook_interface=carrier
+//	hook_interface=lldp:tor-switch-01/Ethernet12
+//
+// Without hook_interface=, the MAC address in hw_addr= or worker_id= is used. When vlan_id= is set,
+// the VLAN interface on top of the selected interface is the provisioning interface.
+type interfaceSelection struct {
+	kind     selectorKind
+	mac      net.HardwareAddr
+	pci      string
+	lldpName string
+	lldpPort string
+	vlan     int
+}
+
+const (
+	// carrierTimeout is how long interfaces are given to get a carrier once they are brought up.
+	carrierTimeout = 15 * time.Second
+	// lldpTimeout is how long LLDP frames are listened for. Switches usually send one every 30 seconds.
+	lldpTimeout = 45 * time.Second
+)
+
+// parseSelection returns the interface selection in the kernel command line. It returns false when
+// there is nothing to select by, or when interface= explicitly names the interface.
+func parseSelection(cmdLines []string) (interfaceSelection, bool, error) {
+	values := map[string]string{}
+	for i := range cmdLines {
+		cmdLine := strings.SplitN(strings.TrimSpace(cmdLines[i]), "=", 2)
+		if len(cmdLine) == 2 {
+			values[cmdLine[0]] = strings.TrimSpace(cmdLine[1])
+		}
+	}
+	if values["interface"] != "" {
+		return interfaceSelection{}, false, nil
+	}
+
+	var sel interfaceSelection
+	if v := values["vlan_id"]; v != "" {
+		vlan, err := strconv.Atoi(v)
+		if err != nil || vlan < 1 || vlan > 4094 {
+			return interfaceSelection{}, true, fmt.Errorf("invalid vlan_id %q", v)
+		}
+		sel.vlan = vlan
+	}
+
+	value := values["hook_interface"]
+	if value == "" {
+		for _, key := range []string{"hw_addr", "worker_id"} {
+			if mac, err := net.ParseMAC(values[key]); err == nil && len(mac) == 6 {
+				sel.kind, sel.mac = selectByMAC, mac
+				return sel, true, nil
+			}
+		}
+		return interfaceSelection{}, false, nil
+	}
+
+	kind, arg, _ := strings.Cut(value, ":")
+	sel.kind = selectorKind(kind)
+	switch sel.kind {
+	case selectByMAC:
+		mac, err := parseMAC(arg)
+		if err != nil {
+			return interfaceSelection{}, true, fmt.Errorf("hook_interface: %w", err)
+		}
+		sel.mac = mac
+	case selectByPCI:
+		sel.pci = strings.TrimPrefix(arg, "pci-")
+		if sel.pci == "" {
+			return interfaceSelection{}, true, errors.New("hook_interface: a PCI address is required")
+		}
+	case selectByCarrier:
+	case selectByLLDP:
+		sel.lldpName, sel.lldpPort, _ = strings.Cut(arg, "/")
+		if sel.lldpName == "" {
+			return interfaceSelection{}, true, errors.New("hook_interface: a switch system name or chassis ID is required")
+		}
+	default:
+		return interfaceSelection{}, true, fmt.Errorf("hook_interface %q must be one of mac:, pci:, carrier or lldp:", value)
+	}
+	return sel, true, nil
+}
+
+// selectInterface selects the provisioning interface and writes it to the DHCP interfaces file,
+// so that dhcp.sh runs the DHCP client on exactly that interface.
+func (c *configurator) selectInterface(ctx context.Context, sel interfaceSelection) (string, error) {
+	link, err := c.selectLink(ctx, sel)
+	if err != nil {
+		return "", err
+	}
+	name := link.Attrs().Name
+	return name, c.writeFile(dhcpInterfacesFile, []byte(name+"\n"))
+}
+
+// selectLink selects the provisioning interface and brings it up, creating the VLAN interface on top of
+// it when the selection has a VLAN.
+func (c *configurator) selectLink(ctx context.Context, sel interfaceSelection) (netlink.Link, error) {
+	links, err := c.nl.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links failed: %w", err)
+	}
+	candidates := c.physicalLinks(links)
+
+	var link netlink.Link
+	switch sel.kind {
+	case selectByMAC:
+		link = findLink(candidates, sel.mac)
+	case selectByPCI:
+		for _, l := range candidates {
+			if c.pciAddress(l.Attrs().Name) == sel.pci {
+				link = l
+				break
+			}
+		}
+	case selectByCarrier:
+		link, err = c.selectByCarrier(ctx, candidates)
+	case selectByLLDP:
+		link, err = c.selectByLLDP(ctx, candidates, sel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, fmt.Errorf("no interface matches %s selector", sel.kind)
+	}
+
+	if err := c.nl.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("bringing up %s failed: %w", link.Attrs().Name, err)
+	}
+	if sel.vlan != 0 {
+		if link, err = c.ensureVLAN(link, sel.vlan); err != nil {
+			return nil, err
+		}
+		if err := c.nl.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("bringing up %s failed: %w", link.Attrs().Name, err)
+		}
+	}
+	return link, nil
+}
+
+// physicalLinks returns the links backed by a device, sorted by name.
+func (c *configurator) physicalLinks(links []netlink.Link) []netlink.Link {
+	var physical []netlink.Link
+	for _, l := range links {
+		if _, err := os.Lstat(filepath.Join(c.root, "/sys/class/net", l.Attrs().Name, "device")); err == nil {
+			physical = append(physical, l)
+		}
+	}
+	sort.Slice(physical, func(i, j int) bool { return physical[i].Attrs().Name < physical[j].Attrs().Name })
+	return physical
+}
+
+// pciAddress returns the PCI address of the device of the interface, or an empty string when it has none.
+func (c *configurator) pciAddress(name string) string {
+	target, err := os.Readlink(filepath.Join(c.root, "/sys/class/net", name, "device"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// bringUp brings up the links that are down, so that they can get a carrier or receive LLDP frames.
+// It returns a function bringing them back down, except for the selected one.
+func (c *configurator) bringUp(links []netlink.Link) func(selected netlink.Link) {
+	var up []netlink.Link
+	for _, l := range links {
+		if l.Attrs().Flags&net.FlagUp != 0 {
+			continue
+		}
+		if err := c.nl.LinkSetUp(l); err != nil {
+			fmt.Printf("bringing up %s failed: %v\n", l.Attrs().Name, err)
+			continue
+		}
+		up = append(up, l)
+	}
+	return func(selected netlink.Link) {
+		for _, l := range up {
+			if selected == nil || l.Attrs().Index != selected.Attrs().Index {
+				_ = c.nl.LinkSetDown(l)
+			}
+		}
+	}
+}
+
+// selectByCarrier returns the first link, by name, that has a carrier within carrierTimeout.
+func (c *configurator) selectByCarrier(ctx context.Context, links []netlink.Link) (netlink.Link, error) {
+	restore := c.bringUp(links)
+	ctx, cancel := context.WithTimeout(ctx, c.carrierTimeout)
+	defer cancel()
+	t := time.NewTicker(c.pollInterval)
+	defer t.Stop()
+	for {
+		for _, l := range links {
+			current, err := c.nl.LinkByName(l.Attrs().Name)
+			if err == nil && current.Attrs().OperState == netlink.OperUp {
+				restore(current)
+				return current, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			restore(nil)
+			return nil, fmt.Errorf("no interface got a carrier within %v", c.carrierTimeout)
+		case <-t.C:
+		}
+	}
+}
+
+// selectByLLDP returns the link whose LLDP neighbor matches the selection within lldpTimeout.
+func (c *configurator) selectByLLDP(ctx context.Context, links []netlink.Link, sel interfaceSelection) (netlink.Link, error) {
+	restore := c.bringUp(links)
+	ctx, cancel := context.WithTimeout(ctx, c.lldpTimeout)
+	defer cancel()
+	for f := range c.listenLLDP(ctx, links) {
+		n := f.neighbor
+		if n.SystemName != sel.lldpName && n.ChassisID != sel.lldpName {
+			continue
+		}
+		if sel.lldpPort != "" && n.PortID != sel.lldpPort {
+			continue
+		}
+		for _, l := range links {
+			if l.Attrs().Name == f.iface {
+				fmt.Printf("selected %s, cabled to %s port %s\n", f.iface, sel.lldpName, n.PortID)
+				restore(l)
+				return l, nil
+			}
+		}
+	}
+	restore(nil)
+	return nil, fmt.Errorf("no LLDP neighbor matched %s within %v", sel.lldpName, c.lldpTimeout)
+}
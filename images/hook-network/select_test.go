@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseSelection(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		m, _ := net.ParseMAC(s)
+		return m
+	}
+	tests := map[string]struct {
+		cmdline string
+		want    interfaceSelection
+		wantOK  bool
+		wantErr bool
+	}{
+		"nothing":           {cmdline: "console=ttyS0 worker_id=3f0c4a2e-6a4e-4c7d-9bd8-a0e1e3f0b6a1"},
+		"worker_id mac":     {cmdline: "worker_id=de:ad:be:ef:fe:ed", wantOK: true, want: interfaceSelection{kind: selectByMAC, mac: mac("de:ad:be:ef:fe:ed")}},
+		"hw_addr wins":      {cmdline: "worker_id=de:ad:be:ef:fe:ed hw_addr=de:ad:be:ef:fe:ee vlan_id=30", wantOK: true, want: interfaceSelection{kind: selectByMAC, mac: mac("de:ad:be:ef:fe:ee"), vlan: 30}},
+		"interface= is set": {cmdline: "worker_id=de:ad:be:ef:fe:ed interface=eth1"},
+		"mac":               {cmdline: "worker_id=de:ad:be:ef:fe:ed hook_interface=mac:de-ad-be-ef-fe-ee", wantOK: true, want: interfaceSelection{kind: selectByMAC, mac: mac("de:ad:be:ef:fe:ee")}},
+		"pci":               {cmdline: "hook_interface=pci:pci-0000:3b:00.1", wantOK: true, want: interfaceSelection{kind: selectByPCI, pci: "0000:3b:00.1"}},
+		"carrier":           {cmdline: "hook_interface=carrier", wantOK: true, want: interfaceSelection{kind: selectByCarrier}},
+		"lldp with port":    {cmdline: "hook_interface=lldp:tor-01/Ethernet12", wantOK: true, want: interfaceSelection{kind: selectByLLDP, lldpName: "tor-01", lldpPort: "Ethernet12"}},
+		"lldp":              {cmdline: "hook_interface=lldp:tor-01", wantOK: true, want: interfaceSelection{kind: selectByLLDP, lldpName: "tor-01"}},
+		"unknown selector":  {cmdline: "hook_interface=name:eth0", wantErr: true},
+		"bad mac":           {cmdline: "hook_interface=mac:de-ad", wantErr: true},
+		"empty lldp":        {cmdline: "hook_interface=lldp:", wantErr: true},
+		"bad vlan":          {cmdline: "hook_interface=carrier vlan_id=5000", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok, err := parseSelection(strings.Fields(tt.cmdline))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(interfaceSelection{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+// fakeListenLLDP returns a listenLLDP sending frames, then nothing until ctx is done.
+func fakeListenLLDP(frames []lldpFrame) func(context.Context, []netlink.Link) <-chan lldpFrame {
+	return func(ctx context.Context, _ []netlink.Link) <-chan lldpFrame {
+		ch := make(chan lldpFrame)
+		go func() {
+			defer close(ch)
+			for _, f := range frames {
+				select {
+				case ch <- f:
+				case <-ctx.Done():
+					return
+				}
+			}
+			<-ctx.Done()
+		}()
+		return ch
+	}
+}
+
+func TestSelectInterface(t *testing.T) {
+	withCarrier := func(l netlink.Link) netlink.Link {
+		l.Attrs().OperState = netlink.OperUp
+		return l
+	}
+	tests := map[string]struct {
+		sel      interfaceSelection
+		links    []netlink.Link
+		frames   []lldpFrame
+		want     string
+		wantDown []string
+		wantErr  bool
+	}{
+		"mac": {
+			sel:   interfaceSelection{kind: selectByMAC, mac: net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}},
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")},
+			want:  "eth1",
+		},
+		"mac with vlan": {
+			sel:   interfaceSelection{kind: selectByMAC, mac: net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}, vlan: 30},
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")},
+			want:  "eth1.30",
+		},
+		"pci": {
+			sel:   interfaceSelection{kind: selectByPCI, pci: "0000:3b:00.1"},
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")},
+			want:  "eth1",
+		},
+		"carrier": {
+			sel:      interfaceSelection{kind: selectByCarrier},
+			links:    []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), withCarrier(device(3, "eth1", "de:ad:be:ef:00:02")), withCarrier(device(4, "eth2", "de:ad:be:ef:00:03"))},
+			want:     "eth1",
+			wantDown: []string{"eth0", "eth2"},
+		},
+		"no carrier": {
+			sel:     interfaceSelection{kind: selectByCarrier},
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			wantErr: true,
+		},
+		"lldp": {
+			sel:   interfaceSelection{kind: selectByLLDP, lldpName: "tor-01", lldpPort: "Ethernet12"},
+			links: []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")},
+			frames: []lldpFrame{
+				{iface: "eth0", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet11", SystemName: "tor-01"}},
+				{iface: "eth1", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet12", SystemName: "tor-01"}},
+			},
+			want:     "eth1",
+			wantDown: []string{"eth0"},
+		},
+		"lldp by chassis id": {
+			sel:    interfaceSelection{kind: selectByLLDP, lldpName: "00:11:22:33:44:66"},
+			links:  []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01"), device(3, "eth1", "de:ad:be:ef:00:02")},
+			frames: []lldpFrame{{iface: "eth0", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:66", PortID: "Ethernet1"}}},
+			want:   "eth0",
+		},
+		"no lldp neighbor": {
+			sel:     interfaceSelection{kind: selectByLLDP, lldpName: "tor-02"},
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			frames:  []lldpFrame{{iface: "eth0", neighbor: lldpNeighbor{ChassisID: "00:11:22:33:44:55", PortID: "Ethernet11", SystemName: "tor-01"}}},
+			wantErr: true,
+		},
+		"no match": {
+			sel:     interfaceSelection{kind: selectByPCI, pci: "0000:af:00.0"},
+			links:   []netlink.Link{device(2, "eth0", "de:ad:be:ef:00:01")},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			nl := newFakeNetlink(tt.links...)
+			root := t.TempDir()
+			for i, l := range tt.links {
+				dir := filepath.Join(root, "/sys/class/net", l.Attrs().Name)
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink("../../../0000:3b:00."+string(rune('0'+i)), filepath.Join(dir, "device")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Virtual interfaces have no device and are never selected.
+			nl.links = append(nl.links, device(1, "lo", "00:00:00:00:00:00"))
+
+			c := &configurator{
+				nl:             nl,
+				root:           root,
+				listenLLDP:     fakeListenLLDP(tt.frames),
+				carrierTimeout: 50 * time.Millisecond,
+				lldpTimeout:    50 * time.Millisecond,
+				pollInterval:   10 * time.Millisecond,
+			}
+			got, err := c.selectInterface(context.Background(), tt.sel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !nl.up[tt.want] {
+				t.Errorf("%s is not up", tt.want)
+			}
+			for _, name := range tt.wantDown {
+				if nl.up[name] {
+					t.Errorf("%s was not brought back down", name)
+				}
+			}
+			b, err := os.ReadFile(filepath.Join(root, dhcpInterfacesFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want+"\n" {
+				t.Errorf("got DHCP interfaces %q, want %q", b, tt.want+"\n")
+			}
+		})
+	}
+}
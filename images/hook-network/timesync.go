@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// timeSyncFile reports the result of the time sync, for BootKit and troubleshooting.
+	timeSyncFile = "/run/network/time-sync.json"
+	// dhcpcdLeaseGlob matches the DHCPv4 leases of dhcpcd, which are the raw DHCPACKs.
+	dhcpcdLeaseGlob = "/var/lib/dhcpcd/*.lease"
+	// rtcDevice is the hardware clock the time is written to once it is synced.
+	rtcDevice = "/dev/rtc0"
+	// defaultNTPServer is used when no NTP server is configured.
+	defaultNTPServer = "pool.ntp.org"
+
+	// timeSyncAttempts is how many times all the NTP servers are queried before giving up.
+	timeSyncAttempts = 5
+	// clockSkewWarning is the clock skew above which TLS certificates are likely to be rejected,
+	// as not valid yet or expired.
+	clockSkewWarning = time.Minute
+)
+
+// timeSync is the result of the time sync.
+type timeSync struct {
+	Servers []string `json:"servers"`
+	// Server is the NTP server the clock was set from.
+	Server string `json:"server,omitempty"`
+	Synced bool   `json:"synced"`
+	// SkewSeconds is how far the clock was off before it was set, positive when it was behind.
+	SkewSeconds float64   `json:"skewSeconds"`
+	Stratum     int       `json:"stratum,omitempty"`
+	RTCWritten  bool      `json:"rtcWritten"`
+	Error       string    `json:"error,omitempty"`
+	CheckedAt   time.Time `json:"checkedAt"`
+}
+
+// ntpServers returns the NTP servers to sync the time with, in order: hook_ntp_servers=, the NTP
+// servers of the static network configuration or of the built-in DHCP client, and the NTP servers
+// (DHCP option 42) in the dhcpcd leases. It returns the default NTP server when there are none.
+func (c *configurator) ntpServers(cmdLines []string) []string {
+	var servers []string
+	for _, l := range cmdLines {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(l), "hook_ntp_servers="); ok {
+			servers = appendNew(servers, splitList(v)...)
+		}
+	}
+	if cfg, ok, err := parseCmdLine(cmdLines); err == nil && ok {
+		servers = appendNew(servers, cfg.NTP...)
+	}
+	if b, err := os.ReadFile(filepath.Join(c.root, ntpServersFile)); err == nil {
+		servers = appendNew(servers, strings.Fields(string(b))...)
+	}
+	leases, _ := filepath.Glob(filepath.Join(c.root, dhcpcdLeaseGlob))
+	for _, name := range leases {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		ack, err := dhcpv4.FromBytes(b)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ack.NTPServers() {
+			servers = appendNew(servers, ip.String())
+		}
+	}
+	if len(servers) == 0 {
+		return []string{defaultNTPServer}
+	}
+	return servers
+}
+
+// syncTime sets the clock from the first NTP server that answers, trying all of them up to
+// timeSyncAttempts times, then writes the time to the RTC and the result to the time sync file.
+// When no server answers, a clock that is behind clockFloor is set to it, which is closer to the
+// actual time than the epoch that machines without an RTC boot with.
+func (c *configurator) syncTime(servers []string) (timeSync, error) {
+	result := timeSync{Servers: servers}
+	var errs []error
+	for attempt := 1; attempt <= timeSyncAttempts && !result.Synced; attempt++ {
+		if attempt > 1 {
+			time.Sleep(c.timeSyncInterval)
+		}
+		errs = nil
+		for _, s := range servers {
+			resp, err := c.queryNTP(s)
+			if err == nil {
+				err = resp.Validate()
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s, err))
+				continue
+			}
+			if err := c.setClock(time.Now().Add(resp.ClockOffset)); err != nil {
+				return result, fmt.Errorf("setting the clock failed: %w", err)
+			}
+			result.Server, result.Synced = s, true
+			result.SkewSeconds = resp.ClockOffset.Seconds()
+			result.Stratum = int(resp.Stratum)
+			break
+		}
+	}
+
+	var err error
+	if result.Synced {
+		if werr := c.writeRTC(time.Now()); werr != nil {
+			fmt.Printf("not writing the time to the RTC: %v\n", werr)
+		} else {
+			result.RTCWritten = true
+		}
+	} else {
+		err = fmt.Errorf("no NTP server answered in %d attempts: %w", timeSyncAttempts, errors.Join(errs...))
+		result.Error = err.Error()
+		if time.Now().Before(c.clockFloor) {
+			if serr := c.setClock(c.clockFloor); serr != nil {
+				fmt.Printf("setting the clock to %v failed: %v\n", c.clockFloor, serr)
+			}
+		}
+	}
+	result.CheckedAt = time.Now().UTC()
+
+	b, merr := json.MarshalIndent(result, "", "  ")
+	if merr != nil {
+		return result, merr
+	}
+	if werr := c.writeFile(timeSyncFile, append(b, '\n')); werr != nil {
+		return result, werr
+	}
+	return result, err
+}
+
+// queryNTP queries an NTP server with SNTP.
+func queryNTP(server string) (*ntp.Response, error) {
+	return ntp.QueryWithOptions(server, ntp.QueryOptions{Timeout: 5 * time.Second})
+}
+
+// setClock sets the system clock.
+func setClock(t time.Time) error {
+	tv := unix.NsecToTimeval(t.UnixNano())
+	return unix.Settimeofday(&tv)
+}
+
+// writeRTC sets the hardware clock, in UTC.
+func writeRTC(t time.Time) error {
+	fd, err := unix.Open(rtcDevice, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	t = t.UTC()
+	return unix.IoctlSetRTCTime(fd, &unix.RTCTime{
+		Sec:  int32(t.Second()),
+		Min:  int32(t.Minute()),
+		Hour: int32(t.Hour()),
+		Mday: int32(t.Day()),
+		Mon:  int32(t.Month()) - 1,
+		Year: int32(t.Year()) - 1900,
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestNTPServers(t *testing.T) {
+	lease, err := dhcpv4.New(dhcpv4.WithOption(dhcpv4.OptNTPServers(net.IPv4(10, 0, 0, 123), net.IPv4(10, 0, 0, 124))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		cmdline    string
+		ntpServers string
+		lease      []byte
+		want       []string
+	}{
+		"default":          {want: []string{defaultNTPServer}},
+		"config key":       {cmdline: "hook_ntp_servers=ntp1.example,ntp2.example", want: []string{"ntp1.example", "ntp2.example"}},
+		"ipam":             {cmdline: "ipam=de-ad-be-ef-fe-ed::10.0.0.2:255.255.255.0:10.0.0.1::10.0.0.53::10.0.0.123", want: []string{"10.0.0.123"}},
+		"hook-network":     {ntpServers: "10.0.0.123\n", want: []string{"10.0.0.123"}},
+		"dhcpcd lease":     {lease: lease.ToBytes(), want: []string{"10.0.0.123", "10.0.0.124"}},
+		"invalid lease":    {lease: []byte("not a lease"), want: []string{defaultNTPServer}},
+		"in order, merged": {cmdline: "hook_ntp_servers=ntp1.example", ntpServers: "10.0.0.124\n", lease: lease.ToBytes(), want: []string{"ntp1.example", "10.0.0.124", "10.0.0.123"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &configurator{root: t.TempDir()}
+			if tt.ntpServers != "" {
+				if err := c.writeFile(ntpServersFile, []byte(tt.ntpServers)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.lease != nil {
+				if err := c.writeFile("/var/lib/dhcpcd/eth0.lease", tt.lease); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if diff := cmp.Diff(tt.want, c.ntpServers(strings.Fields(tt.cmdline))); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestSyncTime(t *testing.T) {
+	valid := func(offset time.Duration) *ntp.Response {
+		now := time.Now()
+		return &ntp.Response{Time: now, ReferenceTime: now.Add(-time.Minute), Stratum: 2, ClockOffset: offset}
+	}
+	future := time.Now().Add(24 * time.Hour)
+	tests := map[string]struct {
+		responses  map[string]*ntp.Response
+		rtcErr     error
+		clockFloor time.Time
+		want       timeSync
+		wantClock  bool
+		wantErr    bool
+	}{
+		"first server": {
+			responses: map[string]*ntp.Response{"ntp1": valid(-2 * time.Hour), "ntp2": valid(time.Second)},
+			want:      timeSync{Servers: []string{"ntp1", "ntp2"}, Server: "ntp1", Synced: true, SkewSeconds: -7200, Stratum: 2, RTCWritten: true},
+			wantClock: true,
+		},
+		"falls over to the next server": {
+			responses: map[string]*ntp.Response{"ntp2": valid(90 * time.Second)},
+			want:      timeSync{Servers: []string{"ntp1", "ntp2"}, Server: "ntp2", Synced: true, SkewSeconds: 90, Stratum: 2, RTCWritten: true},
+			wantClock: true,
+		},
+		"invalid responses are skipped": {
+			responses: map[string]*ntp.Response{"ntp1": {Time: time.Now(), Stratum: 0}, "ntp2": valid(time.Second)},
+			want:      timeSync{Servers: []string{"ntp1", "ntp2"}, Server: "ntp2", Synced: true, SkewSeconds: 1, Stratum: 2, RTCWritten: true},
+			wantClock: true,
+		},
+		"no rtc": {
+			responses: map[string]*ntp.Response{"ntp1": valid(time.Second)},
+			rtcErr:    os.ErrNotExist,
+			want:      timeSync{Servers: []string{"ntp1", "ntp2"}, Server: "ntp1", Synced: true, SkewSeconds: 1, Stratum: 2},
+			wantClock: true,
+		},
+		"no server answers": {
+			want:    timeSync{Servers: []string{"ntp1", "ntp2"}},
+			wantErr: true,
+		},
+		"no server answers, clock behind the floor": {
+			clockFloor: future,
+			want:       timeSync{Servers: []string{"ntp1", "ntp2"}},
+			wantClock:  true,
+			wantErr:    true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var clockSet, rtcSet bool
+			c := &configurator{
+				root: t.TempDir(),
+				queryNTP: func(server string) (*ntp.Response, error) {
+					if r, ok := tt.responses[server]; ok {
+						return r, nil
+					}
+					return nil, errors.New("i/o timeout")
+				},
+				setClock:   func(time.Time) error { clockSet = true; return nil },
+				writeRTC:   func(time.Time) error { rtcSet = true; return tt.rtcErr },
+				clockFloor: tt.clockFloor,
+			}
+			got, err := c.syncTime([]string{"ntp1", "ntp2"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreFields(timeSync{}, "CheckedAt", "Error")); diff != "" {
+				t.Error(diff)
+			}
+			if clockSet != tt.wantClock {
+				t.Errorf("got clock set %v, want %v", clockSet, tt.wantClock)
+			}
+			if rtcSet != tt.want.Synced {
+				t.Errorf("got RTC written %v, want %v", rtcSet, tt.want.Synced)
+			}
+
+			b, err := os.ReadFile(filepath.Join(c.root, timeSyncFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written timeSync
+			if err := json.Unmarshal(b, &written); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, written); diff != "" {
+				t.Errorf("time sync file: %s", diff)
+			}
+		})
+	}
+}